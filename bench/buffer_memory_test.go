@@ -0,0 +1,72 @@
+package bench
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxshardmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// BenchmarkMemoryBufferWrite measures throughput of concurrent producers, while the buffer is flushed in the background.
+// The difference between engines shows up on multicore machines only, e.g.:
+// go test ./bench -run none -bench BenchmarkMemoryBufferWrite -cpu 8
+func BenchmarkMemoryBufferWrite(b *testing.B) {
+	engines := []struct {
+		name string
+		new  func(uint) cx.Buffer
+	}{
+		{name: "cxsyncmem", new: cxsyncmem.NewBuffer},
+		{name: "cxshardmem", new: func(size uint) cx.Buffer {
+			return cxshardmem.NewBuffer(size)
+		}},
+	}
+	for _, producers := range []int{1, 8, 64} {
+		for _, engine := range engines {
+			producers, engine := producers, engine
+			b.Run(engine.name+"/producers-"+strconv.Itoa(producers), func(b *testing.B) {
+				benchmarkConcurrentWrite(b, engine.new(10000), producers)
+			})
+		}
+	}
+}
+
+func benchmarkConcurrentWrite(b *testing.B, buf cx.Buffer, producers int) {
+	row := cx.Vector{int32(1), "uuid", "insert_ts"}
+	var stop int32
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for atomic.LoadInt32(&stop) == 0 {
+			if buf.Len() >= 10000 {
+				buf.Read()
+				buf.Flush()
+			}
+			runtime.Gosched()
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		n := b.N / producers
+		if p < b.N%producers {
+			n++
+		}
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				buf.Write(row)
+			}
+		}(n)
+	}
+	wg.Wait()
+	b.StopTimer()
+	atomic.StoreInt32(&stop, 1)
+	<-flushed
+}
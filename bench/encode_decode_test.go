@@ -139,3 +139,57 @@ func decode(x int, b *testing.B) {
 		_, _ = encodes[i].Decode()
 	}
 }
+
+func codecs() []cx.Codec {
+	rowBinary, _ := cx.NewRowBinaryCodec(cx.NewTypedView("bench", []string{"id", "uuid", "insert_ts"},
+		[]string{"Int64", "String", "String"},
+	))
+	return []cx.Codec{cx.NewGobCodec(), cx.NewBinaryCodec(), cx.NewJSONCodec(), rowBinary}
+}
+
+// BenchmarkCodecEncode compares the codecs on the same row, each iteration encodes 1000 rows
+func BenchmarkCodecEncode(b *testing.B) {
+	for _, codec := range codecs() {
+		codec := codec
+		b.Run(codec.Name(), func(b *testing.B) {
+			now := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 1000; j++ {
+					r := row{
+						id:       j,
+						uuid:     "uuid_here",
+						insertTS: now,
+					}
+					_, _ = codec.Encode(r.Row())
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCodecDecode compares the codecs on the same row, each iteration decodes 1000 rows
+func BenchmarkCodecDecode(b *testing.B) {
+	for _, codec := range codecs() {
+		codec := codec
+		b.Run(codec.Name(), func(b *testing.B) {
+			now := time.Now()
+			encodes := make([]cx.VectorDecoded, 0, 1000)
+			for j := 0; j < 1000; j++ {
+				r := row{
+					id:       j,
+					uuid:     "uuid_here",
+					insertTS: now,
+				}
+				enc, _ := codec.Encode(r.Row())
+				encodes = append(encodes, cx.VectorDecoded(enc))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range encodes {
+					_, _ = encodes[j].DecodeWith(codec)
+				}
+			}
+		})
+	}
+}
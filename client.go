@@ -3,6 +3,7 @@ package clickhousebuffer
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
 	"github.com/zikwall/clickhouse-buffer/v4/src/retry"
@@ -20,14 +21,22 @@ type Client interface {
 	WriteBatch(context.Context, cx.View, *cx.Batch) error
 	// Writer returns the asynchronous, non-blocking, Writer client.
 	// Ensures using a single Writer instance for each table pair.
-	Writer(context.Context, cx.View, cx.Buffer) Writer
+	// Options override the options of the client for this Writer, they are applied when the Writer is created
+	Writer(context.Context, cx.View, cx.Buffer, ...Option) Writer
+	// WriterV2 same as Writer, but uses the buffer engine of the second version
+	WriterV2(context.Context, cx.View, cx.BufferV2, ...Option) Writer
 	// WriterBlocking returns the synchronous, blocking, WriterBlocking client.
 	// Ensures using a single WriterBlocking instance for each table pair.
 	WriterBlocking(cx.View) WriterBlocking
+	// FlushAll flushes all asynchronous Writer-s and waits for the result of their inserts
+	FlushAll(ctx context.Context) error
 	// RetryClient Get retry client
 	RetryClient() retry.Retryable
 	// Close ensures all ongoing asynchronous write clients finish.
 	Close()
+	// Shutdown closes all asynchronous Writer-s in parallel and drains the retry queue within the deadline of the context,
+	// returns *ShutdownError with the number of rows that were not delivered
+	Shutdown(ctx context.Context) error
 }
 
 // Implementation of the Client interface
@@ -39,7 +48,10 @@ type clientImpl struct {
 	syncWriteAPIs map[string]WriterBlocking
 	mu            sync.RWMutex
 	retry         retry.Retryable
+	retryMu       sync.Mutex
 	logger        cx.Logger
+	// options of writers by name of the view, retry events are passed to their hooks and metrics
+	viewOptions sync.Map
 }
 
 // NewClient creates an object implementing the Client interface with default options
@@ -64,16 +76,27 @@ func NewClientWithOptions(ctx context.Context, clickhouse cx.Clickhouse, options
 	}
 	// if resending undelivered messages is enabled, safely check all the necessary settings
 	if options.isRetryEnabled {
+		client.retryClient()
+	}
+	return client
+}
+
+// retryClient returns the retry client, it is created on demand if retries are enabled only for some Writer-s
+func (c *clientImpl) retryClient() retry.Retryable {
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
+	if c.retry == nil {
 		// if no custom engine is specified for queues, we use the default engine,
 		// in most cases, this covers all cases.
-		if options.queue == nil {
-			options.queue = retry.NewImMemoryQueueEngine()
+		if c.options.queue == nil {
+			c.options.queue = retry.NewImMemoryQueueEngine()
 		}
-		client.retry = retry.NewRetry(
-			ctx, options.queue, retry.NewDefaultWriter(clickhouse), options.logger, options.isDebug,
+		c.retry = retry.NewRetry(
+			c.context, c.options.queue, retry.NewDefaultWriter(c.clickhouse), c.options.logger, c.options.isDebug,
+			retry.WithObserver(retryObserver{client: c}),
 		)
 	}
-	return client
+	return c.retry
 }
 
 // Options return global options object
@@ -83,11 +106,26 @@ func (c *clientImpl) Options() *Options {
 
 // Writer returns the asynchronous, non-blocking, Writer client.
 // Ensures using a single Writer instance for each table pair.
-func (c *clientImpl) Writer(ctx context.Context, view cx.View, buf cx.Buffer) Writer {
+func (c *clientImpl) Writer(ctx context.Context, view cx.View, buf cx.Buffer, opts ...Option) Writer {
 	key := view.Name
 	c.mu.Lock()
 	if _, ok := c.writeAPIs[key]; !ok {
-		c.writeAPIs[key] = NewWriter(ctx, c, view, buf)
+		c.writeAPIs[key] = NewWriter(ctx, c, view, buf, opts...)
+		c.viewOptions.Store(view.Name, c.writeAPIs[key].Options())
+	}
+	writer := c.writeAPIs[key]
+	c.mu.Unlock()
+	return writer
+}
+
+// WriterV2 same as Writer, but uses the buffer engine of the second version.
+// Ensures using a single Writer instance for each table pair.
+func (c *clientImpl) WriterV2(ctx context.Context, view cx.View, buf cx.BufferV2, opts ...Option) Writer {
+	key := view.Name
+	c.mu.Lock()
+	if _, ok := c.writeAPIs[key]; !ok {
+		c.writeAPIs[key] = NewWriterV2(ctx, c, view, buf, opts...)
+		c.viewOptions.Store(view.Name, c.writeAPIs[key].Options())
 	}
 	writer := c.writeAPIs[key]
 	c.mu.Unlock()
@@ -131,22 +169,127 @@ func (c *clientImpl) Close() {
 	c.mu.Unlock()
 }
 
+// Shutdown flushes and closes all asynchronous Writer-s in parallel, waits for their batches, including retries,
+// then waits for the retry queue to drain and closes the cx.Clickhouse connection if WithCloseClickhouse is set.
+// At the deadline the retry worker is stopped and waited for, so the connection is not closed under a running retry.
+// Packets left in the retry queue stay in the queue engine, so persistent engines keep them,
+// packets of the default in-memory engine are completed with retry.ErrRetryStopped.
+// It returns *ShutdownError if some rows were not delivered or the deadline was reached
+func (c *clientImpl) Shutdown(ctx context.Context) error {
+	if c.options.isDebug {
+		c.logger.Log("shutdown clickhouse buffer client")
+	}
+	c.mu.Lock()
+	writers := c.writeAPIs
+	c.writeAPIs = map[string]Writer{}
+	c.syncWriteAPIs = map[string]WriterBlocking{}
+	c.mu.Unlock()
+	type result struct {
+		table       string
+		undelivered int
+	}
+	results := make(chan result, len(writers))
+	for table, w := range writers {
+		go func(table string, w Writer) {
+			if impl, ok := w.(*writer); ok {
+				results <- result{table: table, undelivered: impl.shutdown(ctx)}
+				return
+			}
+			w.Close()
+			results <- result{table: table}
+		}(table, w)
+	}
+	undelivered := map[string]int{}
+	for range writers {
+		if r := <-results; r.undelivered > 0 {
+			undelivered[r.table] = r.undelivered
+		}
+	}
+	var cause error
+	if drainable, ok := c.RetryClient().(retry.Drainable); ok {
+		cause = drainable.Drain(ctx)
+	}
+	if cause == nil {
+		cause = ctx.Err()
+	}
+	if c.options.closeClickhouse {
+		if err := c.clickhouse.Close(); err != nil && cause == nil {
+			cause = err
+		}
+	}
+	if len(undelivered) == 0 && cause == nil {
+		return nil
+	}
+	return &ShutdownError{Undelivered: undelivered, Err: cause}
+}
+
+// FlushAll flushes all asynchronous Writer-s concurrently, returns the first error
+func (c *clientImpl) FlushAll(ctx context.Context) error {
+	c.mu.RLock()
+	writers := make([]Writer, 0, len(c.writeAPIs))
+	for _, w := range c.writeAPIs {
+		writers = append(writers, w)
+	}
+	c.mu.RUnlock()
+	errs := make(chan error, len(writers))
+	for _, w := range writers {
+		go func(w Writer) {
+			errs <- w.Flush(ctx)
+		}(w)
+	}
+	var first error
+	for range writers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
 // WriteBatch API top-level method for writing to Clickhouse database.
 // All child Writer-s use this method to write their accumulated and encapsulated data.
+// Failed inserts are returned as *WriteError
 func (c *clientImpl) WriteBatch(ctx context.Context, view cx.View, batch *cx.Batch) error {
+	return c.writeBatch(ctx, view, batch, c.options)
+}
+
+// writeBatch writes the batch with options of the Writer
+func (c *clientImpl) writeBatch(ctx context.Context, view cx.View, batch *cx.Batch, options *Options) error {
+	if options.insertTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.insertTimeout)
+		defer cancel()
+	}
+	start := time.Now()
 	_, err := c.clickhouse.Insert(ctx, view, batch.Rows())
+	latency := time.Since(start)
 	if err != nil {
 		// if there is an acceptable error and if the functionality of resending data is activated,
 		// try to repeat the operation
-		if c.options.isRetryEnabled && cx.IsResendAvailable(err) {
-			c.retry.Retry(retry.NewPacket(view, batch))
+		// the batch is completed by the retry worker then
+		retried := options.isRetryEnabled && cx.IsResendAvailable(err)
+		writeErr := newWriteError(view, batch, err, retried)
+		if hooks := options.lifecycle(); hooks != nil {
+			hooks.OnInsertError(newHookEvent(hooks, view, batch.Rows(), latency, writeErr))
 		}
-		return err
+		if retried {
+			c.retryClient().Retry(retry.NewPacket(view, batch))
+			c.observeRetryQueue(options)
+			return writeErr
+		}
+		batch.Done(err)
+		return writeErr
+	}
+	if hooks := options.lifecycle(); hooks != nil {
+		hooks.OnInsertSuccess(newHookEvent(hooks, view, batch.Rows(), latency, nil))
 	}
+	batch.Done(nil)
 	return nil
 }
 
 // RetryClient returns implementation of the retry.Retryable interface
 func (c *clientImpl) RetryClient() retry.Retryable {
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
 	return c.retry
 }
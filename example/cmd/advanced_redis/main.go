@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/gob"
 	"log"
 	"os"
 	"sync"
@@ -62,19 +61,22 @@ func main() {
 		clickhousebuffer.WithDebugMode(true),
 		clickhousebuffer.WithRetry(false),
 	))
+	// the view knows types of the columns, so rows are stored in redis in compact RowBinary format,
+	// there is no need to register the types of values as it is required by gob
+	view := cx.NewTypedView(tables.AdvancedTableName(), tables.AdvancedTableColumns(), tables.AdvancedTableTypes())
+	codec, err := cx.NewRowBinaryCodec(view)
+	if err != nil {
+		log.Panicln(err)
+	}
 	rxbuffer, err := cxredis.NewBuffer(ctx, redis.NewClient(&redis.Options{
 		Addr:     redisHost,
 		Password: redisPass,
 		DB:       10,
-	}), "bucket", client.Options().BatchSize())
+	}), "bucket", client.Options().BatchSize(), cxredis.WithCodec(codec), cxredis.WithView(view))
 	if err != nil {
 		log.Panicln(err)
 	}
-	writeAPI := client.Writer(
-		ctx,
-		cx.NewView(tables.AdvancedTableName(), tables.AdvancedTableColumns()),
-		rxbuffer,
-	)
+	writeAPI := client.Writer(ctx, view, rxbuffer)
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -86,14 +88,6 @@ func main() {
 		wg.Done()
 	}()
 
-	// before register data types
-	gob.Register(uuid.UUID{})
-	// Tuple
-	gob.Register([]interface{}{})
-	gob.Register(time.Time{})
-	// array of Tuple
-	gob.Register([][]interface{}{})
-
 	write(writeAPI)
 
 	<-time.After(time.Second * 2)
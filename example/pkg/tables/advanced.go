@@ -42,6 +42,24 @@ func AdvancedTableColumns() []string {
 	return []string{"Col1", "Col2", "Col3", "Col4", "Col6", "Col7", "Col8", "Col9", "Col10", "Col11", "Col12", "Col13"}
 }
 
+// AdvancedTableTypes returns types of the columns in the same order, use it with cx.NewTypedView
+func AdvancedTableTypes() []string {
+	return []string{
+		"UInt8",
+		"String",
+		"FixedString(3)",
+		"UUID",
+		"Array(String)",
+		"Tuple(String, UInt8, Array(String), Tuple(DateTime, UInt32))",
+		"DateTime",
+		"Enum('hello' = 1, 'world' = 2)",
+		"DateTime64",
+		"Bool",
+		"Date",
+		"Array(Tuple(String, UInt8, Array(String), Tuple(DateTime, UInt32)))",
+	}
+}
+
 // nolint:gochecknoglobals // it's OK
 // SELECT DISTINCT alias_to
 // FROM system.data_type_families
@@ -0,0 +1,304 @@
+package cxfailover
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+	"github.com/zikwall/clickhouse-buffer/v4/src/metrics"
+)
+
+const defaultProbeInterval = 5 * time.Second
+
+// Buffer is a composite engine, it writes rows to the primary engine (e.g. Redis) while it is healthy,
+// and to the secondary engine (memory or local disk) after the primary fails
+type Buffer interface {
+	cx.BufferV2
+	cx.Acknowledger
+	// Metrics returns counters of mode switches and writes
+	Metrics() Metrics
+}
+
+// Metrics of the failover buffer
+type Metrics struct {
+	// Failovers is the number of switches to the secondary engine
+	Failovers uint64
+	// Recoveries is the number of switches back to the primary engine
+	Recoveries uint64
+	// SecondaryWrites is the number of rows written to the secondary engine
+	SecondaryWrites uint64
+	// Degraded is true while rows are written to the secondary engine
+	Degraded bool
+}
+
+type options struct {
+	probeInterval time.Duration
+	restore       bool
+	logger        cx.Logger
+	metrics       metrics.Collector
+}
+
+type Option func(o *options)
+
+// WithProbeInterval sets how often the primary engine is tried again while it is failed, default 5s
+func WithProbeInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.probeInterval = interval
+	}
+}
+
+// WithRestore moves rows of the secondary engine back into the primary engine once it recovers,
+// e.g. to hand them over to other instances sharing the Redis bucket.
+// By default rows of the secondary engine are sent to Clickhouse with the next batch
+func WithRestore() Option {
+	return func(o *options) {
+		o.restore = true
+	}
+}
+
+// WithLogger sets the logger of mode switches, default is cx.NewDefaultLogger()
+func WithLogger(logger cx.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithMetrics reports mode switches and writes to the secondary engine to the collector,
+// see metrics.Failovers, metrics.Recoveries, metrics.SecondaryWrites and metrics.Degraded
+func WithMetrics(collector metrics.Collector) Option {
+	return func(o *options) {
+		o.metrics = collector
+	}
+}
+
+// drained remembers which engines returned rows of the batch, so that the batch is acknowledged by them only
+type drained struct {
+	primary   bool
+	secondary bool
+}
+
+type failover struct {
+	primary   cx.BufferV2
+	secondary cx.BufferV2
+	options   *options
+	degraded  int32
+	// guards switching of the mode
+	mu sync.Mutex
+	// serializes reads of the secondary engine by Drain and restore, so that its acknowledgements stay in order
+	drainMu     sync.Mutex
+	lastFailure time.Time
+	// batches returned by Drain and not yet acknowledged
+	acks            []drained
+	failovers       uint64
+	recoveries      uint64
+	secondaryWrites uint64
+}
+
+// NewBuffer returns the failover buffer over the primary and the secondary engines
+func NewBuffer(primary, secondary cx.BufferV2, opts ...Option) Buffer {
+	o := &options{
+		probeInterval: defaultProbeInterval,
+		logger:        cx.NewDefaultLogger(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return &failover{
+		primary:   primary,
+		secondary: secondary,
+		options:   o,
+	}
+}
+
+// Write writes the row to the primary engine, if it fails, the row and the following rows are written
+// to the secondary engine, until the probe of the primary succeeds
+func (f *failover) Write(ctx context.Context, row cx.Vector) error {
+	if !f.isDegraded() || f.shouldProbe() {
+		err := f.primary.Write(ctx, row)
+		if err == nil {
+			if f.isDegraded() {
+				f.recover(ctx)
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		f.fail(err)
+	}
+	atomic.AddUint64(&f.secondaryWrites, 1)
+	if f.options.metrics != nil {
+		f.options.metrics.Add(metrics.SecondaryWrites, 1)
+	}
+	return f.secondary.Write(ctx, row)
+}
+
+// Drain returns rows of the secondary engine followed by rows of the primary one, if it is healthy.
+// If the primary engine fails, rows of the secondary engine are returned together with the error
+func (f *failover) Drain(ctx context.Context) ([]cx.Vector, error) {
+	f.drainMu.Lock()
+	defer f.drainMu.Unlock()
+	rows, err := f.secondary.Drain(ctx)
+	if err != nil {
+		return nil, err
+	}
+	secondary := len(rows) > 0
+	var primary bool
+	if !f.isDegraded() {
+		var primaryRows []cx.Vector
+		if primaryRows, err = f.primary.Drain(ctx); err != nil && ctx.Err() == nil {
+			f.fail(err)
+		}
+		primary = len(primaryRows) > 0
+		rows = append(rows, primaryRows...)
+	}
+	if primary || secondary {
+		f.mu.Lock()
+		f.acks = append(f.acks, drained{primary: primary, secondary: secondary})
+		f.mu.Unlock()
+	}
+	return rows, err
+}
+
+func (f *failover) Len() int {
+	if f.isDegraded() {
+		return f.secondary.Len()
+	}
+	return f.primary.Len() + f.secondary.Len()
+}
+
+// Close closes both engines
+func (f *failover) Close() error {
+	err := f.primary.Close()
+	if secondaryErr := f.secondary.Close(); err == nil {
+		err = secondaryErr
+	}
+	return err
+}
+
+// Ack passes the result of the batch to the engines that returned its rows
+func (f *failover) Ack(batch *cx.Batch, err error) {
+	f.mu.Lock()
+	if len(f.acks) == 0 {
+		f.mu.Unlock()
+		return
+	}
+	next := f.acks[0]
+	f.acks = f.acks[1:]
+	f.mu.Unlock()
+	if ack, ok := f.primary.(cx.Acknowledger); ok && next.primary {
+		ack.Ack(batch, err)
+	}
+	if ack, ok := f.secondary.(cx.Acknowledger); ok && next.secondary {
+		ack.Ack(batch, err)
+	}
+}
+
+func (f *failover) Metrics() Metrics {
+	return Metrics{
+		Failovers:       atomic.LoadUint64(&f.failovers),
+		Recoveries:      atomic.LoadUint64(&f.recoveries),
+		SecondaryWrites: atomic.LoadUint64(&f.secondaryWrites),
+		Degraded:        f.isDegraded(),
+	}
+}
+
+func (f *failover) isDegraded() bool {
+	return atomic.LoadInt32(&f.degraded) == 1
+}
+
+// shouldProbe returns true once in the probe interval while the primary engine is failed
+func (f *failover) shouldProbe() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.lastFailure) < f.options.probeInterval {
+		return false
+	}
+	// other writers keep using the secondary engine while this one probes the primary
+	f.lastFailure = time.Now()
+	return true
+}
+
+func (f *failover) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lastFailure = time.Now()
+	if atomic.CompareAndSwapInt32(&f.degraded, 0, 1) {
+		atomic.AddUint64(&f.failovers, 1)
+		f.observe(metrics.Failovers, 1)
+		f.options.logger.Logf("failover buffer: primary engine failed, writing to secondary: %v", err)
+	}
+}
+
+func (f *failover) recover(ctx context.Context) {
+	f.mu.Lock()
+	if !atomic.CompareAndSwapInt32(&f.degraded, 1, 0) {
+		f.mu.Unlock()
+		return
+	}
+	atomic.AddUint64(&f.recoveries, 1)
+	f.observe(metrics.Recoveries, 0)
+	f.mu.Unlock()
+	f.options.logger.Logf("failover buffer: primary engine recovered, %d rows left in secondary", f.secondary.Len())
+	if f.options.restore {
+		f.restore(ctx)
+	}
+}
+
+// restore moves rows of the secondary engine to the primary one, rows that cannot be moved are written back.
+// The read of the secondary engine is acknowledged as written in both cases, so it is skipped
+// while batches of the secondary engine are in progress, they are acknowledged in the order of reads
+func (f *failover) restore(ctx context.Context) {
+	f.drainMu.Lock()
+	defer f.drainMu.Unlock()
+	if f.secondaryInProgress() {
+		f.options.logger.Log("failover buffer: rows of secondary engine are in progress, they are not restored")
+		return
+	}
+	rows, err := f.secondary.Drain(ctx)
+	if err != nil {
+		f.options.logger.Logf("failover buffer: drain secondary engine: %v", err)
+		return
+	}
+	if len(rows) == 0 {
+		return
+	}
+	defer func() {
+		if ack, ok := f.secondary.(cx.Acknowledger); ok {
+			ack.Ack(cx.NewBatch(rows), nil)
+		}
+	}()
+	for i, row := range rows {
+		if err = f.primary.Write(ctx, row); err != nil {
+			f.fail(err)
+			for _, rest := range rows[i:] {
+				if err = f.secondary.Write(ctx, rest); err != nil {
+					f.options.logger.Logf("failover buffer: row is lost: %v", err)
+				}
+			}
+			return
+		}
+	}
+}
+
+func (f *failover) secondaryInProgress() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, next := range f.acks {
+		if next.secondary {
+			return true
+		}
+	}
+	return false
+}
+
+// observe counts the mode switch and sets the gauge of the mode
+func (f *failover) observe(name string, degraded float64) {
+	if f.options.metrics == nil {
+		return
+	}
+	f.options.metrics.Add(name, 1)
+	f.options.metrics.Set(metrics.Degraded, degraded)
+}
@@ -0,0 +1,407 @@
+package cxfile
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// SyncPolicy determines when written records are forced to stable storage with fsync
+type SyncPolicy int
+
+const (
+	// SyncAlways calls fsync after every written row, the safest and the slowest policy
+	SyncAlways SyncPolicy = iota
+	// SyncInterval calls fsync on write if the configured interval has passed since the last sync
+	SyncInterval
+	// SyncNever leaves flushing of written data to the operating system
+	SyncNever
+)
+
+const (
+	defaultSegmentSize  = 64 << 20
+	defaultSyncInterval = time.Second
+)
+
+type options struct {
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	segmentSize  int64
+	codec        cx.Codec
+	view         cx.View
+	compression  cx.Compression
+	keys         cx.KeyProvider
+	memoryRows   int
+	memoryBytes  int
+}
+
+type Option func(o *options)
+
+// WithSyncPolicy sets the fsync policy, default SyncInterval
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(o *options) {
+		o.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval sets the interval used by the SyncInterval policy, default 1s
+func WithSyncInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.syncInterval = interval
+	}
+}
+
+// WithSegmentSize sets the size in bytes after which the current segment file is rotated, default 64MB
+func WithSegmentSize(size int64) Option {
+	return func(o *options) {
+		o.segmentSize = size
+	}
+}
+
+// WithCodec sets the codec of rows stored in segment files, default is gob.
+// Rows are always wrapped in cx.EnvelopeCodec, so segments written with another registered codec can be replayed
+func WithCodec(codec cx.Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithView sets the view of the envelope, rows written for another version of the view are skipped on replay
+func WithView(view cx.View) Option {
+	return func(o *options) {
+		o.view = view
+	}
+}
+
+// WithCompression sets the compression of the envelope, see cx.WithCompression
+func WithCompression(compression cx.Compression) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithEncryption sets the key provider of the envelope, see cx.WithEncryption
+func WithEncryption(keys cx.KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithMemoryRows sets the number of rows the tiered buffer keeps in memory before spilling them to disk,
+// default is the buffer size
+func WithMemoryRows(rows int) Option {
+	return func(o *options) {
+		o.memoryRows = rows
+	}
+}
+
+// WithMemoryBytes sets the approximate size of rows the tiered buffer keeps in memory before spilling them to disk,
+// by default only the number of rows is limited
+func WithMemoryBytes(size int) Option {
+	return func(o *options) {
+		o.memoryBytes = size
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		syncPolicy:   SyncInterval,
+		syncInterval: defaultSyncInterval,
+		segmentSize:  defaultSegmentSize,
+		codec:        cx.NewGobCodec(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.codec = cx.Enveloped(o.codec, o.view, cx.EnvelopeOptions(o.compression, o.keys)...)
+	return o
+}
+
+// fileBuffer is a write-ahead-log buffer: every row is appended to the current segment file
+// before it becomes visible to Read, so the rows survive a crash of the process.
+// A copy of the rows is kept in memory, the files are only read back on startup.
+// Every Read closes the current segment, segments are removed once the batch of their rows is acknowledged
+type fileBuffer struct {
+	mu       sync.Mutex
+	dir      string
+	options  *options
+	buffer   []cx.Vector
+	segment  *segment
+	lastSync time.Time
+	// rows returned by Read, which are not acknowledged yet
+	reads []read
+}
+
+// read holds the rows returned by Read and the id of the last segment they were stored in
+type read struct {
+	rows []cx.Vector
+	last uint64
+}
+
+// NewBuffer opens (or creates) the WAL directory and replays all rows that were not flushed before
+func NewBuffer(dir string, bufferSize uint, opts ...Option) (cx.Buffer, error) {
+	o := newOptions(opts)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	f := &fileBuffer{
+		dir:      dir,
+		options:  o,
+		buffer:   make([]cx.Vector, 0, bufferSize+1),
+		lastSync: time.Now(),
+	}
+	lastID, err := f.replay()
+	if err != nil {
+		return nil, err
+	}
+	if f.segment, err = openSegment(dir, lastID+1); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *fileBuffer) Write(row cx.Vector) {
+	if err := f.write(row); err != nil {
+		log.Printf("%v\n", err.Error())
+	}
+}
+
+func (f *fileBuffer) write(row cx.Vector) error {
+	buf, err := f.options.codec.Encode(row)
+	if err != nil {
+		return fmt.Errorf("file buffer value encode err: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err = f.append(buf); err != nil {
+		return fmt.Errorf("file buffer write err: %w", err)
+	}
+	f.buffer = append(f.buffer, row)
+	return nil
+}
+
+// Read returns the buffered rows, they are kept in segments until Flush or until their batch is acknowledged
+func (f *fileBuffer) Read() []cx.Vector {
+	rows, err := f.drain()
+	if err != nil {
+		log.Printf("%v\n", err.Error())
+	}
+	return rows
+}
+
+// drain reads rows, they stay in segments until the batch is acknowledged
+func (f *fileBuffer) drain() ([]cx.Vector, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.buffer) == 0 || f.segment == nil {
+		return nil, nil
+	}
+	rows := f.buffer
+	f.buffer = make([]cx.Vector, 0, cap(rows))
+	last := f.segment.id
+	f.reads = append(f.reads, read{rows: rows, last: last})
+	// later rows are written to the next segment, so segments of read rows can be removed separately
+	if err := f.rotate(); err != nil {
+		return rows, fmt.Errorf("file buffer rotate segment err: %w", err)
+	}
+	return rows, nil
+}
+
+func (f *fileBuffer) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.buffer)
+}
+
+// Flush drops all rows and segments, including rows of batches that are not acknowledged yet.
+// The Writer does not call it, batches are acknowledged with Ack instead
+func (f *fileBuffer) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buffer = f.buffer[:0]
+	f.reads = nil
+	if f.segment == nil {
+		return
+	}
+	next := f.segment.id + 1
+	if err := f.segment.close(); err != nil {
+		log.Printf("file buffer close segment err: %v\n", err.Error())
+	}
+	if err := removeSegments(f.dir, f.segment.id); err != nil {
+		log.Printf("file buffer remove segments err: %v\n", err.Error())
+	}
+	var err error
+	if f.segment, err = openSegment(f.dir, next); err != nil {
+		log.Printf("file buffer open segment err: %v\n", err.Error())
+	}
+}
+
+// Ack removes segments of the oldest read batch if it was successfully written.
+// Rows of a batch failed with an error that can be retried are written again and delivered with the next batch,
+// rows of other failed batches are moved to RejectedFile. If the rows cannot be written,
+// the segments are kept and the rows are replayed by the next NewBuffer call
+func (f *fileBuffer) Ack(_ *cx.Batch, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.reads) == 0 {
+		return
+	}
+	next := f.reads[0]
+	f.reads = f.reads[1:]
+	switch {
+	case err == nil:
+	case cx.IsResendAvailable(err):
+		if err = f.requeue(next.rows); err != nil {
+			log.Printf("file buffer requeue err: %v\n", err.Error())
+			return
+		}
+	default:
+		if err = f.reject(next.rows); err != nil {
+			log.Printf("file buffer reject err: %v\n", err.Error())
+			return
+		}
+	}
+	if err = removeSegments(f.dir, next.last); err != nil {
+		log.Printf("file buffer remove segments err: %v\n", err.Error())
+	}
+}
+
+// requeue writes rows of the failed batch to the current segment, they are read before the rows buffered meanwhile
+func (f *fileBuffer) requeue(rows []cx.Vector) error {
+	for _, row := range rows {
+		buf, err := f.options.codec.Encode(row)
+		if err != nil {
+			return err
+		}
+		if err = f.append(buf); err != nil {
+			return err
+		}
+	}
+	if f.segment != nil && f.options.syncPolicy != SyncNever {
+		if err := f.segment.sync(); err != nil {
+			return err
+		}
+	}
+	buffer := make([]cx.Vector, 0, len(rows)+len(f.buffer))
+	f.buffer = append(append(buffer, rows...), f.buffer...)
+	return nil
+}
+
+// reject appends rows of the failed batch to the dead-letter file, so that they do not fail later batches
+func (f *fileBuffer) reject(rows []cx.Vector) error {
+	rejected, err := openFile(RejectedFile(f.dir), 0)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		buf, encodeErr := f.options.codec.Encode(row)
+		if encodeErr != nil {
+			_ = rejected.close()
+			return encodeErr
+		}
+		if err = rejected.append(buf); err != nil {
+			_ = rejected.close()
+			return err
+		}
+	}
+	return rejected.close()
+}
+
+// ReadRejected returns rows moved to RejectedFile of the directory, options must match options of the buffer
+func ReadRejected(dir string, opts ...Option) ([]cx.Vector, error) {
+	o := newOptions(opts)
+	records, err := readFile(RejectedFile(dir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rows := make([]cx.Vector, 0, len(records))
+	for _, record := range records {
+		v, decodeErr := cx.VectorDecoded(record).DecodeWith(o.codec)
+		if decodeErr != nil {
+			return rows, decodeErr
+		}
+		rows = append(rows, v)
+	}
+	return rows, nil
+}
+
+// Close syncs and closes the current segment, unflushed rows will be replayed by the next NewBuffer call
+func (f *fileBuffer) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.segment == nil {
+		return nil
+	}
+	err := f.segment.close()
+	f.segment = nil
+	return err
+}
+
+// append writes an encoded row to the current segment, rotates and syncs it according to the options
+func (f *fileBuffer) append(buf []byte) error {
+	if f.segment == nil {
+		return os.ErrClosed
+	}
+	if f.segment.size >= f.options.segmentSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := f.segment.append(buf); err != nil {
+		return err
+	}
+	switch f.options.syncPolicy {
+	case SyncAlways:
+		return f.segment.sync()
+	case SyncInterval:
+		if time.Since(f.lastSync) >= f.options.syncInterval {
+			f.lastSync = time.Now()
+			return f.segment.sync()
+		}
+	case SyncNever:
+	}
+	return nil
+}
+
+func (f *fileBuffer) rotate() error {
+	next := f.segment.id + 1
+	if err := f.segment.close(); err != nil {
+		return err
+	}
+	var err error
+	f.segment, err = openSegment(f.dir, next)
+	return err
+}
+
+// replay reads rows from all existing segments in order, returns the id of the last found segment
+func (f *fileBuffer) replay() (uint64, error) {
+	ids, err := listSegments(f.dir)
+	if err != nil {
+		return 0, err
+	}
+	var lastID uint64
+	var records [][]byte
+	for _, id := range ids {
+		lastID = id
+		if records, err = readSegment(f.dir, id); err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			v, decodeErr := cx.VectorDecoded(record).DecodeWith(f.options.codec)
+			if decodeErr != nil {
+				log.Printf("file buffer replay err: %v\n", decodeErr.Error())
+				continue
+			}
+			f.buffer = append(f.buffer, v)
+		}
+	}
+	return lastID, nil
+}
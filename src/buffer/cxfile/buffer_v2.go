@@ -0,0 +1,76 @@
+package cxfile
+
+import (
+	"context"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// engine is implemented by both file buffers, methods of the first version log failures, while these return them
+type engine interface {
+	write(row cx.Vector) error
+	drain() ([]cx.Vector, error)
+	Len() int
+	Close() error
+}
+
+// bufferV2 implements cx.BufferV2 on top of the engine
+type bufferV2 struct {
+	engine engine
+}
+
+// NewBufferV2 same as NewBuffer, but returns the buffer of the second version
+func NewBufferV2(dir string, bufferSize uint, opts ...Option) (cx.BufferV2, error) {
+	buf, err := NewBuffer(dir, bufferSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	file := buf.(*fileBuffer)
+	return &fileBufferV2{bufferV2: bufferV2{engine: file}, file: file}, nil
+}
+
+// NewTieredBufferV2 same as NewTieredBuffer, but returns the buffer of the second version
+func NewTieredBufferV2(dir string, bufferSize uint, opts ...Option) (cx.BufferV2, error) {
+	buf, err := NewTieredBuffer(dir, bufferSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tiered := buf.(*tieredBuffer)
+	return &tieredBufferV2{bufferV2: bufferV2{engine: tiered}, tiered: tiered}, nil
+}
+
+func (b *bufferV2) Write(_ context.Context, row cx.Vector) error {
+	return b.engine.write(row)
+}
+
+func (b *bufferV2) Drain(_ context.Context) ([]cx.Vector, error) {
+	return b.engine.drain()
+}
+
+func (b *bufferV2) Len() int {
+	return b.engine.Len()
+}
+
+func (b *bufferV2) Close() error {
+	return b.engine.Close()
+}
+
+// fileBufferV2 passes acknowledgements of batches to the file buffer
+type fileBufferV2 struct {
+	bufferV2
+	file *fileBuffer
+}
+
+func (b *fileBufferV2) Ack(batch *cx.Batch, err error) {
+	b.file.Ack(batch, err)
+}
+
+// tieredBufferV2 reports spilled rows, so the Writer drains the tiered buffer in parts
+type tieredBufferV2 struct {
+	bufferV2
+	tiered *tieredBuffer
+}
+
+func (b *tieredBufferV2) Spilled() int {
+	return b.tiered.Spilled()
+}
@@ -0,0 +1,175 @@
+package cxfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	segmentExt = ".wal"
+	// every record is prefixed with the length and the checksum of its payload
+	headerSize = 8
+)
+
+var errCorruptedRecord = errors.New("corrupted wal record")
+
+// segment is a single append-only file of the log
+type segment struct {
+	id   uint64
+	file *os.File
+	size int64
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// RejectedFile returns the path of the dead-letter file, where rows of batches failed with errors
+// that cannot be retried are moved to. It has the format of segments, but it is never replayed
+func RejectedFile(dir string) string {
+	return filepath.Join(dir, "rejected"+segmentExt)
+}
+
+func openSegment(dir string, id uint64) (*segment, error) {
+	return openFile(segmentPath(dir, id), id)
+}
+
+func openFile(path string, id uint64) (*segment, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &segment{id: id, file: file, size: stat.Size()}, nil
+}
+
+func (s *segment) append(payload []byte) error {
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[headerSize:], payload)
+	n, err := s.file.Write(record)
+	s.size += int64(n)
+	return err
+}
+
+func (s *segment) sync() error {
+	return s.file.Sync()
+}
+
+func (s *segment) close() error {
+	if err := s.file.Sync(); err != nil {
+		_ = s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// listSegments returns the ids of all segments in the directory in ascending order
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, parseErr := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if parseErr != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+// removeSegments removes segments with ids up to the last one
+func removeSegments(dir string, last uint64) error {
+	ids, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id > last {
+			break
+		}
+		if err = os.Remove(segmentPath(dir, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment returns payloads of all valid records of the segment.
+// A torn or corrupted tail, left by a crash in the middle of a write, is truncated
+func readSegment(dir string, id uint64) ([][]byte, error) {
+	return readFile(segmentPath(dir, id))
+}
+
+func readFile(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	records, valid, readErr := readRecords(bufio.NewReader(file), stat.Size())
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		if err = os.Truncate(path, valid); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// readRecords reads records until EOF or the first damaged record, returns the size of the valid part
+func readRecords(r io.Reader, size int64) (records [][]byte, valid int64, err error) {
+	header := make([]byte, headerSize)
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return records, valid, nil
+			}
+			return records, valid, err
+		}
+		length := int64(binary.BigEndian.Uint32(header[0:4]))
+		// a damaged length must not lead to a huge allocation
+		if length > size-valid-headerSize {
+			return records, valid, errCorruptedRecord
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return records, valid, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return records, valid, errCorruptedRecord
+		}
+		records = append(records, payload)
+		valid += int64(headerSize + len(payload))
+	}
+}
@@ -0,0 +1,295 @@
+package cxfile
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// spill is a segment holding rows moved from memory to disk
+type spill struct {
+	id   uint64
+	rows int
+}
+
+// tieredBuffer keeps rows in memory up to the threshold, then moves them to a new segment on disk.
+// Rows on disk are always older than rows in memory, so reading segments first and memory last keeps the FIFO order.
+// Only one segment is loaded back into memory at a time, Read returns no more than the buffer size rows
+type tieredBuffer struct {
+	mu          sync.Mutex
+	dir         string
+	options     *options
+	bufferSize  int
+	memory      []cx.Vector
+	memoryBytes int
+	spills      []spill
+	spilled     int
+	loaded      []cx.Vector
+	loadedID    uint64
+	nextID      uint64
+	// rows returned by the last Read, they are removed by Flush
+	pending int
+}
+
+// NewTieredBuffer returns the buffer that spills rows to segments in the directory, when there are too many of them
+// to keep in memory, e.g. while Clickhouse is unavailable. Rows spilled by the previous run are read first.
+// Rows kept in memory are spilled on Close, rows lost by a crash of the process are only those not yet spilled.
+// Every spill is written to its own segment, so WithSegmentSize and the sync options are not used
+func NewTieredBuffer(dir string, bufferSize uint, opts ...Option) (cx.Buffer, error) {
+	o := &options{
+		codec:      cx.NewGobCodec(),
+		memoryRows: int(bufferSize),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.codec = cx.Enveloped(o.codec, o.view, cx.EnvelopeOptions(o.compression, o.keys)...)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	t := &tieredBuffer{
+		dir:        dir,
+		options:    o,
+		bufferSize: int(bufferSize),
+		memory:     make([]cx.Vector, 0, bufferSize+1),
+	}
+	if t.bufferSize <= 0 {
+		t.bufferSize = 1
+	}
+	ids, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		records, readErr := readSegment(dir, id)
+		if readErr != nil {
+			return nil, readErr
+		}
+		t.spills = append(t.spills, spill{id: id, rows: len(records)})
+		t.spilled += len(records)
+		t.nextID = id + 1
+	}
+	return t, nil
+}
+
+func (t *tieredBuffer) Write(row cx.Vector) {
+	if err := t.write(row); err != nil {
+		log.Printf("%v\n", err.Error())
+	}
+}
+
+// write keeps the row in memory, if the rows in memory cannot be spilled, the row is not written
+func (t *tieredBuffer) write(row cx.Vector) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	size := cx.EstimateSize(row)
+	t.memory = append(t.memory, row)
+	t.memoryBytes += size
+	if !t.overflows() {
+		return nil
+	}
+	dropped, err := t.spill()
+	if err != nil {
+		t.memory = t.memory[:len(t.memory)-1]
+		t.memoryBytes -= size
+		return fmt.Errorf("tiered buffer spill err: %w", err)
+	}
+	if dropped != nil {
+		return fmt.Errorf("tiered buffer value encode err, rows are dropped: %w", dropped)
+	}
+	return nil
+}
+
+// Read returns the oldest rows, first from disk, then from memory
+func (t *tieredBuffer) Read() []cx.Vector {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rows, err := t.read()
+	if err != nil {
+		log.Printf("%v\n", err.Error())
+	}
+	return rows
+}
+
+// drain reads the oldest rows and removes them at once
+func (t *tieredBuffer) drain() ([]cx.Vector, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rows, err := t.read()
+	if err != nil {
+		return rows, err
+	}
+	return rows, t.flush()
+}
+
+func (t *tieredBuffer) read() ([]cx.Vector, error) {
+	var err error
+	if err = t.load(); err != nil {
+		err = fmt.Errorf("tiered buffer load err: %w", err)
+	}
+	source := t.memory
+	if len(t.loaded) > 0 {
+		source = t.loaded
+	}
+	n := len(source)
+	if n > t.bufferSize {
+		n = t.bufferSize
+	}
+	rows := make([]cx.Vector, n)
+	copy(rows, source[:n])
+	t.pending = n
+	return rows, err
+}
+
+func (t *tieredBuffer) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.memory) + len(t.loaded) + t.spilled
+}
+
+// Flush removes the rows returned by the last Read, they could have been spilled to disk since then
+func (t *tieredBuffer) Flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.flush(); err != nil {
+		log.Printf("%v\n", err.Error())
+	}
+}
+
+func (t *tieredBuffer) flush() error {
+	n := t.pending
+	t.pending = 0
+	for n > 0 {
+		if len(t.loaded) == 0 && len(t.spills) > 0 {
+			if err := t.load(); err != nil {
+				return fmt.Errorf("tiered buffer load err: %w", err)
+			}
+			continue
+		}
+		if len(t.loaded) > 0 {
+			k := minInt(n, len(t.loaded))
+			t.loaded = t.loaded[k:]
+			n -= k
+			if len(t.loaded) == 0 {
+				t.removeLoaded()
+			}
+			continue
+		}
+		k := minInt(n, len(t.memory))
+		if k == 0 {
+			return nil
+		}
+		for _, row := range t.memory[:k] {
+			t.memoryBytes -= cx.EstimateSize(row)
+		}
+		t.memory = t.memory[k:]
+		n -= k
+	}
+	return nil
+}
+
+// Spilled implements cx.Spiller
+func (t *tieredBuffer) Spilled() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.loaded) + t.spilled
+}
+
+// Close spills rows kept in memory, so they are read by the next NewTieredBuffer call
+func (t *tieredBuffer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.memory) == 0 {
+		return nil
+	}
+	dropped, err := t.spill()
+	if err != nil {
+		return err
+	}
+	return dropped
+}
+
+func (t *tieredBuffer) overflows() bool {
+	return len(t.memory) > t.options.memoryRows ||
+		(t.options.memoryBytes > 0 && t.memoryBytes > t.options.memoryBytes)
+}
+
+// spill moves all rows kept in memory to a new segment, rows that cannot be encoded are dropped,
+// the first encode error is returned as dropped
+func (t *tieredBuffer) spill() (dropped, err error) {
+	seg, err := openSegment(t.dir, t.nextID)
+	if err != nil {
+		return nil, err
+	}
+	var written int
+	for _, row := range t.memory {
+		buf, encodeErr := t.options.codec.Encode(row)
+		if encodeErr != nil {
+			if dropped == nil {
+				dropped = encodeErr
+			}
+			continue
+		}
+		if err = seg.append(buf); err != nil {
+			_ = seg.close()
+			_ = os.Remove(segmentPath(t.dir, seg.id))
+			return nil, err
+		}
+		written++
+	}
+	if err = seg.close(); err != nil {
+		_ = os.Remove(segmentPath(t.dir, seg.id))
+		return nil, err
+	}
+	t.spills = append(t.spills, spill{id: seg.id, rows: written})
+	t.spilled += written
+	t.nextID++
+	t.memory = t.memory[:0]
+	t.memoryBytes = 0
+	return dropped, nil
+}
+
+// load reads rows of the oldest segment, once the rows loaded before are removed
+func (t *tieredBuffer) load() error {
+	if len(t.loaded) > 0 || len(t.spills) == 0 {
+		return nil
+	}
+	next := t.spills[0]
+	t.spills = t.spills[1:]
+	t.spilled -= next.rows
+	t.loadedID = next.id
+	records, err := readSegment(t.dir, next.id)
+	if err != nil {
+		return err
+	}
+	t.loaded = make([]cx.Vector, 0, len(records))
+	for _, record := range records {
+		v, decodeErr := cx.VectorDecoded(record).DecodeWith(t.options.codec)
+		if decodeErr != nil {
+			log.Printf("tiered buffer load err: %v\n", decodeErr.Error())
+			continue
+		}
+		t.loaded = append(t.loaded, v)
+	}
+	if len(t.loaded) == 0 {
+		t.removeLoaded()
+	}
+	return nil
+}
+
+func (t *tieredBuffer) removeLoaded() {
+	if err := os.Remove(segmentPath(t.dir, t.loadedID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("tiered buffer remove segment err: %v\n", err.Error())
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -1,42 +1,90 @@
 package cxredis
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"sync/atomic"
 
+	"github.com/go-redis/redis/v8"
+
 	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
 )
 
 func (r *redisBuffer) Write(row cx.Vector) {
-	var err error
-	var buf []byte
-	if buf, err = row.Encode(); err != nil {
-		log.Printf("redis buffer value encode err: %v\n", err.Error())
-		return
-	}
-	if err = r.client.RPush(r.context, r.bucket, buf).Err(); err != nil {
-		if !r.isContextClosedErr(err) {
-			log.Printf("redis buffer write err: %v\n", err.Error())
+	if err := r.write(r.context, row); err != nil && !r.isContextClosedErr(err) {
+		log.Printf("%v\n", err.Error())
+	}
+}
+
+func (r *redisBuffer) write(ctx context.Context, row cx.Vector) error {
+	rows := []cx.Vector{row}
+	if r.batch != nil {
+		if rows = r.batch.add(row); rows == nil {
+			return nil
 		}
-		return
+	}
+	return r.push(ctx, rows)
+}
+
+func (r *redisBuffer) push(ctx context.Context, rows []cx.Vector) error {
+	buf, err := encode(r.codec, rows)
+	if err != nil {
+		return fmt.Errorf("redis buffer value encode err: %w", err)
+	}
+	if err = r.client.RPush(ctx, r.bucket, buf).Err(); err != nil {
+		return fmt.Errorf("redis buffer write err: %w", err)
 	}
 	atomic.AddInt64(&r.size, 1)
+	return nil
 }
 
-func (r *redisBuffer) Read() []cx.Vector {
-	values := r.client.LRange(r.context, r.bucket, 0, atomic.LoadInt64(&r.size)).Val()
-	slices := make([]cx.Vector, 0, len(values))
-	for _, value := range values {
-		if v, err := cx.VectorDecoded(value).Decode(); err == nil {
-			slices = append(slices, v)
-		} else {
-			log.Printf("redis buffer read err: %v\n", err.Error())
+// pushPending stores the rows of an incomplete micro-batch
+func (r *redisBuffer) pushPending(ctx context.Context) error {
+	if r.batch != nil {
+		if rows := r.batch.take(); rows != nil {
+			return r.push(ctx, rows)
 		}
 	}
+	return nil
+}
+
+func (r *redisBuffer) Read() []cx.Vector {
+	if err := r.pushPending(r.context); err != nil && !r.isContextClosedErr(err) {
+		log.Printf("%v\n", err.Error())
+	}
+	values := r.client.LRange(r.context, r.bucket, 0, atomic.LoadInt64(&r.size)).Val()
+	slices, rejected := decode(r.codec, values)
+	reject(r.context, r.client, r.bucket, rejected)
 	return slices
 }
 
+// drain takes rows from the head of the bucket in a transaction, so rows written meanwhile are not lost
+func (r *redisBuffer) drain(ctx context.Context) ([]cx.Vector, error) {
+	if err := r.pushPending(ctx); err != nil {
+		return nil, err
+	}
+	var values *redis.StringSliceCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		values = pipe.LRange(ctx, r.bucket, 0, r.bufferSize-1)
+		pipe.LTrim(ctx, r.bucket, r.bufferSize, -1)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis buffer drain err: %w", err)
+	}
+	if size := atomic.AddInt64(&r.size, -int64(len(values.Val()))); size < 0 {
+		atomic.StoreInt64(&r.size, 0)
+	}
+	slices, rejected := decode(r.codec, values.Val())
+	reject(ctx, r.client, r.bucket, rejected)
+	return slices, nil
+}
+
 func (r *redisBuffer) Len() int {
+	if r.batch != nil {
+		return int(atomic.LoadInt64(&r.size))*r.batch.size + r.batch.len()
+	}
 	return int(atomic.LoadInt64(&r.size))
 }
 
@@ -0,0 +1,70 @@
+package cxredis
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// engine is implemented by both Redis buffers, methods of the first version log failures, while these return them
+type engine interface {
+	write(ctx context.Context, row cx.Vector) error
+	pushPending(ctx context.Context) error
+	drain(ctx context.Context) ([]cx.Vector, error)
+	Len() int
+}
+
+// bufferV2 implements cx.BufferV2 on top of the engine
+type bufferV2 struct {
+	engine engine
+}
+
+// NewBufferV2 same as NewBuffer, but returns the buffer of the second version
+func NewBufferV2(ctx context.Context, rdb *redis.Client, bucket string, bufferSize uint, opts ...Option) (cx.BufferV2, error) {
+	buf, err := NewBuffer(ctx, rdb, bucket, bufferSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferV2{engine: buf.(*redisBuffer)}, nil
+}
+
+// NewSafeBufferV2 same as NewSafeBuffer, but returns the buffer of the second version
+func NewSafeBufferV2(
+	ctx context.Context, rdb *redis.Client, bucket string, bufferSize uint, opts ...Option,
+) (cx.BufferV2, error) {
+	buf, err := NewSafeBuffer(ctx, rdb, bucket, bufferSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	safe := buf.(*redisSafeBuffer)
+	return &safeBufferV2{bufferV2: bufferV2{engine: safe}, safe: safe}, nil
+}
+
+func (b *bufferV2) Write(ctx context.Context, row cx.Vector) error {
+	return b.engine.write(ctx, row)
+}
+
+func (b *bufferV2) Drain(ctx context.Context) ([]cx.Vector, error) {
+	return b.engine.drain(ctx)
+}
+
+func (b *bufferV2) Len() int {
+	return b.engine.Len()
+}
+
+// Close stores the rows of an incomplete micro-batch, the Redis client is not closed
+func (b *bufferV2) Close() error {
+	return b.engine.pushPending(context.Background())
+}
+
+// safeBufferV2 passes acknowledgements of batches to the safe buffer
+type safeBufferV2 struct {
+	bufferV2
+	safe *redisSafeBuffer
+}
+
+func (b *safeBufferV2) Ack(batch *cx.Batch, err error) {
+	b.safe.Ack(batch, err)
+}
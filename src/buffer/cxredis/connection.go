@@ -3,6 +3,7 @@ package cxredis
 import (
 	"context"
 	"errors"
+	"log"
 
 	"github.com/go-redis/redis/v8"
 
@@ -15,24 +16,50 @@ func key(bucket string) string {
 	return prefix + ":" + bucket
 }
 
+// RejectedKey returns the key of the list, where rows of the bucket that cannot be decoded are moved to,
+// e.g. rows written for another version of the view. The safe buffer also moves there rows of batches
+// failed with errors that cannot be retried
+func RejectedKey(bucket string) string {
+	return key(bucket) + ":rejected"
+}
+
 type redisBuffer struct {
 	client     *redis.Client
 	context    context.Context
 	bucket     string
 	bufferSize int64
 	size       int64
+	codec      *cx.EnvelopeCodec
+	batch      *microBatch
 }
 
-func NewBuffer(ctx context.Context, rdb *redis.Client, bucket string, bufferSize uint) (cx.Buffer, error) {
+func NewBuffer(ctx context.Context, rdb *redis.Client, bucket string, bufferSize uint, opts ...Option) (cx.Buffer, error) {
+	o := newOptions(opts)
 	return &redisBuffer{
 		client:     rdb,
 		context:    ctx,
 		bucket:     key(bucket),
-		bufferSize: int64(bufferSize),
-		size:       rdb.LLen(ctx, bucket).Val(),
+		bufferSize: elements(bufferSize, o.microBatch),
+		size:       rdb.LLen(ctx, key(bucket)).Val(),
+		codec:      o.envelope,
+		batch:      newMicroBatch(o.microBatch),
 	}, nil
 }
 
 func (r *redisBuffer) isContextClosedErr(err error) bool {
-	return errors.Is(err, redis.ErrClosed) && r.context.Err() != nil && errors.Is(r.context.Err(), context.Canceled)
+	return isContextClosedErr(r.context, err)
+}
+
+// reject moves rows that cannot be decoded to the dead-letter list of the bucket, so that they are not lost silently
+func reject(ctx context.Context, rdb *redis.Client, bucketKey string, values []interface{}) {
+	if len(values) == 0 {
+		return
+	}
+	if err := rdb.RPush(ctx, bucketKey+":rejected", values...).Err(); err != nil && !isContextClosedErr(ctx, err) {
+		log.Printf("redis buffer reject err: %v\n", err.Error())
+	}
+}
+
+func isContextClosedErr(ctx context.Context, err error) bool {
+	return errors.Is(err, redis.ErrClosed) && ctx.Err() != nil && errors.Is(ctx.Err(), context.Canceled)
 }
@@ -0,0 +1,89 @@
+package cxredis
+
+import (
+	"log"
+	"sync"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// microBatch collects rows in memory of the process until there are enough of them to be stored as one block,
+// rows of an incomplete block are stored on the next Read
+type microBatch struct {
+	mu   sync.Mutex
+	size int
+	rows []cx.Vector
+}
+
+func newMicroBatch(size int) *microBatch {
+	if size <= 1 {
+		return nil
+	}
+	return &microBatch{size: size, rows: make([]cx.Vector, 0, size)}
+}
+
+// add returns the rows of the block, once it is complete
+func (m *microBatch) add(row cx.Vector) []cx.Vector {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rows = append(m.rows, row)
+	if len(m.rows) < m.size {
+		return nil
+	}
+	return m.takeLocked()
+}
+
+func (m *microBatch) take() []cx.Vector {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.takeLocked()
+}
+
+func (m *microBatch) takeLocked() []cx.Vector {
+	if len(m.rows) == 0 {
+		return nil
+	}
+	rows := m.rows
+	m.rows = make([]cx.Vector, 0, m.size)
+	return rows
+}
+
+func (m *microBatch) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.rows)
+}
+
+// elements returns the number of list elements holding about the given number of rows
+func elements(rows uint, microBatchSize int) int64 {
+	if microBatchSize <= 1 {
+		return int64(rows)
+	}
+	if n := int64(rows) / int64(microBatchSize); n > 0 {
+		return n
+	}
+	return 1
+}
+
+// encode returns the stored representation of rows, a single row or a block of rows
+func encode(codec *cx.EnvelopeCodec, rows []cx.Vector) ([]byte, error) {
+	if len(rows) == 1 {
+		return codec.Encode(rows[0])
+	}
+	return codec.EncodeBlock(rows)
+}
+
+// decode returns rows of stored values, values that cannot be decoded are returned as rejected
+func decode(codec *cx.EnvelopeCodec, values []string) (rows []cx.Vector, rejected []interface{}) {
+	rows = make([]cx.Vector, 0, len(values))
+	for _, value := range values {
+		decoded, err := codec.DecodeBlock([]byte(value))
+		if err != nil {
+			log.Printf("redis buffer read err: %v\n", err.Error())
+			rejected = append(rejected, value)
+			continue
+		}
+		rows = append(rows, decoded...)
+	}
+	return rows, rejected
+}
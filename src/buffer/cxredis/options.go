@@ -0,0 +1,95 @@
+package cxredis
+
+import (
+	"time"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+const defaultMinIdle = time.Minute
+
+type options struct {
+	consumer    string
+	minIdle     time.Duration
+	codec       cx.Codec
+	view        cx.View
+	compression cx.Compression
+	keys        cx.KeyProvider
+	microBatch  int
+	envelope    *cx.EnvelopeCodec
+}
+
+type Option func(o *options)
+
+// WithConsumer sets the name of the consumer owning the processing list of the safe buffer,
+// default is unique for every buffer, see cx.ConsumerName. With a name that is stable across restarts
+// and unique among instances (e.g. name of the pod), a restarted instance picks up the rows it read,
+// but did not flush before the crash, at once. Rows of other consumers are reclaimed after WithMinIdle
+func WithConsumer(name string) Option {
+	return func(o *options) {
+		o.consumer = name
+	}
+}
+
+// WithMinIdle sets the time after which the processing list of a consumer, that stopped reporting
+// (e.g. the process crashed), is returned to the bucket by other consumers of the safe buffer, default 1m.
+// Consumers report on every Read and Len, it must be longer than the flush interval and the clock skew of instances
+func WithMinIdle(minIdle time.Duration) Option {
+	return func(o *options) {
+		o.minIdle = minIdle
+	}
+}
+
+// WithCodec sets the codec of rows stored in Redis, default is gob.
+// Rows are always wrapped in cx.EnvelopeCodec, pass the envelope itself to register migrations,
+// then the view and the compression options of the buffer are not applied
+func WithCodec(codec cx.Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithView sets the view of the envelope, rows written for another version of the view are moved to the rejected list
+func WithView(view cx.View) Option {
+	return func(o *options) {
+		o.view = view
+	}
+}
+
+// WithCompression sets the compression of the envelope, see cx.WithCompression
+func WithCompression(compression cx.Compression) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithEncryption sets the key provider of the envelope, see cx.WithEncryption
+func WithEncryption(keys cx.KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithMicroBatch stores rows in blocks of the given size, that are compressed together,
+// which gives a much better ratio on small rows. Rows of an incomplete block are kept in memory of the process
+// until the next Read, so they can be lost on crash. The size of the buffer and its length are estimated in blocks
+func WithMicroBatch(size int) Option {
+	return func(o *options) {
+		o.microBatch = size
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		codec:   cx.NewGobCodec(),
+		minIdle: defaultMinIdle,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.consumer == "" {
+		o.consumer = cx.ConsumerName()
+	}
+	o.envelope = cx.Enveloped(o.codec, o.view, cx.EnvelopeOptions(o.compression, o.keys)...)
+	return o
+}
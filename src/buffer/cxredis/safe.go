@@ -0,0 +1,287 @@
+package cxredis
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// readScript atomically moves up to ARGV[1] rows from the head of the bucket (KEYS[1])
+// to the tail of the processing list of the consumer (KEYS[2]) and returns them.
+// If ARGV[2] is set and the processing list is not empty, the rows were read, but not acknowledged
+// (e.g. the process crashed), in that case they are returned again instead of taking new ones.
+// The consumer ARGV[5] reports the time ARGV[3] to the set of consumers (KEYS[3]), processing lists of consumers
+// that did not report for ARGV[4] ms are returned to the head of the bucket.
+// Rows are pushed in chunks, because unpack of a large table overflows the Lua stack
+const readScript = `
+local now = tonumber(ARGV[3])
+redis.call('ZADD', KEYS[3], now, ARGV[5])
+local idle = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', now - tonumber(ARGV[4]))
+for _, consumer in ipairs(idle) do
+	local list = KEYS[1] .. ':processing:' .. consumer
+	local abandoned = redis.call('LRANGE', list, 0, -1)
+	for i = #abandoned, 1, -1 do
+		redis.call('LPUSH', KEYS[1], abandoned[i])
+	end
+	redis.call('DEL', list)
+	redis.call('ZREM', KEYS[3], consumer)
+end
+if ARGV[2] == '1' then
+	local pending = redis.call('LRANGE', KEYS[2], 0, -1)
+	if #pending > 0 then
+		return pending
+	end
+end
+local rows = redis.call('LRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1)
+if #rows > 0 then
+	redis.call('LTRIM', KEYS[1], #rows, -1)
+	for i = 1, #rows, 1000 do
+		redis.call('RPUSH', KEYS[2], unpack(rows, i, math.min(i + 999, #rows)))
+	end
+end
+return rows
+`
+
+// lenScript returns the number of rows waiting in the bucket, and in the processing list of the consumer if ARGV[1] is set.
+// The consumer ARGV[3] reports the time ARGV[2] to the set of consumers (KEYS[3])
+const lenScript = `
+redis.call('ZADD', KEYS[3], tonumber(ARGV[2]), ARGV[3])
+if ARGV[1] == '1' then
+	return redis.call('LLEN', KEYS[1]) + redis.call('LLEN', KEYS[2])
+end
+return redis.call('LLEN', KEYS[1])
+`
+
+// ackScript removes ARGV[1] rows of the oldest read batch from the head of the processing list (KEYS[1]).
+// If ARGV[2] is 'retry', the batch failed and its rows are returned to the head of the bucket (KEYS[2]) to be read again,
+// if it is 'reject', the batch failed with an error that cannot be retried and its rows are moved to KEYS[3]
+const ackScript = `
+local n = tonumber(ARGV[1])
+if ARGV[2] == 'retry' then
+	local rows = redis.call('LRANGE', KEYS[1], 0, n - 1)
+	for i = #rows, 1, -1 do
+		redis.call('LPUSH', KEYS[2], rows[i])
+	end
+elseif ARGV[2] == 'reject' then
+	local rows = redis.call('LRANGE', KEYS[1], 0, n - 1)
+	for i = 1, #rows, 1000 do
+		redis.call('RPUSH', KEYS[3], unpack(rows, i, math.min(i + 999, #rows)))
+	end
+end
+redis.call('LTRIM', KEYS[1], n, -1)
+return n
+`
+
+// redisSafeBuffer can be shared by any number of producers and flushers.
+// Rows are handed over from the shared bucket to a consumer with a Lua script,
+// and the length of the buffer is always taken from the server.
+// Read rows stay in the processing list of the consumer until Flush, or until their batch is acknowledged,
+// rows left by a crashed process are returned by its first Read, or by Read of other consumers after the idle time
+type redisSafeBuffer struct {
+	client     *redis.Client
+	context    context.Context
+	bucket     string
+	processing string
+	consumers  string
+	consumer   string
+	minIdle    time.Duration
+	bufferSize int64
+	codec      *cx.EnvelopeCodec
+	batch      *microBatch
+	readScript *redis.Script
+	lenScript  *redis.Script
+	ackScript  *redis.Script
+	mu         sync.Mutex
+	// number of values of the processing list returned by every Read, which is not acknowledged yet
+	reads []int
+}
+
+// NewSafeBuffer returns a Redis buffer, that is safe to use from several instances of service with the same bucket
+func NewSafeBuffer(
+	ctx context.Context, rdb *redis.Client, bucket string, bufferSize uint, opts ...Option,
+) (cx.Buffer, error) {
+	o := newOptions(opts)
+	return &redisSafeBuffer{
+		client:     rdb,
+		context:    ctx,
+		bucket:     key(bucket),
+		processing: key(bucket) + ":processing:" + o.consumer,
+		consumers:  key(bucket) + ":consumers",
+		consumer:   o.consumer,
+		minIdle:    o.minIdle,
+		bufferSize: elements(bufferSize, o.microBatch),
+		codec:      o.envelope,
+		batch:      newMicroBatch(o.microBatch),
+		readScript: redis.NewScript(readScript),
+		lenScript:  redis.NewScript(lenScript),
+		ackScript:  redis.NewScript(ackScript),
+	}, nil
+}
+
+func (r *redisSafeBuffer) Write(row cx.Vector) {
+	if err := r.write(r.context, row); err != nil && !r.isContextClosedErr(err) {
+		log.Printf("%v\n", err.Error())
+	}
+}
+
+func (r *redisSafeBuffer) write(ctx context.Context, row cx.Vector) error {
+	rows := []cx.Vector{row}
+	if r.batch != nil {
+		if rows = r.batch.add(row); rows == nil {
+			return nil
+		}
+	}
+	return r.push(ctx, rows)
+}
+
+func (r *redisSafeBuffer) push(ctx context.Context, rows []cx.Vector) error {
+	buf, err := encode(r.codec, rows)
+	if err != nil {
+		return fmt.Errorf("redis buffer value encode err: %w", err)
+	}
+	if err = r.client.RPush(ctx, r.bucket, buf).Err(); err != nil {
+		return fmt.Errorf("redis buffer write err: %w", err)
+	}
+	return nil
+}
+
+// pushPending stores the rows of an incomplete micro-batch
+func (r *redisSafeBuffer) pushPending(ctx context.Context) error {
+	if r.batch != nil {
+		if rows := r.batch.take(); rows != nil {
+			return r.push(ctx, rows)
+		}
+	}
+	return nil
+}
+
+func (r *redisSafeBuffer) Read() []cx.Vector {
+	rows, err := r.read(r.context)
+	if err != nil && !r.isContextClosedErr(err) {
+		log.Printf("%v\n", err.Error())
+	}
+	return rows
+}
+
+func (r *redisSafeBuffer) read(ctx context.Context) ([]cx.Vector, error) {
+	if err := r.pushPending(ctx); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// without batches in progress, rows of the processing list were left unacknowledged and are returned again
+	values, err := r.readScript.Run(ctx, r.client, []string{r.bucket, r.processing, r.consumers},
+		r.bufferSize, flag(len(r.reads) == 0), time.Now().UnixMilli(), r.minIdle.Milliseconds(), r.consumer,
+	).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("redis buffer read err: %w", err)
+	}
+	slices, rejected := decode(r.codec, values)
+	reject(ctx, r.client, r.bucket, rejected)
+	switch {
+	case len(slices) > 0:
+		r.reads = append(r.reads, len(values))
+	case len(values) > 0:
+		// all values were rejected, nothing is acknowledged, so they are removed from the tail at once
+		if err = r.client.LTrim(ctx, r.processing, 0, -int64(len(values))-1).Err(); err != nil {
+			return nil, fmt.Errorf("redis buffer read err: %w", err)
+		}
+	}
+	return slices, nil
+}
+
+// drain reads rows, they stay in the processing list until the batch is acknowledged
+func (r *redisSafeBuffer) drain(ctx context.Context) ([]cx.Vector, error) {
+	return r.read(ctx)
+}
+
+func (r *redisSafeBuffer) Len() int {
+	size, err := r.length(r.context)
+	if err != nil && !r.isContextClosedErr(err) {
+		log.Printf("%v\n", err.Error())
+	}
+	return size
+}
+
+func (r *redisSafeBuffer) length(ctx context.Context) (int, error) {
+	r.mu.Lock()
+	// rows of batches in progress are not counted
+	inProgress := len(r.reads) > 0
+	r.mu.Unlock()
+	size, err := r.lenScript.Run(ctx, r.client, []string{r.bucket, r.processing, r.consumers},
+		flag(!inProgress), time.Now().UnixMilli(), r.consumer,
+	).Int()
+	if err != nil {
+		return 0, fmt.Errorf("redis buffer len err: %w", err)
+	}
+	if r.batch != nil {
+		return size*r.batch.size + r.batch.len(), nil
+	}
+	return size, nil
+}
+
+// Flush acknowledges the rows returned by all previous Read calls by removing the processing list of the consumer,
+// the Writer does not call it, batches are acknowledged with Ack instead
+func (r *redisSafeBuffer) Flush() {
+	if err := r.flush(r.context); err != nil && !r.isContextClosedErr(err) {
+		log.Printf("%v\n", err.Error())
+	}
+}
+
+func (r *redisSafeBuffer) flush(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.client.Del(ctx, r.processing).Err(); err != nil {
+		return fmt.Errorf("redis buffer flush err: %w", err)
+	}
+	r.reads = nil
+	return nil
+}
+
+// Ack removes rows of the oldest read batch from the processing list if it was successfully written.
+// Rows of a batch failed with an error that can be retried are returned to the head of the bucket and delivered again,
+// rows of other failed batches are moved to RejectedKey, so that they do not fail later batches
+func (r *redisSafeBuffer) Ack(_ *cx.Batch, err error) {
+	// the lock is held until rows leave the processing list, otherwise Read could take them as left by a crash
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.reads) == 0 {
+		return
+	}
+	values := r.reads[0]
+	r.reads = r.reads[1:]
+	keys := []string{r.processing, r.bucket, r.bucket + ":rejected"}
+	if ackErr := r.ackScript.Run(r.context, r.client, keys, values, ackMode(err)).Err(); ackErr != nil &&
+		!r.isContextClosedErr(ackErr) {
+		log.Printf("redis buffer ack err: %v\n", ackErr.Error())
+	}
+}
+
+// ackMode is the argument of ackScript for the result of the batch
+func ackMode(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case cx.IsResendAvailable(err):
+		return "retry"
+	}
+	return "reject"
+}
+
+// flag is the boolean argument of scripts
+func flag(value bool) string {
+	if value {
+		return "1"
+	}
+	return "0"
+}
+
+func (r *redisSafeBuffer) isContextClosedErr(err error) bool {
+	return isContextClosedErr(r.context, err)
+}
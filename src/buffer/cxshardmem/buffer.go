@@ -0,0 +1,156 @@
+package cxshardmem
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// shard is padded to 128 bytes, so that producers writing to neighbouring shards do not share cache lines
+type shard struct {
+	mu   sync.Mutex
+	rows []cx.Vector
+	size int64
+	_    [88]byte
+}
+
+func (s *shard) append(row cx.Vector) {
+	s.rows = append(s.rows, row)
+	atomic.AddInt64(&s.size, 1)
+}
+
+// memory spreads rows across shards, each with its own lock, so concurrent producers rarely wait for each other.
+// The order of rows is not kept, rows of a single producer can be returned in a different order
+type memory struct {
+	shards []shard
+	mask   uint64
+	next   uint64
+	// rows returned by Read, but not yet flushed
+	mu    sync.Mutex
+	taken []cx.Vector
+}
+
+type options struct {
+	shards int
+}
+
+type Option func(o *options)
+
+// WithShards sets the number of shards, it is rounded up to the power of two, default is GOMAXPROCS
+func WithShards(n int) Option {
+	return func(o *options) {
+		o.shards = n
+	}
+}
+
+// NewBuffer returns the in-memory buffer that is safe for concurrent use by many producers
+func NewBuffer(bufferSize uint, opts ...Option) cx.Buffer {
+	return newMemory(bufferSize, opts)
+}
+
+// NewBufferV2 same as NewBuffer, but returns the buffer of the second version
+func NewBufferV2(bufferSize uint, opts ...Option) cx.BufferV2 {
+	return &bufferV2{memory: newMemory(bufferSize, opts)}
+}
+
+func newMemory(bufferSize uint, opts []Option) *memory {
+	o := &options{shards: runtime.GOMAXPROCS(0)}
+	for _, opt := range opts {
+		opt(o)
+	}
+	n := 1
+	for n < o.shards {
+		n <<= 1
+	}
+	m := &memory{shards: make([]shard, n), mask: uint64(n - 1)}
+	for i := range m.shards {
+		m.shards[i].rows = make([]cx.Vector, 0, int(bufferSize)/n+1)
+	}
+	return m
+}
+
+// Write takes the first free shard starting from the next one in turn, and waits for a shard only if all are busy
+func (m *memory) Write(row cx.Vector) {
+	start := atomic.AddUint64(&m.next, 1)
+	for i := uint64(0); i <= m.mask; i++ {
+		s := &m.shards[(start+i)&m.mask]
+		if s.mu.TryLock() {
+			s.append(row)
+			s.mu.Unlock()
+			return
+		}
+	}
+	s := &m.shards[start&m.mask]
+	s.mu.Lock()
+	s.append(row)
+	s.mu.Unlock()
+}
+
+// Read moves rows of all shards to one batch, rows written after Read stay in shards and are not removed by Flush
+func (m *memory) Read() []cx.Vector {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.taken = append(m.taken, m.drain()...)
+	snapshot := make([]cx.Vector, len(m.taken))
+	copy(snapshot, m.taken)
+	return snapshot
+}
+
+func (m *memory) Len() int {
+	m.mu.Lock()
+	size := len(m.taken)
+	m.mu.Unlock()
+	return size + m.buffered()
+}
+
+func (m *memory) Flush() {
+	m.mu.Lock()
+	m.taken = m.taken[:0]
+	m.mu.Unlock()
+}
+
+func (m *memory) buffered() int {
+	var size int64
+	for i := range m.shards {
+		size += atomic.LoadInt64(&m.shards[i].size)
+	}
+	return int(size)
+}
+
+// drain merges rows of all shards into one batch
+func (m *memory) drain() []cx.Vector {
+	rows := make([]cx.Vector, 0, m.buffered())
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		rows = append(rows, s.rows...)
+		s.rows = s.rows[:0]
+		atomic.StoreInt64(&s.size, 0)
+		s.mu.Unlock()
+	}
+	return rows
+}
+
+type bufferV2 struct {
+	memory *memory
+}
+
+func (b *bufferV2) Write(_ context.Context, row cx.Vector) error {
+	b.memory.Write(row)
+	return nil
+}
+
+func (b *bufferV2) Drain(_ context.Context) ([]cx.Vector, error) {
+	return b.memory.drain(), nil
+}
+
+func (b *bufferV2) Len() int {
+	return b.memory.buffered()
+}
+
+func (b *bufferV2) Close() error {
+	return nil
+}
@@ -0,0 +1,383 @@
+package cxstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+const (
+	prefix   = "ch_buffer_stream"
+	rowField = "row"
+	// entries pending longer than this are considered abandoned by a crashed consumer,
+	// the value must be greater than the insert timeout
+	defaultMinIdle = time.Minute
+	// entries delivered this number of times are moved to the dead-letter list instead of being claimed again
+	defaultMaxDeliveries = 5
+)
+
+func key(stream string) string {
+	return prefix + ":" + stream
+}
+
+type options struct {
+	consumer      string
+	minIdle       time.Duration
+	maxDeliveries int64
+	codec         cx.Codec
+	view          cx.View
+	compression   cx.Compression
+	keys          cx.KeyProvider
+}
+
+type Option func(o *options)
+
+// WithConsumer sets the name of the consumer in the group, default is unique for every buffer, see cx.ConsumerName.
+// Entries of consumers that are gone are claimed by others after the min idle time
+func WithConsumer(name string) Option {
+	return func(o *options) {
+		o.consumer = name
+	}
+}
+
+// WithMinIdle sets the time after which unacknowledged entries are claimed again, default 1m.
+// It must be greater than the insert timeout and the time of retries, otherwise batches in progress will be delivered twice
+func WithMinIdle(minIdle time.Duration) Option {
+	return func(o *options) {
+		o.minIdle = minIdle
+	}
+}
+
+// WithMaxDeliveries sets the number of deliveries of an entry, after which it is moved to the rejected list
+// instead of being claimed again, so that a row failing every batch does not fail the rows read with it forever, default 5
+func WithMaxDeliveries(deliveries int64) Option {
+	return func(o *options) {
+		o.maxDeliveries = deliveries
+	}
+}
+
+// WithCodec sets the codec of rows stored in the stream, default is gob.
+// Rows are always wrapped in cx.EnvelopeCodec, pass the envelope itself to register migrations
+func WithCodec(codec cx.Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithView sets the view of the envelope, entries written for another version of the view are moved to the rejected list
+func WithView(view cx.View) Option {
+	return func(o *options) {
+		o.view = view
+	}
+}
+
+// WithCompression sets the compression of the envelope, see cx.WithCompression
+func WithCompression(compression cx.Compression) Option {
+	return func(o *options) {
+		o.compression = compression
+	}
+}
+
+// WithEncryption sets the key provider of the envelope, see cx.WithEncryption
+func WithEncryption(keys cx.KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// RejectedKey returns the key of the list, where entries of the stream that cannot be decoded are moved to,
+// as well as entries of batches failed with errors that cannot be retried and entries delivered too many times
+func RejectedKey(stream string) string {
+	return key(stream) + ":rejected"
+}
+
+// streamBuffer uses Redis Streams with consumer groups and provides at-least-once delivery:
+// rows stay pending in the group until the batch containing them is written into Clickhouse,
+// entries of failed batches and entries abandoned by crashed consumers are claimed and delivered again,
+// up to the max number of deliveries.
+// Entries are acknowledged with the final result of the batch, after client retries,
+// so the min idle time must be greater than the time batches spend in retries
+type streamBuffer struct {
+	client     *redis.Client
+	context    context.Context
+	stream     string
+	group      string
+	options    *options
+	bufferSize int64
+	mu         sync.Mutex
+	// entries of read batches, in the order they were read
+	pending []read
+}
+
+// read holds identifiers and values of entries returned by Read
+type read struct {
+	ids    []string
+	values []interface{}
+}
+
+// NewBuffer creates the consumer group (and the stream) if they do not exist yet
+func NewBuffer(
+	ctx context.Context, rdb *redis.Client, stream, group string, bufferSize uint, opts ...Option,
+) (cx.Buffer, error) {
+	o := &options{
+		minIdle:       defaultMinIdle,
+		maxDeliveries: defaultMaxDeliveries,
+		codec:         cx.NewGobCodec(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.consumer == "" {
+		o.consumer = cx.ConsumerName()
+	}
+	o.codec = cx.Enveloped(o.codec, o.view, cx.EnvelopeOptions(o.compression, o.keys)...)
+	s := &streamBuffer{
+		client:     rdb,
+		context:    ctx,
+		stream:     key(stream),
+		group:      group,
+		options:    o,
+		bufferSize: int64(bufferSize),
+	}
+	// read the stream from the beginning, so that rows written before the group was created are not lost
+	err := rdb.XGroupCreateMkStream(ctx, s.stream, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *streamBuffer) Write(row cx.Vector) {
+	if err := s.write(s.context, row); err != nil && !s.isContextClosedErr(err) {
+		log.Printf("%v\n", err.Error())
+	}
+}
+
+func (s *streamBuffer) write(ctx context.Context, row cx.Vector) error {
+	buf, err := s.options.codec.Encode(row)
+	if err != nil {
+		return fmt.Errorf("stream buffer value encode err: %w", err)
+	}
+	err = s.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		Values: []interface{}{rowField, buf},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("stream buffer write err: %w", err)
+	}
+	return nil
+}
+
+// Read claims abandoned entries first, then reads new ones, up to the buffer size in total
+func (s *streamBuffer) Read() []cx.Vector {
+	rows, err := s.drain(s.context)
+	if err != nil && !s.isContextClosedErr(err) {
+		log.Printf("%v\n", err.Error())
+	}
+	return rows
+}
+
+// drain returns the rows read before the first failure together with it, they stay pending until acknowledged
+func (s *streamBuffer) drain(ctx context.Context) ([]cx.Vector, error) {
+	messages, err := s.claim(ctx)
+	if left := s.bufferSize - int64(len(messages)); left > 0 {
+		streams, readErr := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    s.group,
+			Consumer: s.options.consumer,
+			Streams:  []string{s.stream, ">"},
+			Count:    left,
+			Block:    -1,
+		}).Result()
+		if readErr != nil && !errors.Is(readErr, redis.Nil) && err == nil {
+			err = fmt.Errorf("stream buffer read err: %w", readErr)
+		}
+		for _, stream := range streams {
+			messages = append(messages, stream.Messages...)
+		}
+	}
+	rows := make([]cx.Vector, 0, len(messages))
+	ids := make([]string, 0, len(messages))
+	values := make([]interface{}, 0, len(messages))
+	var broken []string
+	var rejected []interface{}
+	for _, message := range messages {
+		value, _ := message.Values[rowField].(string)
+		v, decodeErr := cx.VectorDecoded(value).DecodeWith(s.options.codec)
+		if decodeErr != nil {
+			log.Printf("stream buffer read err: %v\n", decodeErr.Error())
+			broken = append(broken, message.ID)
+			rejected = append(rejected, value)
+			continue
+		}
+		rows = append(rows, v)
+		ids = append(ids, message.ID)
+		values = append(values, value)
+	}
+	// entries that cannot be decoded would be claimed forever, so they are moved to the dead-letter list
+	if rejectErr := s.reject(ctx, rejected, broken); rejectErr != nil && err == nil {
+		err = rejectErr
+	}
+	if len(ids) > 0 {
+		s.mu.Lock()
+		s.pending = append(s.pending, read{ids: ids, values: values})
+		s.mu.Unlock()
+	}
+	return rows, err
+}
+
+// Len returns the number of entries that were never delivered
+// plus the number of entries that can be claimed from crashed consumers
+func (s *streamBuffer) Len() int {
+	var length *redis.IntCmd
+	var pending *redis.XPendingCmd
+	var claimable *redis.XPendingExtCmd
+	_, err := s.client.Pipelined(s.context, func(pipe redis.Pipeliner) error {
+		length = pipe.XLen(s.context, s.stream)
+		pending = pipe.XPending(s.context, s.stream, s.group)
+		claimable = pipe.XPendingExt(s.context, &redis.XPendingExtArgs{
+			Stream: s.stream,
+			Group:  s.group,
+			Idle:   s.options.minIdle,
+			Start:  "-",
+			End:    "+",
+			Count:  s.bufferSize,
+		})
+		return nil
+	})
+	// an empty group is replied with nil
+	if err != nil && !errors.Is(err, redis.Nil) {
+		if !s.isContextClosedErr(err) {
+			log.Printf("stream buffer len err: %v\n", err.Error())
+		}
+		return 0
+	}
+	var inProgress int64
+	if summary := pending.Val(); summary != nil {
+		inProgress = summary.Count
+	}
+	return int(length.Val()-inProgress) + len(claimable.Val())
+}
+
+// claim takes over entries that were not acknowledged within the min idle time,
+// entries delivered the max number of times are moved to the dead-letter list
+func (s *streamBuffer) claim(ctx context.Context) ([]redis.XMessage, error) {
+	idle, err := s.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: s.stream,
+		Group:  s.group,
+		Idle:   s.options.minIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  s.bufferSize,
+	}).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("stream buffer claim err: %w", err)
+	}
+	if len(idle) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, 0, len(idle))
+	exhausted := map[string]bool{}
+	for _, entry := range idle {
+		ids = append(ids, entry.ID)
+		if s.options.maxDeliveries > 0 && entry.RetryCount >= s.options.maxDeliveries {
+			exhausted[entry.ID] = true
+		}
+	}
+	// XCLAIM checks the idle time again, so entries claimed by another consumer in the meantime are skipped
+	messages, err := s.client.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   s.stream,
+		Group:    s.group,
+		Consumer: s.options.consumer,
+		MinIdle:  s.options.minIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		err = fmt.Errorf("stream buffer claim err: %w", err)
+	}
+	if len(exhausted) == 0 {
+		return messages, err
+	}
+	claimed := messages[:0]
+	var removed []string
+	var rejected []interface{}
+	for _, message := range messages {
+		if !exhausted[message.ID] {
+			claimed = append(claimed, message)
+			continue
+		}
+		removed = append(removed, message.ID)
+		rejected = append(rejected, message.Values[rowField])
+	}
+	if rejectErr := s.reject(ctx, rejected, removed); rejectErr != nil && err == nil {
+		err = rejectErr
+	}
+	return claimed, err
+}
+
+// Flush does nothing, read entries stay pending until they are acknowledged
+func (s *streamBuffer) Flush() {}
+
+// Ack acknowledges and removes entries of the oldest read batch if it was successfully written.
+// Entries of a batch failed with an error that can be retried stay pending and will be claimed again
+// after the min idle time, entries of other failed batches are moved to the dead-letter list
+func (s *streamBuffer) Ack(_ *cx.Batch, err error) {
+	s.mu.Lock()
+	if len(s.pending) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	next := s.pending[0]
+	s.pending = s.pending[1:]
+	s.mu.Unlock()
+	switch {
+	case err == nil:
+		err = s.remove(s.context, next.ids)
+	case cx.IsResendAvailable(err):
+		return
+	default:
+		err = s.reject(s.context, next.values, next.ids)
+	}
+	if err != nil && !s.isContextClosedErr(err) {
+		log.Printf("%v\n", err.Error())
+	}
+}
+
+// reject moves values to the dead-letter list, then removes their entries
+func (s *streamBuffer) reject(ctx context.Context, values []interface{}, ids []string) error {
+	if len(values) > 0 {
+		if err := s.client.RPush(ctx, s.stream+":rejected", values...).Err(); err != nil {
+			return fmt.Errorf("stream buffer reject err: %w", err)
+		}
+	}
+	return s.remove(ctx, ids)
+}
+
+func (s *streamBuffer) remove(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAck(ctx, s.stream, s.group, ids...)
+		pipe.XDel(ctx, s.stream, ids...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("stream buffer ack err: %w", err)
+	}
+	return nil
+}
+
+func (s *streamBuffer) isContextClosedErr(err error) bool {
+	return errors.Is(err, redis.ErrClosed) && s.context.Err() != nil && errors.Is(s.context.Err(), context.Canceled)
+}
@@ -0,0 +1,46 @@
+package cxstream
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// bufferV2 implements cx.BufferV2 on top of the stream buffer, failures are returned instead of being logged
+type bufferV2 struct {
+	stream *streamBuffer
+}
+
+// NewBufferV2 same as NewBuffer, but returns the buffer of the second version
+func NewBufferV2(
+	ctx context.Context, rdb *redis.Client, stream, group string, bufferSize uint, opts ...Option,
+) (cx.BufferV2, error) {
+	buf, err := NewBuffer(ctx, rdb, stream, group, bufferSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferV2{stream: buf.(*streamBuffer)}, nil
+}
+
+func (b *bufferV2) Write(ctx context.Context, row cx.Vector) error {
+	return b.stream.write(ctx, row)
+}
+
+func (b *bufferV2) Drain(ctx context.Context) ([]cx.Vector, error) {
+	return b.stream.drain(ctx)
+}
+
+func (b *bufferV2) Len() int {
+	return b.stream.Len()
+}
+
+// Close does nothing, rows are stored in the stream as soon as they are written, the Redis client is not closed
+func (b *bufferV2) Close() error {
+	return nil
+}
+
+func (b *bufferV2) Ack(batch *cx.Batch, err error) {
+	b.stream.Ack(batch, err)
+}
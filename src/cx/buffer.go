@@ -1,8 +1,8 @@
 package cx
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"sync"
 )
 
 // Buffer it is the interface for creating a data buffer (temporary storage).
@@ -14,6 +14,83 @@ type Buffer interface {
 	Flush()
 }
 
+// BufferV2 is the context- and error-aware version of Buffer.
+// Engines return their failures instead of logging them, so the Writer can report lost rows on Writer.Errors()
+type BufferV2 interface {
+	Write(ctx context.Context, row Vector) error
+	// Drain returns the buffered rows and removes them from the buffer in one step,
+	// rows written concurrently with Drain are either returned or stay in the buffer
+	Drain(ctx context.Context) ([]Vector, error)
+	Len() int
+	// Close releases the resources of the buffer, e.g. stores the rows still kept in memory
+	Close() error
+}
+
+// AdaptBuffer returns the BufferV2 on top of the Buffer of the first version, so that existing engines keep working.
+// Acknowledger of the engine is kept, then rows are removed by acknowledgements instead of Flush.
+// Close is passed to the engine, if it has such a method
+func AdaptBuffer(buffer Buffer) BufferV2 {
+	return &bufferAdapter{buffer: buffer}
+}
+
+type bufferAdapter struct {
+	mu     sync.Mutex
+	buffer Buffer
+}
+
+// Write and Drain ignore the context, engines of the first version cannot be canceled
+func (a *bufferAdapter) Write(_ context.Context, row Vector) error {
+	a.mu.Lock()
+	a.buffer.Write(row)
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *bufferAdapter) Drain(_ context.Context) ([]Vector, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rows := a.buffer.Read()
+	if _, ok := a.buffer.(Acknowledger); !ok {
+		a.buffer.Flush()
+	}
+	return rows, nil
+}
+
+func (a *bufferAdapter) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.buffer.Len()
+}
+
+func (a *bufferAdapter) Close() error {
+	if closer, ok := a.buffer.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (a *bufferAdapter) Ack(batch *Batch, err error) {
+	if ack, ok := a.buffer.(Acknowledger); ok {
+		ack.Ack(batch, err)
+	}
+}
+
+// Acknowledger is an optional interface for Buffer engines with delivery guarantees.
+// Rows returned by Read (or Drain of BufferV2) stay pending in such engines until they are acknowledged:
+// the Writer calls Ack for every batch in the order the batches were read, with the result of writing it into Clickhouse
+type Acknowledger interface {
+	Ack(batch *Batch, err error)
+}
+
+// Spiller is an optional interface for Buffer engines that hold rows beyond the batch size outside of memory,
+// e.g. on local disk. While the previous batch is being written into Clickhouse, the Writer does not wait to flush
+// such engines, so rows accumulate in the engine instead of blocking producers. Such engines may return
+// rows in parts no larger than the batch size, the Writer drains them completely on Close
+type Spiller interface {
+	// Spilled returns the number of rows stored outside of memory
+	Spilled() int
+}
+
 // Vectorable interface is an assistant in the correct formation of the order of fields in the data
 // before sending it to Clickhouse
 type Vectorable interface {
@@ -24,14 +101,10 @@ type Vectorable interface {
 type Vector []interface{}
 
 // Encode turns the Vector type into an array of bytes.
-// Encode is used for data serialization and storage in remote buffers, such as redis.Buffer
+// Encode is used for data serialization and storage in remote buffers, such as redis.Buffer,
+// it uses the gob format, see Codec for the other formats
 func (v Vector) Encode() ([]byte, error) {
-	var buf bytes.Buffer
-	err := gob.NewEncoder(&buf).Encode(v)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return gobCodec{}.Encode(v)
 }
 
 // VectorDecoded a type that is a string, but contains a binary data format
@@ -39,10 +112,10 @@ type VectorDecoded string
 
 // Decode method is required to reverse deserialize an array of bytes in a Vector type
 func (d VectorDecoded) Decode() (Vector, error) {
-	var v Vector
-	err := gob.NewDecoder(bytes.NewReader([]byte(d))).Decode(&v)
-	if err != nil {
-		return nil, err
-	}
-	return v, nil
+	return gobCodec{}.Decode([]byte(d))
+}
+
+// DecodeWith same as Decode, but uses the given codec
+func (d VectorDecoded) DecodeWith(codec Codec) (Vector, error) {
+	return codec.Decode([]byte(d))
 }
@@ -1,8 +1,15 @@
 package cx
 
+import "sync"
+
 // Batch holds information for sending rows batch
 type Batch struct {
 	rows []Vector
+	// functions waiting for the final result of the batch
+	mu     sync.Mutex
+	done   []func(err error)
+	isDone bool
+	result error
 }
 
 // NewBatch creates new batch
@@ -15,3 +22,35 @@ func NewBatch(rows []Vector) *Batch {
 func (b *Batch) Rows() []Vector {
 	return b.rows
 }
+
+// OnDone registers the function called with the final result of the batch:
+// nil once it is written into Clickhouse, or the last error when it is given up, including retries.
+// The function is called immediately if the batch is already done
+func (b *Batch) OnDone(fn func(err error)) {
+	b.mu.Lock()
+	if !b.isDone {
+		b.done = append(b.done, fn)
+		b.mu.Unlock()
+		return
+	}
+	result := b.result
+	b.mu.Unlock()
+	fn(result)
+}
+
+// Done completes the batch with the final result, only the first call has an effect
+func (b *Batch) Done(err error) {
+	b.mu.Lock()
+	if b.isDone {
+		b.mu.Unlock()
+		return
+	}
+	b.isDone = true
+	done := b.done
+	b.done = nil
+	b.result = err
+	b.mu.Unlock()
+	for _, fn := range done {
+		fn(err)
+	}
+}
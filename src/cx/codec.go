@@ -0,0 +1,165 @@
+package cx
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Codec turns the Vector type into an array of bytes and back.
+// Codecs are used for data serialization and storage in remote buffers, such as redis or file buffers
+type Codec interface {
+	// ID is a unique identifier of the codec, engines can store it along with the encoded data
+	ID() uint8
+	Name() string
+	Encode(Vector) ([]byte, error)
+	Decode([]byte) (Vector, error)
+}
+
+// identifiers of the codecs provided by the package, custom codecs should use values starting from 64
+const (
+	GobCodecID    uint8 = 1
+	BinaryCodecID uint8 = 2
+	JSONCodecID   uint8 = 3
+	// RowBinaryCodecID is the identifier of codecs created by NewRowBinaryCodec
+	RowBinaryCodecID uint8 = 4
+)
+
+// nolint:gochecknoglobals // it's OK, registry is protected by mutex
+var codecs = struct {
+	mu     sync.RWMutex
+	byID   map[uint8]Codec
+	byName map[string]Codec
+}{
+	byID: map[uint8]Codec{
+		GobCodecID:    gobCodec{},
+		BinaryCodecID: binaryCodec{},
+		JSONCodecID:   jsonCodec{},
+	},
+	byName: map[string]Codec{
+		gobCodec{}.Name():    gobCodec{},
+		binaryCodec{}.Name(): binaryCodec{},
+		jsonCodec{}.Name():   jsonCodec{},
+	},
+}
+
+// RegisterCodec makes a custom codec available by its identifier and name
+func RegisterCodec(codec Codec) {
+	codecs.mu.Lock()
+	codecs.byID[codec.ID()] = codec
+	codecs.byName[codec.Name()] = codec
+	codecs.mu.Unlock()
+}
+
+// CodecByID returns registered codec by its identifier
+func CodecByID(id uint8) (Codec, bool) {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+	codec, ok := codecs.byID[id]
+	return codec, ok
+}
+
+// CodecByName returns registered codec by its name
+func CodecByName(name string) (Codec, bool) {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+	codec, ok := codecs.byName[name]
+	return codec, ok
+}
+
+// nolint:gochecknoglobals // it's OK, registry is protected by mutex
+// types holds the types that can be stored in a Vector in addition to the basic ones,
+// the most common composite types are registered in advance
+var types = struct {
+	mu     sync.RWMutex
+	byName map[string]reflect.Type
+}{
+	byName: typesOf(
+		time.Time{}, []interface{}{}, []string{}, [][]string{}, [][]interface{}{}, []time.Time{},
+		[]int{}, []int8{}, []int16{}, []int32{}, []int64{},
+		[]uint{}, []uint16{}, []uint32{}, []uint64{},
+		[]float32{}, []float64{}, []bool{},
+		map[string]string{}, map[string]interface{}{},
+	),
+}
+
+func typesOf(values ...interface{}) map[string]reflect.Type {
+	m := make(map[string]reflect.Type, len(values))
+	for _, value := range values {
+		t := reflect.TypeOf(value)
+		m[typeName(t)] = t
+		gob.Register(value)
+	}
+	return m
+}
+
+// RegisterType registers the type of value, so that values of this type placed in a Vector
+// can round-trip through all codecs, e.g. uuid.UUID or custom named types.
+// It also registers the type with encoding/gob, as gob requires it for values stored in interfaces
+func RegisterType(value interface{}) {
+	t := reflect.TypeOf(value)
+	types.mu.Lock()
+	types.byName[typeName(t)] = t
+	types.mu.Unlock()
+	gob.Register(value)
+}
+
+func typeByName(name string) (reflect.Type, error) {
+	types.mu.RLock()
+	defer types.mu.RUnlock()
+	if t, ok := types.byName[name]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("type %s is not registered, use cx.RegisterType", name)
+}
+
+func isRegisteredType(t reflect.Type) bool {
+	types.mu.RLock()
+	defer types.mu.RUnlock()
+	_, ok := types.byName[typeName(t)]
+	return ok
+}
+
+// typeName returns the fully qualified name for named types and the type literal for the others
+func typeName(t reflect.Type) string {
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+// gobCodec is the default codec, it is self-describing, but slow and requires registration
+// of all non-basic types stored in a Vector
+type gobCodec struct{}
+
+// NewGobCodec returns the codec based on encoding/gob, the format used by Vector.Encode
+func NewGobCodec() Codec {
+	return gobCodec{}
+}
+
+func (gobCodec) ID() uint8 {
+	return GobCodecID
+}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Encode(v Vector) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte) (Vector, error) {
+	var v Vector
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
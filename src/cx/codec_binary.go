@@ -0,0 +1,492 @@
+package cx
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// value tags of the binary codec
+const (
+	tagNil byte = iota
+	tagFalse
+	tagTrue
+	tagInt
+	tagInt8
+	tagInt16
+	tagInt32
+	tagInt64
+	tagUint
+	tagUint8
+	tagUint16
+	tagUint32
+	tagUint64
+	tagFloat32
+	tagFloat64
+	tagString
+	tagBytes
+	tagTime
+	tagArray
+	tagTyped
+)
+
+var errMalformedBinary = errors.New("malformed binary vector")
+
+// binaryCodec is a compact self-describing binary format in the spirit of msgpack:
+// every value is prefixed with a one byte tag, integers are varint encoded.
+// Basic types, time.Time and []interface{} are supported natively,
+// other types must be registered with RegisterType
+type binaryCodec struct{}
+
+// NewBinaryCodec returns the compact binary codec
+func NewBinaryCodec() Codec {
+	return binaryCodec{}
+}
+
+func (binaryCodec) ID() uint8 {
+	return BinaryCodecID
+}
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) Encode(v Vector) ([]byte, error) {
+	buf := make([]byte, 0, 16*len(v))
+	buf = appendUvarint(buf, uint64(len(v)))
+	var err error
+	for _, value := range v {
+		if buf, err = appendBinaryValue(buf, value); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (binaryCodec) Decode(data []byte) (Vector, error) {
+	r := bytes.NewReader(data)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(len(data)) {
+		return nil, errMalformedBinary
+	}
+	v := make(Vector, 0, size)
+	for i := uint64(0); i < size; i++ {
+		value, err := readBinaryValue(r)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, value)
+	}
+	return v, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendBytes(buf, value []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// nolint:gocyclo,cyclop // type switch over all supported types
+func appendBinaryValue(buf []byte, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, tagNil), nil
+	case bool:
+		if v {
+			return append(buf, tagTrue), nil
+		}
+		return append(buf, tagFalse), nil
+	case int:
+		return appendVarint(append(buf, tagInt), int64(v)), nil
+	case int8:
+		return append(buf, tagInt8, byte(v)), nil
+	case int16:
+		return appendVarint(append(buf, tagInt16), int64(v)), nil
+	case int32:
+		return appendVarint(append(buf, tagInt32), int64(v)), nil
+	case int64:
+		return appendVarint(append(buf, tagInt64), v), nil
+	case uint:
+		return appendUvarint(append(buf, tagUint), uint64(v)), nil
+	case uint8:
+		return append(buf, tagUint8, v), nil
+	case uint16:
+		return appendUvarint(append(buf, tagUint16), uint64(v)), nil
+	case uint32:
+		return appendUvarint(append(buf, tagUint32), uint64(v)), nil
+	case uint64:
+		return appendUvarint(append(buf, tagUint64), v), nil
+	case float32:
+		return appendUint32(append(buf, tagFloat32), math.Float32bits(v)), nil
+	case float64:
+		return appendUint64(append(buf, tagFloat64), math.Float64bits(v)), nil
+	case string:
+		return appendBytes(append(buf, tagString), []byte(v)), nil
+	case []byte:
+		return appendBytes(append(buf, tagBytes), v), nil
+	case time.Time:
+		data, err := v.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(append(buf, tagTime), data), nil
+	case []interface{}:
+		buf = appendUvarint(append(buf, tagArray), uint64(len(v)))
+		var err error
+		for _, item := range v {
+			if buf, err = appendBinaryValue(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	rv := reflect.ValueOf(value)
+	if !isRegisteredType(rv.Type()) {
+		return nil, fmt.Errorf("type %s is not registered, use cx.RegisterType", typeName(rv.Type()))
+	}
+	buf = appendBytes(append(buf, tagTyped), []byte(typeName(rv.Type())))
+	return appendBinaryTyped(buf, rv)
+}
+
+// appendBinaryTyped writes the payload of a registered type, the type itself is known from its name
+func appendBinaryTyped(buf []byte, rv reflect.Value) ([]byte, error) {
+	if m, ok := rv.Interface().(encoding.BinaryMarshaler); ok {
+		data, err := m.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		return appendBytes(buf, data), nil
+	}
+	var err error
+	// nolint:exhaustive // unsupported kinds are handled by default branch
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		buf = appendUvarint(buf, uint64(rv.Len()))
+		for i := 0; i < rv.Len(); i++ {
+			if buf, err = appendBinaryValue(buf, rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Map:
+		buf = appendUvarint(buf, uint64(rv.Len()))
+		iter := rv.MapRange()
+		for iter.Next() {
+			if buf, err = appendBinaryValue(buf, iter.Key().Interface()); err != nil {
+				return nil, err
+			}
+			if buf, err = appendBinaryValue(buf, iter.Value().Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return append(buf, tagNil), nil
+		}
+		return appendBinaryValue(append(buf, tagTrue), rv.Elem().Interface())
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return appendBinaryValue(buf, basicValue(rv))
+	default:
+		return nil, fmt.Errorf("type %s of kind %s is not supported by binary codec", rv.Type(), rv.Kind())
+	}
+}
+
+// basicValue converts a value of named basic type to the underlying unnamed type, e.g. Status(1) to uint8(1)
+func basicValue(rv reflect.Value) interface{} {
+	// nolint:exhaustive // only basic kinds are passed here
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.String:
+		return rv.String()
+	case reflect.Float32:
+		return float32(rv.Float())
+	case reflect.Float64:
+		return rv.Float()
+	case reflect.Int:
+		return int(rv.Int())
+	case reflect.Int8:
+		return int8(rv.Int())
+	case reflect.Int16:
+		return int16(rv.Int())
+	case reflect.Int32:
+		return int32(rv.Int())
+	case reflect.Int64:
+		return rv.Int()
+	case reflect.Uint:
+		return uint(rv.Uint())
+	case reflect.Uint8:
+		return uint8(rv.Uint())
+	case reflect.Uint16:
+		return uint16(rv.Uint())
+	case reflect.Uint32:
+		return uint32(rv.Uint())
+	default:
+		return rv.Uint()
+	}
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(r.Len()) {
+		return nil, errMalformedBinary
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func readLength(r *bytes.Reader) (int, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	// every element takes at least one byte
+	if size > uint64(r.Len()) {
+		return 0, errMalformedBinary
+	}
+	return int(size), nil
+}
+
+// nolint:gocyclo,cyclop // switch over all supported tags
+func readBinaryValue(r *bytes.Reader) (interface{}, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case tagNil:
+		return nil, nil
+	case tagFalse:
+		return false, nil
+	case tagTrue:
+		return true, nil
+	case tagInt, tagInt16, tagInt32, tagInt64:
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagInt:
+			return int(v), nil
+		case tagInt16:
+			return int16(v), nil
+		case tagInt32:
+			return int32(v), nil
+		}
+		return v, nil
+	case tagInt8:
+		v, err := r.ReadByte()
+		return int8(v), err
+	case tagUint, tagUint16, tagUint32, tagUint64:
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case tagUint:
+			return uint(v), nil
+		case tagUint16:
+			return uint16(v), nil
+		case tagUint32:
+			return uint32(v), nil
+		}
+		return v, nil
+	case tagUint8:
+		return r.ReadByte()
+	case tagFloat32:
+		data := make([]byte, 4)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(data)), nil
+	case tagFloat64:
+		data := make([]byte, 8)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	case tagString:
+		data, err := readBytes(r)
+		return string(data), err
+	case tagBytes:
+		return readBytes(r)
+	case tagTime:
+		data, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		var t time.Time
+		err = t.UnmarshalBinary(data)
+		return t, err
+	case tagArray:
+		size, err := readLength(r)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, size)
+		for i := range values {
+			if values[i], err = readBinaryValue(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	case tagTyped:
+		name, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		t, err := typeByName(string(name))
+		if err != nil {
+			return nil, err
+		}
+		rv := reflect.New(t).Elem()
+		if err = readBinaryTyped(r, rv); err != nil {
+			return nil, err
+		}
+		return rv.Interface(), nil
+	}
+	return nil, fmt.Errorf("%w: unknown tag %d", errMalformedBinary, tag)
+}
+
+// readBinaryTyped reads the payload written by appendBinaryTyped into rv
+func readBinaryTyped(r *bytes.Reader, rv reflect.Value) error {
+	if u, ok := rv.Addr().Interface().(encoding.BinaryUnmarshaler); ok {
+		data, err := readBytes(r)
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalBinary(data)
+	}
+	// nolint:exhaustive // unsupported kinds are handled by default branch
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		size, err := readLength(r)
+		if err != nil {
+			return err
+		}
+		if rv.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(rv.Type(), size, size))
+		} else if size != rv.Len() {
+			return fmt.Errorf("%w: array %s of length %d", errMalformedBinary, rv.Type(), size)
+		}
+		for i := 0; i < size; i++ {
+			value, err := readBinaryValue(r)
+			if err != nil {
+				return err
+			}
+			if err = assign(rv.Index(i), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		size, err := readLength(r)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.MakeMapWithSize(rv.Type(), size))
+		for i := 0; i < size; i++ {
+			k, err := readBinaryValue(r)
+			if err != nil {
+				return err
+			}
+			v, err := readBinaryValue(r)
+			if err != nil {
+				return err
+			}
+			key, value := reflect.New(rv.Type().Key()).Elem(), reflect.New(rv.Type().Elem()).Elem()
+			if err = assign(key, k); err != nil {
+				return err
+			}
+			if err = assign(value, v); err != nil {
+				return err
+			}
+			rv.SetMapIndex(key, value)
+		}
+		return nil
+	case reflect.Ptr:
+		flag, err := r.ReadByte()
+		if err != nil || flag == tagNil {
+			return err
+		}
+		value, err := readBinaryValue(r)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.New(rv.Type().Elem()))
+		return assign(rv.Elem(), value)
+	default:
+		value, err := readBinaryValue(r)
+		if err != nil {
+			return err
+		}
+		return assign(rv, value)
+	}
+}
+
+// assign sets the decoded value to the destination, converting it to the destination type if necessary
+func assign(dst reflect.Value, value interface{}) error {
+	if value == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	rv := reflect.ValueOf(value)
+	switch {
+	case rv.Type().AssignableTo(dst.Type()):
+		dst.Set(rv)
+	case rv.Type().ConvertibleTo(dst.Type()) && rv.Kind() != reflect.Slice:
+		dst.Set(rv.Convert(dst.Type()))
+	case rv.Kind() == reflect.Slice && dst.Kind() == reflect.Slice:
+		// e.g. []interface{} decoded from a nested array into a typed slice
+		dst.Set(reflect.MakeSlice(dst.Type(), rv.Len(), rv.Len()))
+		for i := 0; i < rv.Len(); i++ {
+			if err := assign(dst.Index(i), rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot assign value of type %s to %s", rv.Type(), dst.Type())
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package cx
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// value tags of the JSON codec, strings, booleans and nulls are written as is
+const (
+	jsonInt     = "i"
+	jsonInt8    = "i8"
+	jsonInt16   = "i16"
+	jsonInt32   = "i32"
+	jsonInt64   = "i64"
+	jsonUint    = "u"
+	jsonUint8   = "u8"
+	jsonUint16  = "u16"
+	jsonUint32  = "u32"
+	jsonUint64  = "u64"
+	jsonFloat32 = "f32"
+	jsonFloat64 = "f64"
+	jsonBytes   = "b"
+	jsonTime    = "t"
+	jsonArray   = "a"
+	jsonTyped   = "T"
+)
+
+var errMalformedJSON = errors.New("malformed json vector")
+
+// jsonCodec is a human-readable format, every value except strings, booleans and nulls
+// is written as a pair of the type tag and the value, e.g. ["u8",1], so that the types survive the round-trip.
+// The set of supported types is the same as in the binary codec
+type jsonCodec struct{}
+
+// NewJSONCodec returns the JSON codec
+func NewJSONCodec() Codec {
+	return jsonCodec{}
+}
+
+func (jsonCodec) ID() uint8 {
+	return JSONCodecID
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Encode(v Vector) ([]byte, error) {
+	values := make([]interface{}, 0, len(v))
+	for _, value := range v {
+		encoded, err := toJSONValue(value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, encoded)
+	}
+	return json.Marshal(values)
+}
+
+func (jsonCodec) Decode(data []byte) (Vector, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values []interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, err
+	}
+	v := make(Vector, 0, len(values))
+	for _, value := range values {
+		decoded, err := fromJSONValue(value)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, decoded)
+	}
+	return v, nil
+}
+
+func tagged(tag string, value interface{}) []interface{} {
+	return []interface{}{tag, value}
+}
+
+// nolint:gocyclo,cyclop // type switch over all supported types
+func toJSONValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, string:
+		return v, nil
+	case int:
+		return tagged(jsonInt, v), nil
+	case int8:
+		return tagged(jsonInt8, v), nil
+	case int16:
+		return tagged(jsonInt16, v), nil
+	case int32:
+		return tagged(jsonInt32, v), nil
+	case int64:
+		return tagged(jsonInt64, v), nil
+	case uint:
+		return tagged(jsonUint, v), nil
+	case uint8:
+		return tagged(jsonUint8, v), nil
+	case uint16:
+		return tagged(jsonUint16, v), nil
+	case uint32:
+		return tagged(jsonUint32, v), nil
+	case uint64:
+		return tagged(jsonUint64, v), nil
+	case float32:
+		return tagged(jsonFloat32, v), nil
+	case float64:
+		return tagged(jsonFloat64, v), nil
+	case []byte:
+		return tagged(jsonBytes, base64.StdEncoding.EncodeToString(v)), nil
+	case time.Time:
+		return tagged(jsonTime, v.Format(time.RFC3339Nano)), nil
+	case []interface{}:
+		items, err := toJSONValues(v)
+		if err != nil {
+			return nil, err
+		}
+		return tagged(jsonArray, items), nil
+	}
+	rv := reflect.ValueOf(value)
+	if !isRegisteredType(rv.Type()) {
+		return nil, fmt.Errorf("type %s is not registered, use cx.RegisterType", typeName(rv.Type()))
+	}
+	payload, err := toJSONTyped(rv)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{jsonTyped, typeName(rv.Type()), payload}, nil
+}
+
+func toJSONValues(values []interface{}) ([]interface{}, error) {
+	items := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		item, err := toJSONValue(value)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// toJSONTyped returns the payload of a registered type
+func toJSONTyped(rv reflect.Value) (interface{}, error) {
+	switch m := rv.Interface().(type) {
+	case encoding.TextMarshaler:
+		text, err := m.MarshalText()
+		return string(text), err
+	case encoding.BinaryMarshaler:
+		data, err := m.MarshalBinary()
+		return base64.StdEncoding.EncodeToString(data), err
+	}
+	// nolint:exhaustive // unsupported kinds are handled by default branch
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		items := make([]interface{}, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			item, err := toJSONValue(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	case reflect.Map:
+		pairs := make([]interface{}, 0, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			pair, err := toJSONValues([]interface{}{iter.Key().Interface(), iter.Value().Interface()})
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, pair)
+		}
+		return pairs, nil
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return toJSONValue(rv.Elem().Interface())
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return toJSONValue(basicValue(rv))
+	default:
+		return nil, fmt.Errorf("type %s of kind %s is not supported by json codec", rv.Type(), rv.Kind())
+	}
+}
+
+// nolint:gocyclo,cyclop // switch over all supported tags
+func fromJSONValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, string:
+		return v, nil
+	case []interface{}:
+		if len(v) < 2 {
+			return nil, errMalformedJSON
+		}
+		tag, _ := v[0].(string)
+		if tag == jsonTyped {
+			return fromJSONTyped(v)
+		}
+		switch tag {
+		case jsonInt, jsonInt8, jsonInt16, jsonInt32, jsonInt64:
+			return parseJSONInt(tag, v[1])
+		case jsonUint, jsonUint8, jsonUint16, jsonUint32, jsonUint64:
+			return parseJSONUint(tag, v[1])
+		case jsonFloat32, jsonFloat64:
+			return parseJSONFloat(tag, v[1])
+		case jsonBytes:
+			s, _ := v[1].(string)
+			return base64.StdEncoding.DecodeString(s)
+		case jsonTime:
+			s, _ := v[1].(string)
+			return time.Parse(time.RFC3339Nano, s)
+		case jsonArray:
+			items, _ := v[1].([]interface{})
+			values := make([]interface{}, len(items))
+			for i, item := range items {
+				decoded, err := fromJSONValue(item)
+				if err != nil {
+					return nil, err
+				}
+				values[i] = decoded
+			}
+			return values, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unexpected value %v", errMalformedJSON, value)
+}
+
+func parseJSONInt(tag string, value interface{}) (interface{}, error) {
+	n, _ := value.(json.Number)
+	var bits int
+	switch tag {
+	case jsonInt8:
+		bits = 8
+	case jsonInt16:
+		bits = 16
+	case jsonInt32:
+		bits = 32
+	default:
+		bits = 64
+	}
+	i, err := strconv.ParseInt(n.String(), 10, bits)
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case jsonInt:
+		return int(i), nil
+	case jsonInt8:
+		return int8(i), nil
+	case jsonInt16:
+		return int16(i), nil
+	case jsonInt32:
+		return int32(i), nil
+	}
+	return i, nil
+}
+
+func parseJSONUint(tag string, value interface{}) (interface{}, error) {
+	n, _ := value.(json.Number)
+	var bits int
+	switch tag {
+	case jsonUint8:
+		bits = 8
+	case jsonUint16:
+		bits = 16
+	case jsonUint32:
+		bits = 32
+	default:
+		bits = 64
+	}
+	u, err := strconv.ParseUint(n.String(), 10, bits)
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case jsonUint:
+		return uint(u), nil
+	case jsonUint8:
+		return uint8(u), nil
+	case jsonUint16:
+		return uint16(u), nil
+	case jsonUint32:
+		return uint32(u), nil
+	}
+	return u, nil
+}
+
+func parseJSONFloat(tag string, value interface{}) (interface{}, error) {
+	n, _ := value.(json.Number)
+	if tag == jsonFloat32 {
+		f, err := strconv.ParseFloat(n.String(), 32)
+		return float32(f), err
+	}
+	return strconv.ParseFloat(n.String(), 64)
+}
+
+// fromJSONTyped decodes ["T", name, payload] into a value of registered type
+func fromJSONTyped(v []interface{}) (interface{}, error) {
+	if len(v) != 3 {
+		return nil, errMalformedJSON
+	}
+	name, _ := v[1].(string)
+	t, err := typeByName(name)
+	if err != nil {
+		return nil, err
+	}
+	rv := reflect.New(t).Elem()
+	if err = readJSONTyped(rv, v[2]); err != nil {
+		return nil, err
+	}
+	return rv.Interface(), nil
+}
+
+// nolint:gocyclo,cyclop // switch over all supported kinds
+func readJSONTyped(rv reflect.Value, payload interface{}) error {
+	switch u := rv.Addr().Interface().(type) {
+	case encoding.TextUnmarshaler:
+		s, _ := payload.(string)
+		return u.UnmarshalText([]byte(s))
+	case encoding.BinaryUnmarshaler:
+		s, _ := payload.(string)
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		return u.UnmarshalBinary(data)
+	}
+	// nolint:exhaustive // unsupported kinds are handled by default branch
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		items, _ := payload.([]interface{})
+		if rv.Kind() == reflect.Slice {
+			rv.Set(reflect.MakeSlice(rv.Type(), len(items), len(items)))
+		} else if len(items) != rv.Len() {
+			return fmt.Errorf("%w: array %s of length %d", errMalformedJSON, rv.Type(), len(items))
+		}
+		for i, item := range items {
+			value, err := fromJSONValue(item)
+			if err != nil {
+				return err
+			}
+			if err = assign(rv.Index(i), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		pairs, _ := payload.([]interface{})
+		rv.Set(reflect.MakeMapWithSize(rv.Type(), len(pairs)))
+		for _, item := range pairs {
+			pair, _ := item.([]interface{})
+			if len(pair) != 2 {
+				return errMalformedJSON
+			}
+			k, err := fromJSONValue(pair[0])
+			if err != nil {
+				return err
+			}
+			v, err := fromJSONValue(pair[1])
+			if err != nil {
+				return err
+			}
+			key, value := reflect.New(rv.Type().Key()).Elem(), reflect.New(rv.Type().Elem()).Elem()
+			if err = assign(key, k); err != nil {
+				return err
+			}
+			if err = assign(value, v); err != nil {
+				return err
+			}
+			rv.SetMapIndex(key, value)
+		}
+		return nil
+	case reflect.Ptr:
+		if payload == nil {
+			return nil
+		}
+		value, err := fromJSONValue(payload)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.New(rv.Type().Elem()))
+		return assign(rv.Elem(), value)
+	default:
+		value, err := fromJSONValue(payload)
+		if err != nil {
+			return err
+		}
+		return assign(rv, value)
+	}
+}
@@ -0,0 +1,610 @@
+package cx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const secondsInDay = 24 * 60 * 60
+
+var errMalformedRowBinary = errors.New("malformed rowbinary vector")
+
+// rowBinaryCodec is a schema-aware codec, values are written one after another in the format of Clickhouse RowBinary,
+// without any type information, so it is the most compact and the fastest codec.
+// Decoded values have the types chosen by the column type: UInt8 is decoded as uint8, String, FixedString and Enum
+// as string, UUID as uuid.UUID, dates as time.Time, Array(T) as a slice of T, Tuple as []interface{},
+// Map(K, V) as map[K]V and Nullable(T) as *T
+type rowBinaryCodec struct {
+	names   []string
+	columns []*columnType
+}
+
+// NewRowBinaryCodec returns the codec for rows of the view, the view must be created with NewTypedView.
+// The codec depends on the view, so it is not available from the registry
+func NewRowBinaryCodec(view View) (Codec, error) {
+	if len(view.Types) != len(view.Columns) {
+		return nil, fmt.Errorf("view %s: expected types of %d columns, received %d", view.Name, len(view.Columns), len(view.Types))
+	}
+	c := &rowBinaryCodec{
+		names:   view.Columns,
+		columns: make([]*columnType, 0, len(view.Types)),
+	}
+	for i, definition := range view.Types {
+		column, err := parseColumnType(definition)
+		if err != nil {
+			return nil, fmt.Errorf("view %s, column %s: %w", view.Name, view.Columns[i], err)
+		}
+		c.columns = append(c.columns, column)
+	}
+	return c, nil
+}
+
+func (c *rowBinaryCodec) ID() uint8 {
+	return RowBinaryCodecID
+}
+
+func (c *rowBinaryCodec) Name() string {
+	return "rowbinary"
+}
+
+func (c *rowBinaryCodec) Encode(v Vector) ([]byte, error) {
+	if len(v) != len(c.columns) {
+		return nil, fmt.Errorf("expected %d columns, received %d", len(c.columns), len(v))
+	}
+	buf := make([]byte, 0, 16*len(v))
+	var err error
+	for i, column := range c.columns {
+		if buf, err = column.append(buf, v[i]); err != nil {
+			return nil, fmt.Errorf("column %s: %w", c.names[i], err)
+		}
+	}
+	return buf, nil
+}
+
+func (c *rowBinaryCodec) Decode(data []byte) (Vector, error) {
+	r := bytes.NewReader(data)
+	v := make(Vector, 0, len(c.columns))
+	for i, column := range c.columns {
+		value, err := column.read(r)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", c.names[i], err)
+		}
+		v = append(v, value.Interface())
+	}
+	if r.Len() != 0 {
+		return nil, errMalformedRowBinary
+	}
+	return v, nil
+}
+
+func appendUint16LE(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+
+func appendUint32LE(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+func appendUint64LE(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+// append writes the value in the format of the column type
+// nolint:gocyclo,cyclop // switch over all supported types
+func (t *columnType) append(buf []byte, value interface{}) ([]byte, error) {
+	if t.kind == kindNullable {
+		return t.appendNullable(buf, value)
+	}
+	// the most common values are written without reflection
+	switch v := value.(type) {
+	case string:
+		if t.kind == kindString {
+			buf = appendUvarint(buf, uint64(len(v)))
+			return append(buf, v...), nil
+		}
+	case int64:
+		if t.kind == kindInt64 {
+			return appendUint64LE(buf, uint64(v)), nil
+		}
+	case uint8:
+		if t.kind == kindUInt8 {
+			return append(buf, v), nil
+		}
+	case time.Time:
+		if t.kind == kindDate || t.kind == kindDate32 || t.kind == kindDateTime || t.kind == kindDateTime64 {
+			return t.appendTime(buf, v)
+		}
+	}
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil, errors.New("nil value of non-nullable column")
+	}
+	switch t.kind {
+	case kindInt8, kindInt16, kindInt32, kindInt64, kindEnum8, kindEnum16:
+		i, err := t.intValue(rv)
+		if err != nil {
+			return nil, err
+		}
+		return appendIntLE(buf, t.kind, i), nil
+	case kindUInt8, kindUInt16, kindUInt32, kindUInt64:
+		u, err := uintValue(rv, t.bits())
+		if err != nil {
+			return nil, err
+		}
+		return appendIntLE(buf, t.kind, int64(u)), nil
+	case kindFloat32, kindFloat64:
+		f, err := floatValue(rv)
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == kindFloat32 {
+			return appendUint32LE(buf, math.Float32bits(float32(f))), nil
+		}
+		return appendUint64LE(buf, math.Float64bits(f)), nil
+	case kindBool:
+		b, err := boolValue(rv)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case kindString, kindFixedString:
+		s, err := bytesValue(rv)
+		if err != nil {
+			return nil, err
+		}
+		if t.kind == kindString {
+			return appendBytes(buf, s), nil
+		}
+		if len(s) > t.size {
+			return nil, fmt.Errorf("value of length %d does not fit FixedString(%d)", len(s), t.size)
+		}
+		buf = append(buf, s...)
+		return append(buf, make([]byte, t.size-len(s))...), nil
+	case kindUUID:
+		return appendUUID(buf, rv)
+	case kindDate, kindDate32, kindDateTime, kindDateTime64:
+		tm, ok := rv.Interface().(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("cannot write value of type %s as date", rv.Type())
+		}
+		return t.appendTime(buf, tm)
+	case kindArray, kindTuple:
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, fmt.Errorf("cannot write value of type %s as array or tuple", rv.Type())
+		}
+		if t.kind == kindTuple {
+			if rv.Len() != len(t.elems) {
+				return nil, fmt.Errorf("expected tuple of %d elements, received %d", len(t.elems), rv.Len())
+			}
+		} else {
+			buf = appendUvarint(buf, uint64(rv.Len()))
+		}
+		var err error
+		for i := 0; i < rv.Len(); i++ {
+			elem := t.elems[0]
+			if t.kind == kindTuple {
+				elem = t.elems[i]
+			}
+			if buf, err = elem.append(buf, rv.Index(i).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case kindMap:
+		if rv.Kind() != reflect.Map {
+			return nil, fmt.Errorf("cannot write value of type %s as map", rv.Type())
+		}
+		buf = appendUvarint(buf, uint64(rv.Len()))
+		var err error
+		iter := rv.MapRange()
+		for iter.Next() {
+			if buf, err = t.elems[0].append(buf, iter.Key().Interface()); err != nil {
+				return nil, err
+			}
+			if buf, err = t.elems[1].append(buf, iter.Value().Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("unexpected column kind %d", t.kind)
+}
+
+// appendNullable writes the null flag followed by the value, nil and nil pointers are written as NULL
+func (t *columnType) appendNullable(buf []byte, value interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(value)
+	if !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return append(buf, 1), nil
+	}
+	return t.elems[0].append(append(buf, 0), value)
+}
+
+func (t *columnType) appendTime(buf []byte, tm time.Time) ([]byte, error) {
+	switch t.kind {
+	case kindDate, kindDate32:
+		// date is a calendar day, so it is taken in the location of the value
+		year, month, day := tm.Date()
+		days := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / secondsInDay
+		if t.kind == kindDate32 {
+			return appendUint32LE(buf, uint32(int32(days))), nil
+		}
+		if days < 0 || days > math.MaxUint16 {
+			return nil, fmt.Errorf("date %s is out of range", tm)
+		}
+		return appendUint16LE(buf, uint16(days)), nil
+	case kindDateTime:
+		if tm.Unix() < 0 || tm.Unix() > math.MaxUint32 {
+			return nil, fmt.Errorf("date %s is out of range", tm)
+		}
+		return appendUint32LE(buf, uint32(tm.Unix())), nil
+	default:
+		scale := int64(math.Pow10(9 - t.size))
+		ticks := tm.Unix()*int64(math.Pow10(t.size)) + int64(tm.Nanosecond())/scale
+		return appendUint64LE(buf, uint64(ticks)), nil
+	}
+}
+
+func appendUUID(buf []byte, rv reflect.Value) ([]byte, error) {
+	var id uuid.UUID
+	switch {
+	case rv.Kind() == reflect.String:
+		parsed, err := uuid.Parse(rv.String())
+		if err != nil {
+			return nil, err
+		}
+		id = parsed
+	case rv.Kind() == reflect.Array && rv.Len() == len(id) && rv.Type().Elem().Kind() == reflect.Uint8:
+		reflect.Copy(reflect.ValueOf(id[:]), rv)
+	default:
+		return nil, fmt.Errorf("cannot write value of type %s as UUID", rv.Type())
+	}
+	// Clickhouse stores UUID as two little endian 64-bit halves
+	for i := 7; i >= 0; i-- {
+		buf = append(buf, id[i])
+	}
+	for i := 15; i >= 8; i-- {
+		buf = append(buf, id[i])
+	}
+	return buf, nil
+}
+
+func appendIntLE(buf []byte, kind columnKind, v int64) []byte {
+	switch kind {
+	case kindInt8, kindUInt8, kindEnum8:
+		return append(buf, byte(v))
+	case kindInt16, kindUInt16, kindEnum16:
+		return appendUint16LE(buf, uint16(v))
+	case kindInt32, kindUInt32:
+		return appendUint32LE(buf, uint32(v))
+	default:
+		return appendUint64LE(buf, uint64(v))
+	}
+}
+
+// bits returns the size of the integer column type in bits
+func (t *columnType) bits() int {
+	switch t.kind {
+	case kindInt8, kindUInt8, kindEnum8, kindBool:
+		return 8
+	case kindInt16, kindUInt16, kindEnum16:
+		return 16
+	case kindInt32, kindUInt32:
+		return 32
+	default:
+		return 64
+	}
+}
+
+// intValue returns the integer value of signed integer and enum columns, enum values can be written by name
+func (t *columnType) intValue(rv reflect.Value) (int64, error) {
+	if t.enum != nil {
+		if rv.Kind() == reflect.String {
+			value, ok := t.enum[rv.String()]
+			if !ok {
+				return 0, fmt.Errorf("unknown enum value %q", rv.String())
+			}
+			return int64(value), nil
+		}
+		i, err := intValue(rv, t.bits())
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := t.names[int16(i)]; !ok {
+			return 0, fmt.Errorf("unknown enum value %d", i)
+		}
+		return i, nil
+	}
+	return intValue(rv, t.bits())
+}
+
+// nolint:exhaustive // other kinds are not integers
+func intValue(rv reflect.Value, bits int) (int64, error) {
+	var i int64
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i = rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return 0, fmt.Errorf("value %d overflows Int%d", rv.Uint(), bits)
+		}
+		i = int64(rv.Uint())
+	case reflect.Bool:
+		if rv.Bool() {
+			i = 1
+		}
+	default:
+		return 0, fmt.Errorf("cannot write value of type %s as integer", rv.Type())
+	}
+	if bits < 64 && (i < -1<<(bits-1) || i >= 1<<(bits-1)) {
+		return 0, fmt.Errorf("value %d overflows Int%d", i, bits)
+	}
+	return i, nil
+}
+
+// nolint:exhaustive // other kinds are not integers
+func uintValue(rv reflect.Value, bits int) (uint64, error) {
+	var u uint64
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.Int() < 0 {
+			return 0, fmt.Errorf("negative value %d of UInt%d", rv.Int(), bits)
+		}
+		u = uint64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u = rv.Uint()
+	case reflect.Bool:
+		if rv.Bool() {
+			u = 1
+		}
+	default:
+		return 0, fmt.Errorf("cannot write value of type %s as integer", rv.Type())
+	}
+	if bits < 64 && u >= 1<<bits {
+		return 0, fmt.Errorf("value %d overflows UInt%d", u, bits)
+	}
+	return u, nil
+}
+
+// nolint:exhaustive // other kinds are not numbers
+func floatValue(rv reflect.Value) (float64, error) {
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), nil
+	default:
+		return 0, fmt.Errorf("cannot write value of type %s as float", rv.Type())
+	}
+}
+
+// boolValue accepts booleans and integers, non-zero integers are written as true
+func boolValue(rv reflect.Value) (bool, error) {
+	if rv.Kind() == reflect.Bool {
+		return rv.Bool(), nil
+	}
+	i, err := intValue(rv, 64)
+	if err != nil {
+		return false, fmt.Errorf("cannot write value of type %s as bool", rv.Type())
+	}
+	return i != 0, nil
+}
+
+func bytesValue(rv reflect.Value) ([]byte, error) {
+	switch {
+	case rv.Kind() == reflect.String:
+		return []byte(rv.String()), nil
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+		return rv.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("cannot write value of type %s as string", rv.Type())
+	}
+}
+
+// read reads a value of the column type, the returned value always has the goType of the column type
+// nolint:gocyclo,cyclop // switch over all supported types
+func (t *columnType) read(r *bytes.Reader) (reflect.Value, error) {
+	switch t.kind {
+	case kindInt8, kindInt16, kindInt32, kindInt64, kindUInt8, kindUInt16, kindUInt32, kindUInt64, kindBool:
+		u, err := readUintLE(r, t.bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return integerOf(t.kind, u), nil
+	case kindFloat32:
+		u, err := readUintLE(r, 32)
+		return reflect.ValueOf(math.Float32frombits(uint32(u))), err
+	case kindFloat64:
+		u, err := readUintLE(r, 64)
+		return reflect.ValueOf(math.Float64frombits(u)), err
+	case kindEnum8, kindEnum16:
+		u, err := readUintLE(r, t.bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		value := int16(int8(u))
+		if t.kind == kindEnum16 {
+			value = int16(u)
+		}
+		name, ok := t.names[value]
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("%w: unknown enum value %d", errMalformedRowBinary, value)
+		}
+		return reflect.ValueOf(name), nil
+	case kindString:
+		data, err := readBytes(r)
+		return reflect.ValueOf(string(data)), err
+	case kindFixedString:
+		data := make([]byte, t.size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(strings.TrimRight(string(data), "\x00")), nil
+	case kindUUID:
+		return readUUID(r)
+	case kindDate, kindDate32, kindDateTime, kindDateTime64:
+		return t.readTime(r)
+	case kindArray, kindTuple:
+		return t.readArray(r)
+	case kindMap:
+		size, err := readLength(r)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		m := reflect.MakeMapWithSize(t.goType, size)
+		for i := 0; i < size; i++ {
+			k, keyErr := t.elems[0].read(r)
+			if keyErr != nil {
+				return reflect.Value{}, keyErr
+			}
+			v, valueErr := t.elems[1].read(r)
+			if valueErr != nil {
+				return reflect.Value{}, valueErr
+			}
+			m.SetMapIndex(k, v)
+		}
+		return m, nil
+	case kindNullable:
+		isNull, err := r.ReadByte()
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if isNull == 1 {
+			return reflect.Zero(t.goType), nil
+		}
+		v, err := t.elems[0].read(r)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		p := reflect.New(t.elems[0].goType)
+		p.Elem().Set(v)
+		return p, nil
+	}
+	return reflect.Value{}, fmt.Errorf("unexpected column kind %d", t.kind)
+}
+
+func (t *columnType) readArray(r *bytes.Reader) (reflect.Value, error) {
+	size := len(t.elems)
+	if t.kind == kindArray {
+		var err error
+		if size, err = readLength(r); err != nil {
+			return reflect.Value{}, err
+		}
+	}
+	slice := reflect.MakeSlice(t.goType, size, size)
+	for i := 0; i < size; i++ {
+		elem := t.elems[0]
+		if t.kind == kindTuple {
+			elem = t.elems[i]
+		}
+		v, err := elem.read(r)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		slice.Index(i).Set(v)
+	}
+	return slice, nil
+}
+
+func (t *columnType) readTime(r *bytes.Reader) (reflect.Value, error) {
+	var tm time.Time
+	switch t.kind {
+	case kindDate:
+		days, err := readUintLE(r, 16)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		tm = time.Unix(int64(days)*secondsInDay, 0).UTC()
+	case kindDate32:
+		days, err := readUintLE(r, 32)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		tm = time.Unix(int64(int32(days))*secondsInDay, 0).UTC()
+	case kindDateTime:
+		seconds, err := readUintLE(r, 32)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		tm = time.Unix(int64(seconds), 0)
+	default:
+		ticks, err := readUintLE(r, 64)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		scale := int64(math.Pow10(t.size))
+		seconds, fraction := int64(ticks)/scale, int64(ticks)%scale
+		if fraction < 0 {
+			seconds, fraction = seconds-1, fraction+scale
+		}
+		tm = time.Unix(seconds, fraction*int64(math.Pow10(9-t.size)))
+	}
+	if t.location != nil {
+		tm = tm.In(t.location)
+	}
+	return reflect.ValueOf(tm), nil
+}
+
+func readUUID(r *bytes.Reader) (reflect.Value, error) {
+	var data [16]byte
+	if _, err := io.ReadFull(r, data[:]); err != nil {
+		return reflect.Value{}, err
+	}
+	var id uuid.UUID
+	for i := 0; i < 8; i++ {
+		id[i], id[8+i] = data[7-i], data[15-i]
+	}
+	return reflect.ValueOf(id), nil
+}
+
+func readUintLE(r *bytes.Reader, bits int) (uint64, error) {
+	var tmp [8]byte
+	if _, err := io.ReadFull(r, tmp[:bits/8]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(tmp[:]), nil
+}
+
+// integerOf converts the raw value to the Go type of the column kind
+func integerOf(kind columnKind, u uint64) reflect.Value {
+	switch kind {
+	case kindInt8:
+		return reflect.ValueOf(int8(u))
+	case kindInt16:
+		return reflect.ValueOf(int16(u))
+	case kindInt32:
+		return reflect.ValueOf(int32(u))
+	case kindInt64:
+		return reflect.ValueOf(int64(u))
+	case kindUInt8:
+		return reflect.ValueOf(uint8(u))
+	case kindUInt16:
+		return reflect.ValueOf(uint16(u))
+	case kindUInt32:
+		return reflect.ValueOf(uint32(u))
+	case kindBool:
+		return reflect.ValueOf(u != 0)
+	default:
+		return reflect.ValueOf(u)
+	}
+}
@@ -0,0 +1,278 @@
+package cx
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type columnKind uint8
+
+const (
+	kindInt8 columnKind = iota
+	kindInt16
+	kindInt32
+	kindInt64
+	kindUInt8
+	kindUInt16
+	kindUInt32
+	kindUInt64
+	kindFloat32
+	kindFloat64
+	kindBool
+	kindString
+	kindFixedString
+	kindUUID
+	kindDate
+	kindDate32
+	kindDateTime
+	kindDateTime64
+	kindEnum8
+	kindEnum16
+	kindArray
+	kindTuple
+	kindMap
+	kindNullable
+)
+
+// columnType is a parsed Clickhouse type, e.g. Array(Nullable(String))
+type columnType struct {
+	kind columnKind
+	// length of FixedString or precision of DateTime64
+	size int
+	// time zone of DateTime and DateTime64, nil if not specified
+	location *time.Location
+	enum     map[string]int16
+	names    map[int16]string
+	elems    []*columnType
+	// goType is the type of decoded values
+	goType reflect.Type
+}
+
+// nolint:gocyclo,cyclop // switch over all supported types
+func simpleColumnType(name string) (*columnType, bool) {
+	var kind columnKind
+	var value interface{}
+	switch name {
+	case "Int8":
+		kind, value = kindInt8, int8(0)
+	case "Int16":
+		kind, value = kindInt16, int16(0)
+	case "Int32":
+		kind, value = kindInt32, int32(0)
+	case "Int64":
+		kind, value = kindInt64, int64(0)
+	case "UInt8":
+		kind, value = kindUInt8, uint8(0)
+	case "UInt16":
+		kind, value = kindUInt16, uint16(0)
+	case "UInt32":
+		kind, value = kindUInt32, uint32(0)
+	case "UInt64":
+		kind, value = kindUInt64, uint64(0)
+	case "Float32":
+		kind, value = kindFloat32, float32(0)
+	case "Float64":
+		kind, value = kindFloat64, float64(0)
+	case "Bool", "Boolean":
+		kind, value = kindBool, false
+	case "String":
+		kind, value = kindString, ""
+	case "UUID":
+		kind, value = kindUUID, uuid.UUID{}
+	case "Date":
+		kind, value = kindDate, time.Time{}
+	case "Date32":
+		kind, value = kindDate32, time.Time{}
+	default:
+		return nil, false
+	}
+	return &columnType{kind: kind, goType: reflect.TypeOf(value)}, true
+}
+
+// parseColumnType parses the type of column as it is written in the CREATE TABLE query
+// nolint:gocyclo,cyclop // switch over all supported types
+func parseColumnType(definition string) (*columnType, error) {
+	definition = strings.TrimSpace(definition)
+	name, args := definition, ""
+	if i := strings.IndexByte(definition, '('); i >= 0 {
+		if !strings.HasSuffix(definition, ")") {
+			return nil, fmt.Errorf("invalid column type %q", definition)
+		}
+		name, args = strings.TrimSpace(definition[:i]), definition[i+1:len(definition)-1]
+	}
+	if t, ok := simpleColumnType(name); ok && args == "" {
+		return t, nil
+	}
+	switch name {
+	case "LowCardinality":
+		// dictionary encoding does not affect the row format
+		return parseColumnType(args)
+	case "FixedString":
+		size, err := strconv.Atoi(strings.TrimSpace(args))
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid length of %q", definition)
+		}
+		return &columnType{kind: kindFixedString, size: size, goType: reflect.TypeOf("")}, nil
+	case "DateTime":
+		t := &columnType{kind: kindDateTime, goType: reflect.TypeOf(time.Time{})}
+		if args != "" {
+			location, err := time.LoadLocation(unquote(args))
+			if err != nil {
+				return nil, err
+			}
+			t.location = location
+		}
+		return t, nil
+	case "DateTime64":
+		return parseDateTime64(definition, args)
+	case "Enum", "Enum8", "Enum16":
+		return parseEnum(definition, name, args)
+	case "Nullable":
+		elem, err := parseColumnType(args)
+		if err != nil {
+			return nil, err
+		}
+		return &columnType{kind: kindNullable, elems: []*columnType{elem}, goType: reflect.PtrTo(elem.goType)}, nil
+	case "Array":
+		elem, err := parseColumnType(args)
+		if err != nil {
+			return nil, err
+		}
+		return &columnType{kind: kindArray, elems: []*columnType{elem}, goType: reflect.SliceOf(elem.goType)}, nil
+	case "Tuple":
+		elems, err := parseColumnTypes(splitTypeArgs(args), true)
+		if err != nil {
+			return nil, err
+		}
+		return &columnType{kind: kindTuple, elems: elems, goType: reflect.TypeOf([]interface{}{})}, nil
+	case "Map":
+		elems, err := parseColumnTypes(splitTypeArgs(args), false)
+		if err != nil {
+			return nil, err
+		}
+		if len(elems) != 2 {
+			return nil, fmt.Errorf("invalid column type %q", definition)
+		}
+		return &columnType{kind: kindMap, elems: elems, goType: reflect.MapOf(elems[0].goType, elems[1].goType)}, nil
+	}
+	return nil, fmt.Errorf("column type %q is not supported by rowbinary codec", definition)
+}
+
+func parseColumnTypes(definitions []string, named bool) ([]*columnType, error) {
+	elems := make([]*columnType, 0, len(definitions))
+	for _, definition := range definitions {
+		// elements of named tuples are written as "name Type"
+		if space := strings.IndexByte(definition, ' '); named && space > 0 {
+			if parenthesis := strings.IndexByte(definition, '('); parenthesis < 0 || space < parenthesis {
+				definition = definition[space+1:]
+			}
+		}
+		elem, err := parseColumnType(definition)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+// parseDateTime64 parses precision and time zone of DateTime64, default precision is 3 as in Clickhouse
+func parseDateTime64(definition, args string) (*columnType, error) {
+	params := splitTypeArgs(args)
+	if len(params) == 0 {
+		params = []string{"3"}
+	}
+	if len(params) > 2 {
+		return nil, fmt.Errorf("invalid column type %q", definition)
+	}
+	precision, err := strconv.Atoi(params[0])
+	if err != nil || precision < 0 || precision > 9 {
+		return nil, fmt.Errorf("invalid precision of %q", definition)
+	}
+	t := &columnType{kind: kindDateTime64, size: precision, goType: reflect.TypeOf(time.Time{})}
+	if len(params) == 2 {
+		if t.location, err = time.LoadLocation(unquote(params[1])); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// parseEnum parses values of enum, e.g. Enum8('hello' = 1, 'world' = 2),
+// the size of Enum without explicit size is chosen by the range of values, as Clickhouse does
+func parseEnum(definition, name, args string) (*columnType, error) {
+	t := &columnType{
+		kind:   kindEnum8,
+		enum:   map[string]int16{},
+		names:  map[int16]string{},
+		goType: reflect.TypeOf(""),
+	}
+	for _, pair := range splitTypeArgs(args) {
+		eq := strings.LastIndexByte(pair, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid value %q of %q", pair, definition)
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(pair[eq+1:]), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q of %q", pair, definition)
+		}
+		if value < -128 || value > 127 {
+			t.kind = kindEnum16
+		}
+		key := unquote(pair[:eq])
+		t.enum[key] = int16(value)
+		t.names[int16(value)] = key
+	}
+	switch name {
+	case "Enum8":
+		if t.kind == kindEnum16 {
+			return nil, fmt.Errorf("values of %q are out of range", definition)
+		}
+	case "Enum16":
+		t.kind = kindEnum16
+	}
+	return t, nil
+}
+
+// splitTypeArgs splits arguments of a type by commas, that are not nested in parentheses or quotes
+func splitTypeArgs(args string) []string {
+	var parts []string
+	var depth int
+	var quoted, escaped bool
+	start := 0
+	for i, c := range args {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(args[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(args[start:]); last != "" {
+		parts = append(parts, last)
+	}
+	return parts
+}
+
+func unquote(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		s = strings.NewReplacer(`\'`, `'`, `\\`, `\`).Replace(s[1 : len(s)-1])
+	}
+	return s
+}
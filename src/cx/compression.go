@@ -0,0 +1,122 @@
+package cx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compression is the algorithm used to compress encoded rows in remote buffers
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	// CompressionLZ4 is fast and gives a moderate ratio, a good choice for most cases
+	CompressionLZ4
+	// CompressionZSTD gives a better ratio at the cost of CPU, a good choice for wide string-heavy rows
+	CompressionZSTD
+)
+
+// limit of the size of decompressed data, protects from corrupted or malicious length prefixes
+const maxDecompressedSize = 256 << 20
+
+var errMalformedCompressed = errors.New("malformed compressed data")
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionLZ4:
+		return "lz4"
+	case CompressionZSTD:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// nolint:gochecknoglobals // it's OK, encoder and decoder are safe for concurrent use and expensive to create
+var zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func zstdInit() error {
+	zstdCodec.once.Do(func() {
+		zstdCodec.encoder, zstdCodec.err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdCodec.err != nil {
+			return
+		}
+		zstdCodec.decoder, zstdCodec.err = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecompressedSize),
+		)
+	})
+	return zstdCodec.err
+}
+
+// compress returns the compressed data, or the data as is with CompressionNone if compression does not reduce its size
+func compress(c Compression, data []byte) ([]byte, Compression, error) {
+	var compressed []byte
+	switch c {
+	case CompressionNone:
+		return data, CompressionNone, nil
+	case CompressionLZ4:
+		// lz4 block does not store the size of the source, so it is written before the block
+		buf := make([]byte, binary.MaxVarintLen64+lz4.CompressBlockBound(len(data)))
+		n := binary.PutUvarint(buf, uint64(len(data)))
+		size, err := lz4.CompressBlock(data, buf[n:], nil)
+		if err != nil {
+			return nil, c, err
+		}
+		// zero size means the data is incompressible
+		if size == 0 {
+			return data, CompressionNone, nil
+		}
+		compressed = buf[:n+size]
+	case CompressionZSTD:
+		if err := zstdInit(); err != nil {
+			return nil, c, err
+		}
+		compressed = zstdCodec.encoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	default:
+		return nil, c, fmt.Errorf("unknown compression %s", c)
+	}
+	if len(compressed) >= len(data) {
+		return data, CompressionNone, nil
+	}
+	return compressed, c, nil
+}
+
+func decompress(c Compression, data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionLZ4:
+		size, n := binary.Uvarint(data)
+		if n <= 0 || size > maxDecompressedSize {
+			return nil, errMalformedCompressed
+		}
+		buf := make([]byte, size)
+		written, err := lz4.UncompressBlock(data[n:], buf)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(written) != size {
+			return nil, errMalformedCompressed
+		}
+		return buf, nil
+	case CompressionZSTD:
+		if err := zstdInit(); err != nil {
+			return nil, err
+		}
+		return zstdCodec.decoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("%w: unknown compression %s", errMalformedCompressed, c)
+	}
+}
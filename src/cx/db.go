@@ -8,6 +8,8 @@ import (
 type View struct {
 	Name    string
 	Columns []string
+	// Types of the columns as they are written in the CREATE TABLE query, e.g. Array(String), optional
+	Types []string
 }
 
 // NewView return View
@@ -15,6 +17,11 @@ func NewView(name string, columns []string) View {
 	return View{Name: name, Columns: columns}
 }
 
+// NewTypedView return View that knows the types of columns, such view allows to use NewRowBinaryCodec
+func NewTypedView(name string, columns, types []string) View {
+	return View{Name: name, Columns: columns, Types: types}
+}
+
 // Clickhouse base interface, which is inherited by the top-level Client API and further by all its child Writer-s
 type Clickhouse interface {
 	Insert(context.Context, View, []Vector) (uint64, error)
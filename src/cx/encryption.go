@@ -0,0 +1,193 @@
+package cx
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrUnknownKey is returned on rows encrypted with a key that the key provider does not know
+	ErrUnknownKey = errors.New("unknown encryption key")
+	// ErrEncrypted is returned on encrypted rows, if the decoder has no key provider
+	ErrEncrypted = errors.New("row is encrypted, but no key provider is set")
+
+	errMalformedEncrypted = errors.New("malformed encrypted envelope")
+)
+
+// KeyProvider supplies AES keys (16, 24 or 32 bytes for AES-128, AES-192 or AES-256) for encryption of stored rows.
+// The identifier of the key is stored with every row, so that rows encrypted with an older key
+// can be decrypted while the buffer is drained after rotation
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt new rows
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key by its identifier
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing is a KeyProvider holding keys in memory, it is safe for concurrent use
+type KeyRing struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyRing returns the key ring with the current key
+func NewKeyRing(id string, key []byte) (*KeyRing, error) {
+	k := &KeyRing{keys: map[string][]byte{}}
+	if err := k.Rotate(id, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Add adds the key that is only used to decrypt rows, e.g. the key used before the restart of the service
+func (k *KeyRing) Add(id string, key []byte) error {
+	if err := validateKey(id, key); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys[id] = key
+	k.mu.Unlock()
+	return nil
+}
+
+// Rotate makes the key current, previous keys are kept to decrypt rows written before the rotation
+func (k *KeyRing) Rotate(id string, key []byte) error {
+	if err := validateKey(id, key); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys[id] = key
+	k.current = id
+	k.mu.Unlock()
+	return nil
+}
+
+// Remove forgets the key, rows encrypted with it can no longer be decrypted
+func (k *KeyRing) Remove(id string) {
+	k.mu.Lock()
+	if id != k.current {
+		delete(k.keys, id)
+	}
+	k.mu.Unlock()
+}
+
+func (k *KeyRing) CurrentKey() (id string, key []byte, err error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *KeyRing) Key(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+}
+
+func validateKey(id string, key []byte) error {
+	if id == "" || len(id) > 255 {
+		return fmt.Errorf("key id must be from 1 to 255 bytes long, received %d", len(id))
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return nil
+	default:
+		return fmt.Errorf("key %q must be 16, 24 or 32 bytes long, received %d", id, len(key))
+	}
+}
+
+// encryptor caches AEAD instances of keys, so that the cipher is not created for every row
+type encryptor struct {
+	provider KeyProvider
+	mu       sync.RWMutex
+	aeads    map[string]cachedAEAD
+}
+
+type cachedAEAD struct {
+	key  []byte
+	aead cipher.AEAD
+}
+
+func newEncryptor(provider KeyProvider) *encryptor {
+	return &encryptor{provider: provider, aeads: map[string]cachedAEAD{}}
+}
+
+func (e *encryptor) aead(id string, key []byte) (cipher.AEAD, error) {
+	e.mu.RLock()
+	cached, ok := e.aeads[id]
+	e.mu.RUnlock()
+	if ok && bytes.Equal(cached.key, key) {
+		return cached.aead, nil
+	}
+	if err := validateKey(id, key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.aeads[id] = cachedAEAD{key: key, aead: aead}
+	e.mu.Unlock()
+	return aead, nil
+}
+
+// seal appends the key id, the nonce and the encrypted payload to the header,
+// the header and the key id are authenticated, so they cannot be changed without notice
+func (e *encryptor) seal(header, payload []byte) ([]byte, error) {
+	id, key, err := e.provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := e.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(header)+1+len(id)+aead.NonceSize()+len(payload)+aead.Overhead())
+	buf = append(append(append(buf, header...), byte(len(id))), id...)
+	aad := len(buf)
+	nonce := buf[aad : aad+aead.NonceSize()]
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	buf = buf[:aad+len(nonce)]
+	return aead.Seal(buf, nonce, payload, buf[:aad]), nil
+}
+
+// open decrypts the payload following the header
+func (e *encryptor) open(data []byte, headerSize int) ([]byte, error) {
+	if headerSize >= len(data) {
+		return nil, errMalformedEncrypted
+	}
+	size := int(data[headerSize])
+	aad := headerSize + 1 + size
+	if aad > len(data) {
+		return nil, errMalformedEncrypted
+	}
+	id := string(data[headerSize+1 : aad])
+	key, err := e.provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := e.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	if aad+aead.NonceSize() > len(data) {
+		return nil, errMalformedEncrypted
+	}
+	nonce := data[aad : aad+aead.NonceSize()]
+	return aead.Open(nil, nonce, data[aad+aead.NonceSize():], data[:aad])
+}
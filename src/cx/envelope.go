@@ -0,0 +1,357 @@
+package cx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	// envelopeMagic starts every enveloped row, gob streams never start with this byte,
+	// so rows written before the envelope was introduced can be told apart
+	envelopeMagic byte = 0xCB
+	// EnvelopeVersion is the latest version of the envelope format. Version 1 had no flags,
+	// version 2 added compression and blocks, version 3 added encryption. Unencrypted rows are still written
+	// in version 2, so that they can be read by previous releases during a rolling deploy
+	EnvelopeVersion      byte = 3
+	envelopeVersionPlain byte = 2
+	// magic, version, codec id and fingerprint
+	envelopeHeaderSizeV1 = 7
+	// magic, version, codec id, flags and fingerprint
+	envelopeHeaderSize = 8
+	// the lower bits of flags hold the compression, the highest bits mark a block of rows and an encrypted payload
+	compressionMask byte = 0x0F
+	flagBlock       byte = 0x80
+	flagEncrypted   byte = 0x40
+)
+
+var (
+	// ErrUnsupportedEnvelope is returned on rows written in a newer format than the decoder understands
+	ErrUnsupportedEnvelope = errors.New("unsupported envelope version")
+	// ErrUnknownCodec is returned on rows encoded with a codec that is not registered
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrSchemaMismatch is returned on rows written for another set of columns, for which no migration is registered
+	ErrSchemaMismatch = errors.New("schema mismatch")
+
+	errUnexpectedBlock = errors.New("envelope holds a block of rows, use DecodeBlock")
+)
+
+// Fingerprint returns the hash of the columns and their types, it changes whenever the order,
+// the names or the types of the columns are changed
+func (v View) Fingerprint() uint32 {
+	h := fnv.New32a()
+	for i, column := range v.Columns {
+		_, _ = h.Write([]byte(column))
+		_, _ = h.Write([]byte{0})
+		if i < len(v.Types) {
+			_, _ = h.Write([]byte(v.Types[i]))
+		}
+		_, _ = h.Write([]byte{0})
+	}
+	return h.Sum32()
+}
+
+// Migration converts a row written for a previous version of the view to the current one
+type Migration func(Vector) (Vector, error)
+
+type migration struct {
+	view    View
+	codec   Codec
+	migrate Migration
+}
+
+type EnvelopeOption func(e *EnvelopeCodec)
+
+// WithMigration allows to decode rows written for the previous version of the view,
+// e.g. by instances of the service that were not updated yet
+func WithMigration(previous View, migrate Migration) EnvelopeOption {
+	return func(e *EnvelopeCodec) {
+		m := migration{view: previous, migrate: migrate}
+		if len(previous.Types) > 0 {
+			m.codec, _ = NewRowBinaryCodec(previous)
+		}
+		e.migrations[previous.Fingerprint()] = m
+	}
+}
+
+// WithCompression compresses the payload of envelopes, payloads that do not become smaller are stored as is
+func WithCompression(compression Compression) EnvelopeOption {
+	return func(e *EnvelopeCodec) {
+		e.compression = compression
+	}
+}
+
+// WithEncryption encrypts the payload of envelopes with AES-GCM, the identifier of the key is stored in the envelope,
+// so that rows encrypted with older keys of the provider can still be decrypted
+func WithEncryption(provider KeyProvider) EnvelopeOption {
+	return func(e *EnvelopeCodec) {
+		e.encryptor = newEncryptor(provider)
+	}
+}
+
+// EnvelopeOptions returns options of the envelope for stored rows, encryption is enabled only with the key provider
+func EnvelopeOptions(compression Compression, keys KeyProvider) []EnvelopeOption {
+	opts := []EnvelopeOption{WithCompression(compression)}
+	if keys != nil {
+		opts = append(opts, WithEncryption(keys))
+	}
+	return opts
+}
+
+// EnvelopeCodec wraps every encoded row in an envelope, that records the format version,
+// the identifier of the codec, the compression and the fingerprint of the view:
+//
+//	[0xCB][version][codec id][flags][fingerprint, 4 bytes][payload]
+//
+// The payload of encrypted envelopes is preceded by the key id, and the nonce and the header are authenticated:
+//
+//	[0xCB][version][codec id][flags][fingerprint, 4 bytes][key id length][key id][nonce][encrypted payload]
+//
+// The envelope can also hold a block of rows (see EncodeBlock), that are compressed together.
+// On decode rows encoded with other registered codecs are decoded with them, rows written for another view
+// are migrated or rejected with ErrSchemaMismatch. Rows without envelope (written by previous versions of the package)
+// are decoded with the wrapped codec as is, so a mixed-version fleet can drain a shared buffer
+type EnvelopeCodec struct {
+	codec       Codec
+	view        View
+	fingerprint uint32
+	compression Compression
+	encryptor   *encryptor
+	migrations  map[uint32]migration
+	// RowBinary codecs of views by their fingerprints, for rows encoded with it by other instances
+	rowBinary sync.Map
+}
+
+// NewEnvelopeCodec returns the envelope around the codec, the view may be empty, then the schema is not checked
+func NewEnvelopeCodec(codec Codec, view View, opts ...EnvelopeOption) *EnvelopeCodec {
+	e := &EnvelopeCodec{
+		codec:      codec,
+		view:       view,
+		migrations: map[uint32]migration{},
+	}
+	if len(view.Columns) > 0 {
+		e.fingerprint = view.Fingerprint()
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// Enveloped wraps the codec in the envelope for the view, unless it is already wrapped,
+// in that case the options are ignored
+func Enveloped(codec Codec, view View, opts ...EnvelopeOption) *EnvelopeCodec {
+	if e, ok := codec.(*EnvelopeCodec); ok {
+		return e
+	}
+	return NewEnvelopeCodec(codec, view, opts...)
+}
+
+// ID returns the identifier of the wrapped codec
+func (e *EnvelopeCodec) ID() uint8 {
+	return e.codec.ID()
+}
+
+// Name returns the name of the wrapped codec
+func (e *EnvelopeCodec) Name() string {
+	return e.codec.Name()
+}
+
+func (e *EnvelopeCodec) Encode(v Vector) ([]byte, error) {
+	payload, err := e.codec.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return e.seal(payload, 0)
+}
+
+// EncodeBlock encodes several rows into one envelope, they are compressed together,
+// which gives a much better ratio on small rows than compression of every row
+func (e *EnvelopeCodec) EncodeBlock(rows []Vector) ([]byte, error) {
+	payload := appendUvarint(make([]byte, 0, 64*len(rows)), uint64(len(rows)))
+	for _, row := range rows {
+		encoded, err := e.codec.Encode(row)
+		if err != nil {
+			return nil, err
+		}
+		payload = appendBytes(payload, encoded)
+	}
+	return e.seal(payload, flagBlock)
+}
+
+func (e *EnvelopeCodec) seal(payload []byte, flags byte) ([]byte, error) {
+	compressed, compression, err := compress(e.compression, payload)
+	if err != nil {
+		return nil, err
+	}
+	version := envelopeVersionPlain
+	if e.encryptor != nil {
+		version, flags = EnvelopeVersion, flags|flagEncrypted
+	}
+	header := make([]byte, envelopeHeaderSize, envelopeHeaderSize+len(compressed))
+	header[0], header[1], header[2], header[3] = envelopeMagic, version, e.codec.ID(), flags|byte(compression)
+	binary.BigEndian.PutUint32(header[4:], e.fingerprint)
+	if e.encryptor != nil {
+		return e.encryptor.seal(header, compressed)
+	}
+	return append(header, compressed...), nil
+}
+
+func (e *EnvelopeCodec) Decode(data []byte) (Vector, error) {
+	if len(data) == 0 || data[0] != envelopeMagic {
+		return e.decodeLegacy(data)
+	}
+	header, payload, err := e.open(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.flags&flagBlock != 0 {
+		return nil, errUnexpectedBlock
+	}
+	return e.decodePayload(header.codecID, header.fingerprint, payload)
+}
+
+// DecodeBlock decodes envelopes written by both Encode and EncodeBlock
+func (e *EnvelopeCodec) DecodeBlock(data []byte) ([]Vector, error) {
+	if len(data) == 0 || data[0] != envelopeMagic {
+		v, err := e.decodeLegacy(data)
+		if err != nil {
+			return nil, err
+		}
+		return []Vector{v}, nil
+	}
+	header, payload, err := e.open(data)
+	if err != nil {
+		return nil, err
+	}
+	if header.flags&flagBlock == 0 {
+		v, decodeErr := e.decodePayload(header.codecID, header.fingerprint, payload)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		return []Vector{v}, nil
+	}
+	r := bytes.NewReader(payload)
+	count, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]Vector, 0, count)
+	for i := 0; i < count; i++ {
+		encoded, readErr := readBytes(r)
+		if readErr != nil {
+			return nil, readErr
+		}
+		v, decodeErr := e.decodePayload(header.codecID, header.fingerprint, encoded)
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		rows = append(rows, v)
+	}
+	return rows, nil
+}
+
+type envelopeHeader struct {
+	codecID     uint8
+	flags       byte
+	fingerprint uint32
+}
+
+// open parses the header of any supported version and returns the decrypted and decompressed payload
+func (e *EnvelopeCodec) open(data []byte) (envelopeHeader, []byte, error) {
+	var header envelopeHeader
+	var payload []byte
+	switch {
+	case len(data) >= envelopeHeaderSizeV1 && data[1] == 1:
+		header.codecID, header.fingerprint = data[2], binary.BigEndian.Uint32(data[3:])
+		payload = data[envelopeHeaderSizeV1:]
+	case len(data) >= envelopeHeaderSize && (data[1] == envelopeVersionPlain || data[1] == EnvelopeVersion):
+		header.codecID, header.flags, header.fingerprint = data[2], data[3], binary.BigEndian.Uint32(data[4:])
+		payload = data[envelopeHeaderSize:]
+	case len(data) < envelopeHeaderSizeV1:
+		return header, nil, fmt.Errorf("%w: truncated header", ErrUnsupportedEnvelope)
+	default:
+		return header, nil, fmt.Errorf("%w: %d", ErrUnsupportedEnvelope, data[1])
+	}
+	if header.flags&flagEncrypted != 0 {
+		if e.encryptor == nil {
+			return header, nil, ErrEncrypted
+		}
+		var err error
+		if payload, err = e.encryptor.open(data, envelopeHeaderSize); err != nil {
+			return header, nil, err
+		}
+	}
+	payload, err := decompress(Compression(header.flags&compressionMask), payload)
+	return header, payload, err
+}
+
+// decodeLegacy decodes a row written without envelope, only the number of columns can be checked
+func (e *EnvelopeCodec) decodeLegacy(data []byte) (Vector, error) {
+	v, err := e.codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return v, e.checkColumns(v)
+}
+
+func (e *EnvelopeCodec) decodePayload(codecID uint8, fingerprint uint32, payload []byte) (Vector, error) {
+	// rows of unknown schema are accepted as is, as well as all rows if the view is unknown
+	if fingerprint == e.fingerprint || fingerprint == 0 || e.fingerprint == 0 {
+		codec, err := e.codecFor(codecID, e.codec, e.view, e.fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		v, err := codec.Decode(payload)
+		if err != nil {
+			return nil, err
+		}
+		return v, e.checkColumns(v)
+	}
+	m, ok := e.migrations[fingerprint]
+	if !ok {
+		return nil, fmt.Errorf("%w: fingerprint %08x, expected %08x", ErrSchemaMismatch, fingerprint, e.fingerprint)
+	}
+	codec, err := e.codecFor(codecID, m.codec, m.view, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	v, err := codec.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return m.migrate(v)
+}
+
+func (e *EnvelopeCodec) checkColumns(v Vector) error {
+	if e.fingerprint != 0 && len(v) != len(e.view.Columns) {
+		return fmt.Errorf("%w: expected %d columns, received %d", ErrSchemaMismatch, len(e.view.Columns), len(v))
+	}
+	return nil
+}
+
+// codecFor returns the codec the payload was encoded with,
+// the schema-aware codec is created for the view once, as it cannot be taken from the registry
+func (e *EnvelopeCodec) codecFor(codecID uint8, own Codec, view View, fingerprint uint32) (Codec, error) {
+	if own != nil && codecID == own.ID() {
+		return own, nil
+	}
+	if codecID == RowBinaryCodecID {
+		if codec, ok := e.rowBinary.Load(fingerprint); ok {
+			return codec.(Codec), nil
+		}
+		codec, err := NewRowBinaryCodec(view)
+		if err != nil {
+			return nil, err
+		}
+		e.rowBinary.Store(fingerprint, codec)
+		return codec, nil
+	}
+	if codec, ok := CodecByID(codecID); ok {
+		return codec, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownCodec, codecID)
+}
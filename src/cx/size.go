@@ -0,0 +1,153 @@
+package cx
+
+import (
+	"reflect"
+	"time"
+	"unsafe"
+
+	"github.com/google/uuid"
+)
+
+// sizes of the header of a slice, a string and an interface value
+const (
+	sliceHeaderSize  = int(unsafe.Sizeof([]byte(nil)))
+	stringHeaderSize = int(unsafe.Sizeof(""))
+	interfaceSize    = int(unsafe.Sizeof(interface{}(nil)))
+)
+
+// EstimateSize returns the approximate size of the row in memory, it is used to limit memory of buffers.
+// It does not encode the row, so it is cheap enough to be called for every written row.
+// See EncodedSize for the size of the row sent to Clickhouse
+func EstimateSize(row Vector) int {
+	size := sliceHeaderSize
+	for _, value := range row {
+		size += interfaceSize + valueSize(value)
+	}
+	return size
+}
+
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, int64, uint, uint64, float64:
+		return 8
+	case string:
+		return stringHeaderSize + len(v)
+	case []byte:
+		return sliceHeaderSize + len(v)
+	case time.Time:
+		return int(unsafe.Sizeof(v))
+	case Vector:
+		return EstimateSize(v)
+	case []interface{}:
+		return EstimateSize(v)
+	case []string:
+		size := sliceHeaderSize
+		for _, s := range v {
+			size += stringHeaderSize + len(s)
+		}
+		return size
+	default:
+		// other types are counted as a pointer to a small value
+		return 16
+	}
+}
+
+// EncodedSize returns the approximate size of the row sent to Clickhouse, it follows the RowBinary format:
+// numbers take their width, strings and slices are prefixed with the length, nil values and pointers
+// take a byte of the Nullable marker. Dates are counted as DateTime64, so the estimate is not less than the real size.
+// It does not encode the row, so it is cheap enough to be called for every written row
+func EncodedSize(row Vector) int {
+	size := 0
+	for _, value := range row {
+		size += encodedValueSize(value)
+	}
+	return size
+}
+
+// nolint:gocyclo,cyclop // switch over all supported types
+func encodedValueSize(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return 1
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, int64, uint, uint64, float64:
+		return 8
+	case string:
+		return uvarintSize(len(v)) + len(v)
+	case []byte:
+		return uvarintSize(len(v)) + len(v)
+	case time.Time:
+		return 8
+	case uuid.UUID:
+		return len(v)
+	case Vector:
+		return uvarintSize(len(v)) + EncodedSize(v)
+	case []interface{}:
+		return uvarintSize(len(v)) + EncodedSize(v)
+	case []string:
+		size := uvarintSize(len(v))
+		for _, s := range v {
+			size += uvarintSize(len(s)) + len(s)
+		}
+		return size
+	}
+	return encodedTypedSize(reflect.ValueOf(value))
+}
+
+// encodedTypedSize estimates values of other types with reflection, e.g. typed slices, maps and pointers
+func encodedTypedSize(rv reflect.Value) int {
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return 1
+		}
+		return 1 + encodedValueSize(rv.Elem().Interface())
+	case reflect.Slice, reflect.Array:
+		size := uvarintSize(rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			size += encodedValueSize(rv.Index(i).Interface())
+		}
+		return size
+	case reflect.Map:
+		size := uvarintSize(rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			size += encodedValueSize(iter.Key().Interface()) + encodedValueSize(iter.Value().Interface())
+		}
+		return size
+	case reflect.String:
+		return uvarintSize(rv.Len()) + rv.Len()
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1
+	case reflect.Int16, reflect.Uint16:
+		return 2
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4
+	default:
+		// 64-bit numbers and unknown types, e.g. decimals
+		return 8
+	}
+}
+
+// uvarintSize returns the size of the length prefix of strings and arrays
+func uvarintSize(length int) int {
+	size := 1
+	for length >= 0x80 {
+		length >>= 7
+		size++
+	}
+	return size
+}
@@ -1,10 +1,15 @@
 package cx
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
+	"os"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/google/uuid"
 )
 
 const defaultInsertDurationTimeout = time.Millisecond * 15000
@@ -53,6 +58,40 @@ func IsResendAvailable(err error) bool {
 	return true
 }
 
+// ExceptionCode returns the code of the Clickhouse exception, or zero if the error is not an exception
+func ExceptionCode(err error) int32 {
+	var e *clickhouse.Exception
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return 0
+}
+
+// nolint:gochecknoglobals // it's OK, readonly variable
+// errors meaning that Clickhouse cannot keep up with the size of inserts
+var overloadErrors = map[int32]struct{}{
+	159: {}, // TIMEOUT_EXCEEDED
+	160: {}, // TOO_SLOW
+	202: {}, // TOO_MANY_SIMULTANEOUS_QUERIES
+	209: {}, // SOCKET_TIMEOUT
+	241: {}, // MEMORY_LIMIT_EXCEEDED
+}
+
+// IsOverload checks whether the error means that Clickhouse is overloaded with inserts:
+// limits of memory or time are exceeded, or the insert timed out
+func IsOverload(err error) bool {
+	var e *clickhouse.Exception
+	if errors.As(err, &e) {
+		_, ok := overloadErrors[e.Code]
+		return ok
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 type RuntimeOptions struct {
 	WriteTimeout time.Duration
 }
@@ -63,3 +102,14 @@ func (r *RuntimeOptions) GetWriteTimeout() time.Duration {
 	}
 	return getDefaultInsertDurationTimeout()
 }
+
+// ConsumerName returns the default name of the consumer of buffers shared by several instances,
+// it is unique for every call: the hostname, the process id and a random suffix,
+// so that buffers of the same process or of hosts with the same name never share pending rows
+func ConsumerName() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.NewString())
+}
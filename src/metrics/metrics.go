@@ -0,0 +1,75 @@
+package metrics
+
+// Names of metrics of writers and the retry worker, all of them except RetryQueueDepth have the label of the view
+const (
+	// RowsReceived counts rows written to the buffer of the Writer
+	RowsReceived = "clickhouse_buffer_rows_received_total"
+	// RowsFlushed counts rows sent to insert
+	RowsFlushed = "clickhouse_buffer_rows_flushed_total"
+	// Batches counts batches sent to insert
+	Batches = "clickhouse_buffer_batches_total"
+	// InsertDuration observes durations of inserts and retry cycles in seconds
+	InsertDuration = "clickhouse_buffer_insert_duration_seconds"
+	// BufferLength is the number of rows waiting to be flushed
+	BufferLength = "clickhouse_buffer_buffer_length"
+	// Errors counts failed inserts, it has the label of the Clickhouse exception code, zero for other errors
+	Errors = "clickhouse_buffer_errors_total"
+	// Retries counts batches queued for retry
+	Retries = "clickhouse_buffer_retries_total"
+	// Drops counts rows given up by the retry worker or dropped by the backpressure policy
+	Drops = "clickhouse_buffer_drops_total"
+	// RetryQueueDepth is the number of packets waiting in the retry queue
+	RetryQueueDepth = "clickhouse_buffer_retry_queue_depth"
+)
+
+// Names of metrics of the failover buffer, they have no labels
+const (
+	// Failovers counts switches to the secondary engine
+	Failovers = "clickhouse_buffer_failovers_total"
+	// Recoveries counts switches back to the primary engine
+	Recoveries = "clickhouse_buffer_recoveries_total"
+	// SecondaryWrites counts rows written to the secondary engine
+	SecondaryWrites = "clickhouse_buffer_secondary_writes_total"
+	// Degraded is one while rows are written to the secondary engine
+	Degraded = "clickhouse_buffer_degraded"
+)
+
+// Names of labels
+const (
+	LabelView = "view"
+	LabelCode = "code"
+)
+
+// Label is the name and the value of the label
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Collector receives metrics, it is called synchronously by writers and must not block.
+// Labels must not be modified, they may be reused between calls
+type Collector interface {
+	// Add increases the counter
+	Add(name string, value float64, labels ...Label)
+	// Set sets the value of the gauge
+	Set(name string, value float64, labels ...Label)
+	// Observe adds the value to the histogram
+	Observe(name string, value float64, labels ...Label)
+}
+
+// nolint:gochecknoglobals // it's OK, readonly variable
+var help = map[string]string{
+	RowsReceived:    "Rows written to the buffer of the writer.",
+	RowsFlushed:     "Rows sent to insert.",
+	Batches:         "Batches sent to insert.",
+	InsertDuration:  "Duration of inserts and retry cycles in seconds.",
+	BufferLength:    "Rows waiting to be flushed.",
+	Errors:          "Failed inserts by code of the Clickhouse exception.",
+	Retries:         "Batches queued for retry.",
+	Drops:           "Rows given up by the retry worker or dropped by the backpressure policy.",
+	RetryQueueDepth: "Packets waiting in the retry queue.",
+	Failovers:       "Switches of the failover buffer to the secondary engine.",
+	Recoveries:      "Switches of the failover buffer back to the primary engine.",
+	SecondaryWrites: "Rows written to the secondary engine of the failover buffer.",
+	Degraded:        "One while the failover buffer writes to the secondary engine.",
+}
@@ -0,0 +1,222 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are upper bounds of histograms in seconds
+// nolint:gochecknoglobals // it's OK, readonly variable
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry is the Collector keeping metrics in memory, it serves them over HTTP in the Prometheus text format,
+// so it can be mounted on a server without the Prometheus client library.
+// Every metric keeps the type of its first call, samples of another type are dropped and the conflict is logged once
+type Registry struct {
+	mu       sync.Mutex
+	buckets  []float64
+	families map[string]*family
+	// conflicts holds metrics already logged as used with another type
+	conflicts map[string]bool
+}
+
+type family struct {
+	kind   string
+	series map[string]*series
+}
+
+type series struct {
+	labels []Label
+	value  float64
+	// cumulative counts are computed on write
+	counts []uint64
+	count  uint64
+}
+
+// NewRegistry creates the Registry, histograms use the buckets or DefaultBuckets
+func NewRegistry(buckets ...float64) *Registry {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &Registry{buckets: buckets, families: map[string]*family{}, conflicts: map[string]bool{}}
+}
+
+func (r *Registry) Add(name string, value float64, labels ...Label) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.series(name, typeCounter, labels); s != nil {
+		s.value += value
+	}
+}
+
+func (r *Registry) Set(name string, value float64, labels ...Label) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s := r.series(name, typeGauge, labels); s != nil {
+		s.value = value
+	}
+}
+
+func (r *Registry) Observe(name string, value float64, labels ...Label) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.series(name, typeHistogram, labels)
+	if s == nil {
+		return
+	}
+	if s.counts == nil {
+		s.counts = make([]uint64, len(r.buckets))
+	}
+	// the value is counted in its bucket only
+	if i := sort.SearchFloat64s(r.buckets, value); i < len(r.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.value += value
+}
+
+// Value returns the value of the counter or the gauge, or the sum of the histogram
+func (r *Registry) Value(name string, labels ...Label) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		if s, ok := f.series[key(labels)]; ok {
+			return s.value
+		}
+	}
+	return 0
+}
+
+// series returns the series of the family, the type of the family is set by the first call.
+// Using the metric as another type would write invalid exposition, so nil is returned and the sample is dropped,
+// metrics are written from goroutines of the library, where a panic would crash the process
+func (r *Registry) series(name, kind string, labels []Label) *series {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{kind: kind, series: map[string]*series{}}
+		r.families[name] = f
+	}
+	if f.kind != kind {
+		if conflict := name + " " + kind; !r.conflicts[conflict] {
+			r.conflicts[conflict] = true
+			log.Printf("metrics: %s is registered as %s, samples of %s are dropped\n", name, f.kind, kind)
+		}
+		return nil
+	}
+	k := key(labels)
+	s, ok := f.series[k]
+	if !ok {
+		s = &series{labels: append([]Label{}, labels...)}
+		f.series[k] = s
+	}
+	return s
+}
+
+func key(labels []Label) string {
+	var b strings.Builder
+	for _, label := range labels {
+		b.WriteString(label.Name)
+		b.WriteByte(0)
+		b.WriteString(label.Value)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// ServeHTTP writes metrics in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WritePrometheus(w)
+}
+
+// WritePrometheus writes metrics in the Prometheus text format, families and series are sorted
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := bufio.NewWriter(w)
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := r.families[name]
+		if text, ok := help[name]; ok {
+			out.WriteString("# HELP " + name + " " + text + "\n")
+		}
+		out.WriteString("# TYPE " + name + " " + f.kind + "\n")
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			r.writeSeries(out, name, f.kind, f.series[k])
+		}
+	}
+	return out.Flush()
+}
+
+func (r *Registry) writeSeries(out *bufio.Writer, name, kind string, s *series) {
+	if kind != typeHistogram {
+		writeSample(out, name, s.labels, s.value)
+		return
+	}
+	var cumulative uint64
+	for i, bound := range r.buckets {
+		cumulative += s.counts[i]
+		writeSample(out, name+"_bucket", append(s.labels[:len(s.labels):len(s.labels)], Label{"le", formatFloat(bound)}), float64(cumulative))
+	}
+	writeSample(out, name+"_bucket", append(s.labels[:len(s.labels):len(s.labels)], Label{"le", "+Inf"}), float64(s.count))
+	writeSample(out, name+"_sum", s.labels, s.value)
+	writeSample(out, name+"_count", s.labels, float64(s.count))
+}
+
+func writeSample(out *bufio.Writer, name string, labels []Label, value float64) {
+	out.WriteString(name)
+	if len(labels) > 0 {
+		out.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteString(label.Name + `="` + escape(label.Value) + `"`)
+		}
+		out.WriteByte('}')
+	}
+	out.WriteString(" " + formatFloat(value) + "\n")
+}
+
+// nolint:gochecknoglobals // it's OK, readonly variable
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(value string) string {
+	return escaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -2,6 +2,9 @@ package retry
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Rican7/retry"
@@ -19,6 +22,7 @@ const (
 const (
 	defaultAttemptLimit = 3
 	defaultFactor       = 100 * time.Millisecond
+	drainPollInterval   = 10 * time.Millisecond
 )
 
 const (
@@ -38,6 +42,47 @@ const (
 	packetResend    = "(DEBUG): packet will be sent for resend, cycles left %d"
 )
 
+// ErrQueueIsFull completes batches that could not be queued for retry
+var ErrQueueIsFull = errors.New("queue for repeating messages is full")
+
+// ErrRetryStopped completes batches that were sent for retry after the worker has been stopped
+var ErrRetryStopped = errors.New("retry worker is stopped")
+
+// LostError completes batches that could not be written within all retry cycles
+type LostError struct {
+	// Attempts is the number of inserts, including the first one made before the retry
+	Attempts int
+	Err      error
+}
+
+func (e *LostError) Error() string {
+	return fmt.Sprintf("packet is lost after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *LostError) Unwrap() error {
+	return e.Err
+}
+
+// Observer is notified about results of retry cycles, it is called by the worker and must not block
+type Observer interface {
+	// OnSuccess is called when the packet is written
+	OnSuccess(view cx.View, batch *cx.Batch, latency time.Duration)
+	// OnRequeue is called when the packet is queued for the next retry cycle
+	OnRequeue(view cx.View, batch *cx.Batch, latency time.Duration, err error)
+	// OnLost is called when the packet is given up: all retry cycles failed, or it could not be queued
+	OnLost(view cx.View, batch *cx.Batch, latency time.Duration, err error)
+}
+
+// Option configures the retry client
+type Option func(r *retryImpl)
+
+// WithObserver sets the Observer of retry cycles
+func WithObserver(observer Observer) Option {
+	return func(r *retryImpl) {
+		r.observer = observer
+	}
+}
+
 type Retryable interface {
 	Retry(packet *Packet)
 	Metrics() (uint64, uint64, uint64)
@@ -48,6 +93,11 @@ type Queueable interface {
 	Retries() <-chan *Packet
 }
 
+// Drainable is implemented by retry clients that can finish handling of queued packets on shutdown
+type Drainable interface {
+	Drain(ctx context.Context) error
+}
+
 type Closable interface {
 	Close() error
 	CloseMessage() string
@@ -57,6 +107,7 @@ type Packet struct {
 	view     cx.View
 	batch    *cx.Batch
 	tryCount uint8
+	attempts int
 }
 
 func NewPacket(view cx.View, batch *cx.Batch) *Packet {
@@ -75,9 +126,18 @@ type retryImpl struct {
 	successfully Countable
 	failed       Countable
 	progress     Countable
+	active       Countable
+	observer     Observer
+	mu           sync.RWMutex
+	stopped      bool
+	// cancels the context of the worker, the insert of the packet being handled is interrupted
+	stop     context.CancelFunc
+	stopOnce sync.Once
+	// closed when the worker has stopped
+	exited chan struct{}
 }
 
-func NewRetry(ctx context.Context, engine Queueable, writer Writeable, logger cx.Logger, isDebug bool) Retryable {
+func NewRetry(ctx context.Context, engine Queueable, writer Writeable, logger cx.Logger, isDebug bool, opts ...Option) Retryable {
 	r := &retryImpl{
 		engine:       engine,
 		writer:       writer,
@@ -88,7 +148,13 @@ func NewRetry(ctx context.Context, engine Queueable, writer Writeable, logger cx
 		successfully: newUint64Counter(),
 		failed:       newUint64Counter(),
 		progress:     newUint64Counter(),
+		active:       newUint64Counter(),
+		exited:       make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	ctx, r.stop = context.WithCancel(ctx)
 	go r.backoffRetry(ctx)
 	return r
 }
@@ -98,18 +164,68 @@ func (r *retryImpl) Metrics() (successfully, failed, progress uint64) {
 }
 
 func (r *retryImpl) Retry(packet *Packet) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.stopped {
+		r.lose(packet, 0, ErrRetryStopped)
+		return
+	}
 	if value := r.progress.Inc(); value >= defaultRetryChanSize {
+		r.progress.Dec()
 		r.logger.Log(queueIsFull)
+		r.lose(packet, 0, ErrQueueIsFull)
 		return
 	}
 	r.engine.Queue(packet)
 }
 
+// Drain waits until queued packets are handled and stops the worker, the closable queue engine is closed then.
+// If the context is done earlier, the worker is stopped anyway: the insert of the packet being handled is interrupted,
+// and Drain waits for the worker to exit, so that the connection can be closed. Packets left unhandled stay
+// in the queue engine, except for the in-memory engine, whose packets are completed with ErrRetryStopped.
+// Drain returns at once if the worker has already stopped
+func (r *retryImpl) Drain(ctx context.Context) error {
+	err := r.wait(ctx)
+	r.stopOnce.Do(func() {
+		// later packets are rejected right away, not after the worker has finished the current one
+		r.mu.Lock()
+		r.stopped = true
+		r.mu.Unlock()
+		r.stop()
+	})
+	<-r.exited
+	return err
+}
+
+// wait waits until queued and active packets are handled, or the worker has stopped
+func (r *retryImpl) wait(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for r.progress.Val() > 0 || r.active.Val() > 0 {
+		select {
+		case <-ticker.C:
+		case <-r.exited:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 func (r *retryImpl) backoffRetry(ctx context.Context) {
 	if r.isDebug {
 		r.logger.Log(runListenerMsg)
 	}
+	retries := r.engine.Retries()
 	defer func() {
+		// packets are not queued into the closed engine
+		r.mu.Lock()
+		r.stopped = true
+		r.mu.Unlock()
+		if _, ok := r.engine.(*imMemoryQueueEngine); ok {
+			r.reject(retries)
+		}
 		if closable, ok := r.engine.(Closable); ok {
 			r.logger.Log(closable.CloseMessage())
 			if err := closable.Close(); err != nil {
@@ -119,8 +235,8 @@ func (r *retryImpl) backoffRetry(ctx context.Context) {
 		if r.isDebug {
 			r.logger.Log(stopListenerMsg)
 		}
+		close(r.exited)
 	}()
-	retries := r.engine.Retries()
 	for {
 		select {
 		case <-ctx.Done():
@@ -131,9 +247,10 @@ func (r *retryImpl) backoffRetry(ctx context.Context) {
 	}
 }
 
-func (r *retryImpl) action(ctx context.Context, view cx.View, btc *cx.Batch) retry.Action {
+func (r *retryImpl) action(ctx context.Context, packet *Packet) retry.Action {
 	return func(attempt uint) error {
-		affected, err := r.writer.Write(ctx, view, btc)
+		packet.attempts++
+		affected, err := r.writer.Write(ctx, packet.view, packet.batch)
 		if err != nil {
 			if r.isDebug {
 				r.logger.Logf("%s: %s", attemptError, err.Error())
@@ -150,12 +267,16 @@ func (r *retryImpl) action(ctx context.Context, view cx.View, btc *cx.Batch) ret
 // if error is not in list of not allowed,
 // and the number of repetition cycles has not been exhausted,
 // try to re-send it to the processing queue
-func (r *retryImpl) resend(packet *Packet, err error) bool {
+func (r *retryImpl) resend(packet *Packet, latency time.Duration, err error) bool {
 	if (packet.tryCount < defaultCycloCount) && cx.IsResendAvailable(err) {
+		if r.observer != nil {
+			r.observer.OnRequeue(packet.view, packet.batch, latency, err)
+		}
 		r.Retry(&Packet{
 			view:     packet.view,
 			batch:    packet.batch,
 			tryCount: packet.tryCount + 1,
+			attempts: packet.attempts,
 		})
 		if r.isDebug {
 			r.logger.Logf(packetResend, defaultCycloCount-packet.tryCount-1)
@@ -165,21 +286,79 @@ func (r *retryImpl) resend(packet *Packet, err error) bool {
 	return false
 }
 
+// keep leaves the packet, that was not handled because the worker is stopping, in the queue engine.
+// Packets of the in-memory engine would be lost with it, so they are completed with ErrRetryStopped
+func (r *retryImpl) keep(packet *Packet) {
+	if _, ok := r.engine.(*imMemoryQueueEngine); ok {
+		r.lose(packet, 0, ErrRetryStopped)
+		return
+	}
+	r.progress.Inc()
+	r.engine.Queue(packet)
+}
+
+// reject completes batches of packets left in the in-memory queue after the worker has stopped
+func (r *retryImpl) reject(retries <-chan *Packet) {
+	for {
+		select {
+		case packet, ok := <-retries:
+			if !ok {
+				return
+			}
+			r.progress.Dec()
+			r.lose(packet, 0, ErrRetryStopped)
+		default:
+			return
+		}
+	}
+}
+
+// lose completes the batch of the packet that is given up
+func (r *retryImpl) lose(packet *Packet, latency time.Duration, err error) {
+	if r.observer != nil {
+		r.observer.OnLost(packet.view, packet.batch, latency, err)
+	}
+	packet.batch.Done(err)
+}
+
 func (r *retryImpl) handlePacket(ctx context.Context, packet *Packet) {
+	// the packet is counted as active before it leaves the queue, so Drain does not miss it
+	r.active.Inc()
+	defer r.active.Dec()
 	r.progress.Dec()
+	// the packet may be received together with the stop of the worker
+	if ctx.Err() != nil {
+		r.keep(packet)
+		return
+	}
 	if r.isDebug {
 		r.logger.Log(handleRetryMsg)
 	}
-	if err := retry.Retry(r.action(ctx, packet.view, packet.batch), r.limit, r.backoff); err != nil {
+	start := time.Now()
+	// attempts are not repeated after the stop of the worker
+	stopped := func(attempt uint) bool {
+		return attempt == 0 || ctx.Err() == nil
+	}
+	if err := retry.Retry(r.action(ctx, packet), stopped, r.limit, r.backoff); err != nil {
+		if ctx.Err() != nil {
+			r.keep(packet)
+			return
+		}
 		r.logger.Logf("%s: %v", limitOfRetries, err)
-		if !r.resend(packet, err) {
+		if !r.resend(packet, time.Since(start), err) {
 			// otherwise, increase failed counter and report in logs that the package is always lost
 			r.failed.Inc()
 			r.logger.Logf(packetIsLost, defaultCycloCount)
+			// the first insert was made before the retry
+			r.lose(packet, time.Since(start), &LostError{Attempts: packet.attempts + 1, Err: err})
 		}
 	} else {
 		// mark packet as successfully processed
 		r.successfully.Inc()
+		if r.observer != nil {
+			r.observer.OnSuccess(packet.view, packet.batch, time.Since(start))
+		}
+		packet.batch.Done(nil)
 		if r.isDebug {
 			r.logger.Log(successfully)
 		}
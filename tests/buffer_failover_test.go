@@ -0,0 +1,199 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxfailover"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxfile"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxredis"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+	"github.com/zikwall/clickhouse-buffer/v4/src/metrics"
+)
+
+type loggerMock struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *loggerMock) Log(message interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprint(message))
+}
+
+func (l *loggerMock) Logf(format string, v ...interface{}) {
+	l.Log(fmt.Sprintf(format, v...))
+}
+
+func (l *loggerMock) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.messages)
+}
+
+func useFailover(t *testing.T, opts ...cxfailover.Option) (*miniredis.Miniredis, *redis.Client, cxfailover.Buffer) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	t.Cleanup(func() {
+		_ = rdb.Close()
+	})
+	primary, err := cxredis.NewBufferV2(context.Background(), rdb, "bucket", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, rdb, cxfailover.NewBuffer(primary, cx.AdaptBuffer(cxsyncmem.NewBuffer(100)), opts...)
+}
+
+// nolint:funlen // it's not important here
+func TestFailoverBuffer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("it should write to secondary engine while primary is unavailable", func(t *testing.T) {
+		logger := &loggerMock{}
+		server, _, buf := useFailover(t, cxfailover.WithProbeInterval(time.Millisecond*10), cxfailover.WithLogger(logger))
+		for i := 0; i < 3; i++ {
+			if err := buf.Write(ctx, cx.Vector{i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		server.Close()
+		for i := 3; i < 6; i++ {
+			if err := buf.Write(ctx, cx.Vector{i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if m := buf.Metrics(); m.Failovers != 1 || m.SecondaryWrites != 3 || !m.Degraded {
+			t.Fatalf("failed, expected to switch to secondary engine, received %+v", m)
+		}
+		rows, err := buf.Drain(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSequence(t, rows, 3)
+		if err = server.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		simulateWait(time.Millisecond * 20)
+		if err = buf.Write(ctx, cx.Vector{6}); err != nil {
+			t.Fatal(err)
+		}
+		if m := buf.Metrics(); m.Recoveries != 1 || m.Degraded {
+			t.Fatalf("failed, expected to switch back to primary engine, received %+v", m)
+		}
+		rows, err = buf.Drain(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 4 || rows[0][0] != 0 || rows[3][0] != 6 {
+			t.Fatalf("failed, expected rows of primary engine, received %v", rows)
+		}
+		if logger.Len() != 2 {
+			t.Fatalf("failed, expected mode switches to be logged, received %d messages", logger.Len())
+		}
+	})
+
+	t.Run("it should restore rows of secondary engine into primary", func(t *testing.T) {
+		server, rdb, buf := useFailover(t, cxfailover.WithProbeInterval(time.Millisecond*10),
+			cxfailover.WithRestore(), cxfailover.WithLogger(&loggerMock{}),
+		)
+		server.Close()
+		for i := 0; i < 3; i++ {
+			if err := buf.Write(ctx, cx.Vector{i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := server.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		simulateWait(time.Millisecond * 20)
+		if err := buf.Write(ctx, cx.Vector{3}); err != nil {
+			t.Fatal(err)
+		}
+		if size := rdb.LLen(ctx, "ch_buffer:bucket").Val(); size != 4 {
+			t.Fatalf("failed, expected four rows in primary engine, received %d", size)
+		}
+		if buf.Len() != 4 {
+			t.Fatalf("failed, expected four rows, received %d", buf.Len())
+		}
+	})
+
+	t.Run("it should acknowledge restored rows by the secondary engine", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		rdb := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+		defer rdb.Close()
+		primary, err := cxredis.NewBufferV2(ctx, rdb, "bucket", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := t.TempDir()
+		secondary, err := cxfile.NewBuffer(dir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registry := metrics.NewRegistry()
+		buf := cxfailover.NewBuffer(primary, cx.AdaptBuffer(secondary), cxfailover.WithProbeInterval(time.Millisecond*10),
+			cxfailover.WithRestore(), cxfailover.WithLogger(&loggerMock{}), cxfailover.WithMetrics(registry),
+		)
+		server.Close()
+		for i := 0; i < 3; i++ {
+			if err = buf.Write(ctx, cx.Vector{i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if registry.Value(metrics.Failovers) != 1 || registry.Value(metrics.Degraded) != 1 || registry.Value(metrics.SecondaryWrites) != 3 {
+			t.Fatal("failed, expected the switch to secondary engine to be collected")
+		}
+		if err = server.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		simulateWait(time.Millisecond * 20)
+		if err = buf.Write(ctx, cx.Vector{3}); err != nil {
+			t.Fatal(err)
+		}
+		if registry.Value(metrics.Recoveries) != 1 || registry.Value(metrics.Degraded) != 0 {
+			t.Fatal("failed, expected the switch back to primary engine to be collected")
+		}
+		if size := rdb.LLen(ctx, "ch_buffer:bucket").Val(); size != 4 {
+			t.Fatalf("failed, expected four rows in primary engine, received %d", size)
+		}
+		if err = buf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		reopened, err := cxfile.NewBuffer(dir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, reopened)
+		if reopened.Len() != 0 {
+			t.Fatalf("failed, expected restored rows not to be replayed, received %d", reopened.Len())
+		}
+	})
+
+	t.Run("it should acknowledge batches by engines that returned them", func(t *testing.T) {
+		engine := &bufferAckMock{Buffer: cxsyncmem.NewBuffer(10)}
+		buf := cxfailover.NewBuffer(cx.AdaptBuffer(engine), cx.AdaptBuffer(cxsyncmem.NewBuffer(10)))
+		if err := buf.Write(ctx, cx.Vector{1}); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := buf.Drain(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Ack(cx.NewBatch(rows), nil)
+		// nothing was drained, nothing to acknowledge
+		buf.Ack(cx.NewBatch(nil), nil)
+		if engine.acked != 1 {
+			t.Fatalf("failed, expected one acknowledged batch, received %d", engine.acked)
+		}
+	})
+}
@@ -0,0 +1,307 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxfile"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+func closeFileBuffer(t *testing.T, buf cx.Buffer) {
+	t.Helper()
+	closer, ok := buf.(io.Closer)
+	if !ok {
+		t.Fatal("failed, file buffer is expected to implement io.Closer")
+	}
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nolint:funlen // it's not important here
+func TestFileBuffer(t *testing.T) {
+	rows := []cx.Vector{
+		{1, "one", "01 Jan 22 00:00 UTC"},
+		{2, "two", "02 Jan 22 00:00 UTC"},
+		{3, "three", "03 Jan 22 00:00 UTC"},
+	}
+
+	t.Run("it should be successfully replay unflushed rows", func(t *testing.T) {
+		dir := t.TempDir()
+		buf, err := cxfile.NewBuffer(dir, 10, cxfile.WithSyncPolicy(cxfile.SyncAlways))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			buf.Write(row)
+		}
+		// simulate a crash, nothing was flushed
+		closeFileBuffer(t, buf)
+
+		restored, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, restored)
+		if restored.Len() != len(rows) {
+			t.Fatalf("failed, expected to replay %d rows, received %d", len(rows), restored.Len())
+		}
+		if !reflect.DeepEqual(restored.Read(), rows) {
+			t.Fatalf("failed, replayed rows are not equal: %v", restored.Read())
+		}
+	})
+
+	t.Run("it should not replay flushed rows", func(t *testing.T) {
+		dir := t.TempDir()
+		buf, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			buf.Write(row)
+		}
+		buf.Flush()
+		buf.Write(rows[0])
+		closeFileBuffer(t, buf)
+
+		restored, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, restored)
+		if !reflect.DeepEqual(restored.Read(), rows[:1]) {
+			t.Fatalf("failed, expected to replay only one row, received %v", restored.Read())
+		}
+	})
+
+	t.Run("it should be successfully rotate segments", func(t *testing.T) {
+		dir := t.TempDir()
+		buf, err := cxfile.NewBuffer(dir, 10, cxfile.WithSegmentSize(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			buf.Write(row)
+		}
+		closeFileBuffer(t, buf)
+		segments, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != len(rows) {
+			t.Fatalf("failed, expected to get %d segments, received %d", len(rows), len(segments))
+		}
+
+		restored, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, restored)
+		if !reflect.DeepEqual(restored.Read(), rows) {
+			t.Fatalf("failed, replayed rows are not equal: %v", restored.Read())
+		}
+	})
+
+	t.Run("it should be successfully truncate torn tail", func(t *testing.T) {
+		dir := t.TempDir()
+		buf, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			buf.Write(row)
+		}
+		closeFileBuffer(t, buf)
+		segments, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+		if err != nil || len(segments) != 1 {
+			t.Fatalf("failed, expected to get one segment, received %d (%v)", len(segments), err)
+		}
+		// simulate a crash in the middle of writing a record
+		file, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = file.Write([]byte{0, 0, 0, 42, 1, 2}); err != nil {
+			t.Fatal(err)
+		}
+		if err = file.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		restored, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored.Write(rows[0])
+		closeFileBuffer(t, restored)
+
+		restored, err = cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, restored)
+		if !reflect.DeepEqual(restored.Read(), append(rows, rows[0])) {
+			t.Fatalf("failed, replayed rows are not equal: %v", restored.Read())
+		}
+	})
+
+	t.Run("it should be correct send and flush data with writer", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplMock{},
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(50),
+				clickhousebuffer.WithBatchSize(3),
+			),
+		)
+		defer client.Close()
+		dir := t.TempDir()
+		buf, err := cxfile.NewBuffer(dir, client.Options().BatchSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, buf)
+		writeAPI := client.Writer(ctx, cx.NewView("test_db.test_table", []string{"id", "uuid", "insert_ts"}), buf)
+		for _, row := range rows {
+			writeAPI.WriteVector(row)
+		}
+		simulateWait(time.Millisecond * 150)
+		if buf.Len() != 0 {
+			t.Fatal("failed, the buffer was expected to be cleared")
+		}
+		restored, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, restored)
+		if restored.Len() != 0 {
+			t.Fatalf("failed, flushed rows were expected to be removed, received %d", restored.Len())
+		}
+	})
+
+	t.Run("it should remove segments only after successful write", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		mock := &ClickhouseImplBlockMock{release: make(chan struct{})}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10000),
+				clickhousebuffer.WithBatchSize(3),
+			),
+		)
+		dir := t.TempDir()
+		buf, err := cxfile.NewBuffer(dir, client.Options().BatchSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, cx.NewView("test_db.test_table", []string{"id", "uuid", "insert_ts"}), buf)
+		for _, row := range rows {
+			writeAPI.WriteVector(row)
+		}
+		simulateWait(time.Millisecond * 50)
+		// the process crashes while the batch is inserted
+		crashed, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if crashed.Len() != len(rows) {
+			t.Fatalf("failed, expected rows being inserted to be replayed, received %d", crashed.Len())
+		}
+		closeFileBuffer(t, crashed)
+		close(mock.release)
+		client.Close()
+		restored, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, restored)
+		if restored.Len() != 0 {
+			t.Fatalf("failed, written rows were expected to be removed, received %d", restored.Len())
+		}
+	})
+
+	t.Run("it should keep rows of failed batch", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMock{},
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10000),
+				clickhousebuffer.WithBatchSize(3),
+			),
+		)
+		dir := t.TempDir()
+		buf, err := cxfile.NewBuffer(dir, client.Options().BatchSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, cx.NewView("test_db.test_table", []string{"id", "uuid", "insert_ts"}), buf)
+		for _, row := range rows {
+			writeAPI.WriteVector(row)
+		}
+		if err = writeAPI.Flush(ctx); err == nil {
+			t.Fatal("failed, expected insert to fail")
+		}
+		if buf.Len() != len(rows) {
+			t.Fatalf("failed, expected rows of failed batch to be buffered again, received %d", buf.Len())
+		}
+		client.Close()
+		restored, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, restored)
+		if !reflect.DeepEqual(restored.Read(), rows) {
+			t.Fatal("failed, expected rows of failed batch to be replayed")
+		}
+	})
+	t.Run("it should move rows of batch failed without retry to rejected file", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		mock := &ClickhouseImplPoisonMock{poison: 0}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10000),
+				clickhousebuffer.WithBatchSize(1),
+			),
+		)
+		dir := t.TempDir()
+		buf, err := cxfile.NewBuffer(dir, client.Options().BatchSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, cx.NewView("test_db.test_table", []string{"id"}), buf)
+		for i := 0; i < 6; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+		client.Close()
+		if inserted := mock.Rows(); len(inserted) != 5 {
+			t.Fatalf("failed, expected all good rows to be inserted, received %v", inserted)
+		}
+		if inserts := atomic.LoadInt32(&mock.inserts); inserts != 6 {
+			t.Fatalf("failed, expected the poison row to be inserted once, received %d inserts", inserts)
+		}
+		rejected, err := cxfile.ReadRejected(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rejected) != 1 || rejected[0][0] != 0 {
+			t.Fatalf("failed, expected the poison row to be rejected, received %v", rejected)
+		}
+		restored, err := cxfile.NewBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, restored)
+		if restored.Len() != 0 {
+			t.Fatalf("failed, rejected rows were expected not to be replayed, received %d", restored.Len())
+		}
+	})
+}
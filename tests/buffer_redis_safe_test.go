@@ -0,0 +1,268 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxredis"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+func useMiniredis(t *testing.T) *redis.Client {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+// nolint:funlen,gocognit // it's not important here
+func TestRedisSafeBuffer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("it should deliver every row exactly once with several producers and flushers", func(t *testing.T) {
+		const producers, rowsPerProducer, batchSize = 4, 250, 32
+		rdb := useMiniredis(t)
+		buffers := make([]cx.Buffer, producers)
+		for i := range buffers {
+			buf, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", batchSize, cxredis.WithConsumer(fmt.Sprintf("c%d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			buffers[i] = buf
+		}
+		wg := sync.WaitGroup{}
+		mu := sync.Mutex{}
+		received := map[string]int{}
+		for i, buf := range buffers {
+			wg.Add(2)
+			go func(i int, buf cx.Buffer) {
+				defer wg.Done()
+				for j := 0; j < rowsPerProducer; j++ {
+					buf.Write(cx.Vector{i, fmt.Sprintf("%d-%d", i, j)})
+				}
+			}(i, buf)
+			go func(buf cx.Buffer) {
+				defer wg.Done()
+				for k := 0; k < producers*rowsPerProducer; k++ {
+					rows := buf.Read()
+					buf.Flush()
+					mu.Lock()
+					for _, row := range rows {
+						received[row[1].(string)]++
+					}
+					mu.Unlock()
+				}
+			}(buf)
+		}
+		wg.Wait()
+		// drain the rest
+		for rows := buffers[0].Read(); len(rows) > 0; rows = buffers[0].Read() {
+			buffers[0].Flush()
+			for _, row := range rows {
+				received[row[1].(string)]++
+			}
+		}
+		if len(received) != producers*rowsPerProducer {
+			t.Fatalf("failed, expected to receive %d rows, received %d", producers*rowsPerProducer, len(received))
+		}
+		for value, count := range received {
+			if count != 1 {
+				t.Fatalf("failed, row %s was received %d times", value, count)
+			}
+		}
+		if buffers[0].Len() != 0 {
+			t.Fatal("failed, the buffer was expected to be cleared")
+		}
+	})
+
+	t.Run("it should return rows read by a crashed consumer again", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		buf, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 2, cxredis.WithConsumer("pod-0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			buf.Write(cx.Vector{i})
+		}
+		if rows := buf.Read(); len(rows) != 2 {
+			t.Fatalf("failed, expected to read two rows, received %d", len(rows))
+		}
+		// the process crashed before Flush, another consumer must not see these rows
+		other, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 2, cxredis.WithConsumer("pod-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other.Len() != 1 {
+			t.Fatalf("failed, expected one row for another consumer, received %d", other.Len())
+		}
+		restarted, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 2, cxredis.WithConsumer("pod-0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restarted.Len() != 3 {
+			t.Fatalf("failed, expected three rows for restarted consumer, received %d", restarted.Len())
+		}
+		rows := restarted.Read()
+		if len(rows) != 2 || rows[0][0] != 0 || rows[1][0] != 1 {
+			t.Fatalf("failed, expected to read unflushed rows again, received %v", rows)
+		}
+		restarted.Flush()
+		if rows = restarted.Read(); len(rows) != 1 || rows[0][0] != 2 {
+			t.Fatalf("failed, expected to read the last row, received %v", rows)
+		}
+	})
+
+	t.Run("it should not share processing list between buffers with default consumers", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		first, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 4; i++ {
+			first.Write(cx.Vector{i})
+		}
+		if rows := first.Read(); len(rows) != 2 || rows[0][0] != 0 {
+			t.Fatalf("failed, expected to read the first two rows, received %v", rows)
+		}
+		if rows := second.Read(); len(rows) != 2 || rows[0][0] != 2 {
+			t.Fatalf("failed, expected another buffer to read other rows, received %v", rows)
+		}
+	})
+
+	t.Run("it should reclaim rows read by a crashed consumer with default name", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		crashed, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 2, cxredis.WithMinIdle(time.Millisecond*20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			crashed.Write(cx.Vector{i})
+		}
+		if rows := crashed.Read(); len(rows) != 2 {
+			t.Fatalf("failed, expected to read two rows, received %v", rows)
+		}
+		alive, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 10, cxredis.WithMinIdle(time.Millisecond*20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows := alive.Read(); len(rows) != 1 || rows[0][0] != 2 {
+			t.Fatalf("failed, rows of the consumer that reported recently should not be reclaimed, received %v", rows)
+		}
+		alive.Flush()
+		simulateWait(time.Millisecond * 50)
+		rows := alive.Read()
+		if len(rows) != 2 || rows[0][0] != 0 || rows[1][0] != 1 {
+			t.Fatalf("failed, expected rows of the crashed consumer to be reclaimed in order, received %v", rows)
+		}
+		if keys := rdb.Keys(ctx, "ch_buffer:bucket:processing:*").Val(); len(keys) != 1 {
+			t.Fatalf("failed, expected processing list of the crashed consumer to be removed, received %v", keys)
+		}
+	})
+
+	t.Run("it should remove rows from the processing list only after successful write", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		mock := &ClickhouseImplBlockMock{release: make(chan struct{})}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(2),
+		))
+		buf, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 2, cxredis.WithConsumer("pod-0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, cx.NewView("test_db.test_table", []string{"id"}), buf)
+		writeAPI.WriteVector(cx.Vector{1})
+		writeAPI.WriteVector(cx.Vector{2})
+		simulateWait(time.Millisecond * 50)
+		if size := rdb.LLen(ctx, "ch_buffer:bucket:processing:pod-0").Val(); size != 2 {
+			t.Fatalf("failed, expected rows to be kept while the batch is inserted, received %d", size)
+		}
+		close(mock.release)
+		client.Close()
+		if size := rdb.LLen(ctx, "ch_buffer:bucket:processing:pod-0").Val(); size != 0 || len(mock.Rows()) != 2 {
+			t.Fatalf("failed, expected rows to be removed after insert, left %d", size)
+		}
+	})
+
+	t.Run("it should return rows of failed batch to the bucket", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMock{}, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(2),
+		))
+		buf, err := cxredis.NewSafeBufferV2(ctx, rdb, "bucket", 2, cxredis.WithConsumer("pod-0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.WriterV2(ctx, cx.NewView("test_db.test_table", []string{"id"}), buf)
+		writeAPI.WriteVector(cx.Vector{1})
+		writeAPI.WriteVector(cx.Vector{2})
+		if err = writeAPI.Flush(ctx); err == nil {
+			t.Fatal("failed, expected insert to fail")
+		}
+		client.Close()
+		processing, bucket := rdb.LLen(ctx, "ch_buffer:bucket:processing:pod-0").Val(), rdb.LLen(ctx, "ch_buffer:bucket").Val()
+		if processing != 0 || bucket != 2 {
+			t.Fatalf("failed, expected rows to be returned to the bucket, received %d and %d", processing, bucket)
+		}
+	})
+
+	t.Run("it should move rows of batch failed without retry to rejected list", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		mock := &ClickhouseImplPoisonMock{poison: int64(0)}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(1),
+		))
+		buf, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 1, cxredis.WithConsumer("pod-0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, cx.NewView("test_db.test_table", []string{"id"}), buf)
+		for i := int64(0); i < 6; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+		client.Close()
+		if inserted, inserts := mock.Rows(), atomic.LoadInt32(&mock.inserts); len(inserted) != 5 || inserts != 6 {
+			t.Fatalf("failed, expected all good rows to be inserted once, received %v in %d inserts", inserted, inserts)
+		}
+		rejected := rdb.LRange(ctx, cxredis.RejectedKey("bucket"), 0, -1).Val()
+		if len(rejected) != 1 {
+			t.Fatalf("failed, expected the poison row to be rejected, received %d rows", len(rejected))
+		}
+		processing, bucket := rdb.LLen(ctx, "ch_buffer:bucket:processing:pod-0").Val(), rdb.LLen(ctx, "ch_buffer:bucket").Val()
+		if processing != 0 || bucket != 0 {
+			t.Fatalf("failed, expected no rows to be left, received %d and %d", processing, bucket)
+		}
+	})
+
+	t.Run("it should take length of existing bucket by prefixed key", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		buf, err := cxredis.NewBuffer(ctx, rdb, "bucket", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(cx.Vector{1})
+		buf.Write(cx.Vector{2})
+		restored, err := cxredis.NewBuffer(ctx, rdb, "bucket", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored.Len() != 2 {
+			t.Fatalf("failed, expected to get two rows, received %d", restored.Len())
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package tests
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxstream"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+const testStreamKey = "ch_buffer_stream:events"
+
+// nolint:funlen // it's not important here
+func TestRedisStreamBuffer(t *testing.T) {
+	tableView := cx.NewView("test_db.test_table", []string{"id", "uuid"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("it should acknowledge rows only after successful write", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplMock{},
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(20),
+				clickhousebuffer.WithBatchSize(2),
+			),
+		)
+		defer client.Close()
+		buf, err := cxstream.NewBuffer(ctx, rdb, "events", "writers", client.Options().BatchSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, tableView, buf)
+		writeAPI.WriteVector(cx.Vector{1, "1"})
+		writeAPI.WriteVector(cx.Vector{2, "2"})
+		writeAPI.WriteVector(cx.Vector{3, "3"})
+		simulateWait(time.Millisecond * 100)
+		if size := rdb.XLen(ctx, testStreamKey).Val(); size != 0 {
+			t.Fatalf("failed, expected all entries to be acknowledged and removed, left %d", size)
+		}
+	})
+
+	t.Run("it should leave rows of failed batch pending", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMock{},
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(20),
+				clickhousebuffer.WithBatchSize(2),
+			),
+		)
+		defer client.Close()
+		buf, err := cxstream.NewBuffer(ctx, rdb, "events", "writers", client.Options().BatchSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, tableView, buf)
+		writeAPI.WriteVector(cx.Vector{1, "1"})
+		writeAPI.WriteVector(cx.Vector{2, "2"})
+		simulateWait(time.Millisecond * 100)
+		pending := rdb.XPending(ctx, testStreamKey, "writers").Val()
+		if pending.Count != 2 {
+			t.Fatalf("failed, expected two pending entries, received %d", pending.Count)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("failed, pending entries should not be counted before min idle time, received %d", buf.Len())
+		}
+	})
+
+	t.Run("it should move entries of batch failed without retry to rejected list", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		mock := &ClickhouseImplPoisonMock{poison: int64(0)}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10000),
+				clickhousebuffer.WithBatchSize(1),
+			),
+		)
+		buf, err := cxstream.NewBuffer(ctx, rdb, "events", "writers", client.Options().BatchSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, tableView, buf)
+		for i := int64(0); i < 4; i++ {
+			writeAPI.WriteVector(cx.Vector{i, "uuid"})
+		}
+		client.Close()
+		if inserted := mock.Rows(); len(inserted) != 3 {
+			t.Fatalf("failed, expected all good rows to be inserted, received %v", inserted)
+		}
+		if size := rdb.XLen(ctx, testStreamKey).Val(); size != 0 {
+			t.Fatalf("failed, expected all entries to be removed, left %d", size)
+		}
+		if rejected := rdb.LLen(ctx, cxstream.RejectedKey("events")).Val(); rejected != 1 {
+			t.Fatalf("failed, expected the poison entry to be rejected, received %d", rejected)
+		}
+	})
+
+	t.Run("it should move entries delivered too many times to rejected list", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		opts := []cxstream.Option{cxstream.WithMinIdle(time.Millisecond * 20), cxstream.WithMaxDeliveries(2)}
+		first, err := cxstream.NewBuffer(ctx, rdb, "events", "writers", 10, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first.Write(cx.Vector{1, "1"})
+		if rows := first.Read(); len(rows) != 1 {
+			t.Fatalf("failed, expected to read the row, received %v", rows)
+		}
+		second, err := cxstream.NewBuffer(ctx, rdb, "events", "writers", 10, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		simulateWait(time.Millisecond * 50)
+		if rows := second.Read(); len(rows) != 1 {
+			t.Fatalf("failed, expected the entry to be delivered the second time, received %v", rows)
+		}
+		simulateWait(time.Millisecond * 50)
+		if rows := second.Read(); len(rows) != 0 {
+			t.Fatalf("failed, expected the entry not to be delivered the third time, received %v", rows)
+		}
+		if size := rdb.XLen(ctx, testStreamKey).Val(); size != 0 {
+			t.Fatalf("failed, expected the entry to be removed, left %d", size)
+		}
+		if rejected := rdb.LLen(ctx, cxstream.RejectedKey("events")).Val(); rejected != 1 {
+			t.Fatalf("failed, expected the entry to be rejected, received %d", rejected)
+		}
+	})
+
+	t.Run("it should acknowledge rows with the final result of retries", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		mock := &ClickhouseImplRetryMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(20),
+				clickhousebuffer.WithBatchSize(2),
+				clickhousebuffer.WithRetry(true),
+			),
+		)
+		defer client.Close()
+		buf, err := cxstream.NewBuffer(ctx, rdb, "events", "writers", client.Options().BatchSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, tableView, buf)
+		writeAPI.WriteVector(cx.Vector{1, "1"})
+		writeAPI.WriteVector(cx.Vector{2, "2"})
+		simulateWait(time.Millisecond * 100)
+		if size := rdb.XLen(ctx, testStreamKey).Val(); size != 2 {
+			t.Fatalf("failed, expected entries to be kept while batch is retried, left %d", size)
+		}
+		atomic.StoreInt32(&mock.hasErr, 1)
+		deadline := time.Now().Add(time.Second * 5)
+		for rdb.XLen(ctx, testStreamKey).Val() != 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("failed, expected entries to be acknowledged after successful retry")
+			}
+			simulateWait(time.Millisecond * 20)
+		}
+	})
+
+	t.Run("it should claim entries abandoned by crashed consumer", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		crashed, err := cxstream.NewBuffer(ctx, rdb, "events", "writers", 10,
+			cxstream.WithConsumer("pod-0"), cxstream.WithMinIdle(time.Millisecond*20),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crashed.Write(cx.Vector{1, "1"})
+		crashed.Write(cx.Vector{2, "2"})
+		if rows := crashed.Read(); len(rows) != 2 {
+			t.Fatalf("failed, expected to read two rows, received %d", len(rows))
+		}
+		alive, err := cxstream.NewBuffer(ctx, rdb, "events", "writers", 10,
+			cxstream.WithConsumer("pod-1"), cxstream.WithMinIdle(time.Millisecond*20),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows := alive.Read(); len(rows) != 0 {
+			t.Fatalf("failed, entries of alive consumer should not be claimed, received %d", len(rows))
+		}
+		simulateWait(time.Millisecond * 50)
+		if alive.Len() != 2 {
+			t.Fatalf("failed, expected two claimable entries, received %d", alive.Len())
+		}
+		rows := alive.Read()
+		if len(rows) != 2 || rows[0][1] != "1" || rows[1][1] != "2" {
+			t.Fatalf("failed, expected to claim two rows, received %v", rows)
+		}
+		alive.(cx.Acknowledger).Ack(cx.NewBatch(rows), nil)
+		if size := rdb.XLen(ctx, testStreamKey).Val(); size != 0 {
+			t.Fatalf("failed, expected all entries to be removed, left %d", size)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxshardmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// nolint:funlen // it's not important here
+func TestShardMemoryBuffer(t *testing.T) {
+	t.Run("it should deliver every row exactly once with concurrent producers", func(t *testing.T) {
+		buf := cxshardmem.NewBuffer(100, cxshardmem.WithShards(4))
+		const producers, rowsPerProducer = 16, 1000
+		var wg sync.WaitGroup
+		for p := 0; p < producers; p++ {
+			wg.Add(1)
+			go func(p int) {
+				defer wg.Done()
+				for i := 0; i < rowsPerProducer; i++ {
+					buf.Write(cx.Vector{p*rowsPerProducer + i})
+				}
+			}(p)
+		}
+		seen := make(map[int]int, producers*rowsPerProducer)
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		collect := func() {
+			for _, row := range buf.Read() {
+				seen[row[0].(int)]++
+			}
+			buf.Flush()
+		}
+		for finished := false; !finished; {
+			select {
+			case <-done:
+				finished = true
+			default:
+			}
+			collect()
+		}
+		collect()
+		if len(seen) != producers*rowsPerProducer {
+			t.Fatalf("failed, expected %d rows, received %d", producers*rowsPerProducer, len(seen))
+		}
+		for id, count := range seen {
+			if count != 1 {
+				t.Fatalf("failed, expected row %d once, received %d times", id, count)
+			}
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("failed, expected empty buffer, received %d", buf.Len())
+		}
+	})
+
+	t.Run("it should keep rows written between read and flush", func(t *testing.T) {
+		buf := cxshardmem.NewBuffer(10)
+		buf.Write(cx.Vector{1})
+		buf.Write(cx.Vector{2})
+		if rows := buf.Read(); len(rows) != 2 {
+			t.Fatalf("failed, expected two rows, received %d", len(rows))
+		}
+		buf.Write(cx.Vector{3})
+		if buf.Len() != 3 {
+			t.Fatalf("failed, expected three rows, received %d", buf.Len())
+		}
+		buf.Flush()
+		if rows := buf.Read(); len(rows) != 1 || rows[0][0] != 3 {
+			t.Fatalf("failed, expected row written after read, received %v", rows)
+		}
+	})
+
+	t.Run("it should drain buffer of the second version", func(t *testing.T) {
+		ctx := context.Background()
+		buf := cxshardmem.NewBufferV2(10, cxshardmem.WithShards(3))
+		for i := 0; i < 25; i++ {
+			if err := buf.Write(ctx, cx.Vector{i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if buf.Len() != 25 {
+			t.Fatalf("failed, expected 25 rows, received %d", buf.Len())
+		}
+		rows, err := buf.Drain(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 25 || buf.Len() != 0 {
+			t.Fatalf("failed, expected to drain 25 rows, received %d, left %d", len(rows), buf.Len())
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxfile"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// ClickhouseImplBlockMock blocks inserts until it is released and stores inserted rows
+type ClickhouseImplBlockMock struct {
+	ClickhouseImplRecordMock
+	release chan struct{}
+}
+
+func (cb *ClickhouseImplBlockMock) Insert(ctx context.Context, view cx.View, rows []cx.Vector) (uint64, error) {
+	<-cb.release
+	return cb.ClickhouseImplRecordMock.Insert(ctx, view, rows)
+}
+
+func segmentFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func assertSequence(t *testing.T, rows []cx.Vector, from int) {
+	t.Helper()
+	for i, row := range rows {
+		if row[0] != from+i {
+			t.Fatalf("failed, expected row %d at position %d, received %v", from+i, i, row[0])
+		}
+	}
+}
+
+// nolint:funlen,gocognit // it's not important here
+func TestTieredBuffer(t *testing.T) {
+	t.Run("it should spill rows to disk and read them back in order", func(t *testing.T) {
+		dir := t.TempDir()
+		buf, err := cxfile.NewTieredBuffer(dir, 10, cxfile.WithMemoryRows(15))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, buf)
+		for i := 0; i < 40; i++ {
+			buf.Write(cx.Vector{i, "row"})
+		}
+		if spilled := buf.(cx.Spiller).Spilled(); spilled != 32 {
+			t.Fatalf("failed, expected 32 rows to be spilled, received %d", spilled)
+		}
+		if segmentFiles(t, dir) != 2 {
+			t.Fatalf("failed, expected two segments, received %d", segmentFiles(t, dir))
+		}
+		for from := 0; from < 40; {
+			rows := buf.Read()
+			if len(rows) == 0 || len(rows) > 10 {
+				t.Fatalf("failed, expected up to 10 rows, received %d", len(rows))
+			}
+			assertSequence(t, rows, from)
+			from += len(rows)
+			buf.Flush()
+		}
+		if buf.Len() != 0 || segmentFiles(t, dir) != 0 {
+			t.Fatalf("failed, expected empty buffer, received %d rows and %d segments", buf.Len(), segmentFiles(t, dir))
+		}
+	})
+
+	t.Run("it should spill rows by size", func(t *testing.T) {
+		buf, err := cxfile.NewTieredBuffer(t.TempDir(), 100, cxfile.WithMemoryBytes(1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, buf)
+		for i := 0; i < 5; i++ {
+			buf.Write(cx.Vector{i, strings.Repeat("x", 300)})
+		}
+		// the third row of about 380 bytes exceeds the limit
+		if spilled := buf.(cx.Spiller).Spilled(); spilled != 3 {
+			t.Fatalf("failed, expected three rows to be spilled, received %d", spilled)
+		}
+		if buf.Len() != 5 {
+			t.Fatalf("failed, expected five rows, received %d", buf.Len())
+		}
+	})
+
+	t.Run("it should flush rows spilled after read", func(t *testing.T) {
+		buf, err := cxfile.NewTieredBuffer(t.TempDir(), 10, cxfile.WithMemoryRows(5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, buf)
+		for i := 0; i < 3; i++ {
+			buf.Write(cx.Vector{i})
+		}
+		assertSequence(t, buf.Read(), 0)
+		for i := 3; i < 8; i++ {
+			buf.Write(cx.Vector{i})
+		}
+		// rows 0-5 were spilled together, the rows returned by Read are removed from the segment
+		buf.Flush()
+		rows := buf.Read()
+		if len(rows) != 3 {
+			t.Fatalf("failed, expected three spilled rows, received %d", len(rows))
+		}
+		assertSequence(t, rows, 3)
+		buf.Flush()
+		assertSequence(t, buf.Read(), 6)
+	})
+
+	t.Run("it should keep rows between restarts", func(t *testing.T) {
+		dir := t.TempDir()
+		buf, err := cxfile.NewTieredBuffer(dir, 10, cxfile.WithMemoryRows(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 7; i++ {
+			buf.Write(cx.Vector{i})
+		}
+		closeFileBuffer(t, buf)
+		restored, err := cxfile.NewTieredBuffer(dir, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeFileBuffer(t, restored)
+		if restored.Len() != 7 {
+			t.Fatalf("failed, expected seven rows, received %d", restored.Len())
+		}
+		var rows []cx.Vector
+		for restored.Len() > 0 {
+			rows = append(rows, restored.Read()...)
+			restored.Flush()
+		}
+		assertSequence(t, rows, 0)
+	})
+
+	t.Run("it should not block producers while clickhouse is slow", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		mock := &ClickhouseImplBlockMock{release: make(chan struct{})}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10),
+				clickhousebuffer.WithBatchSize(10),
+			),
+		)
+		buf, err := cxfile.NewTieredBuffer(t.TempDir(), 10, cxfile.WithMemoryRows(20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, cx.NewView("test_db.test_table", []string{"id"}), buf)
+		written := make(chan struct{})
+		go func() {
+			for i := 0; i < 1000; i++ {
+				writeAPI.WriteVector(cx.Vector{i})
+			}
+			close(written)
+		}()
+		select {
+		case <-written:
+		case <-time.After(5 * time.Second):
+			t.Fatal("failed, producers are blocked by slow clickhouse")
+		}
+		if spilled := buf.(cx.Spiller).Spilled(); spilled == 0 {
+			t.Fatal("failed, expected rows to be spilled to disk")
+		}
+		close(mock.release)
+		client.Close()
+		rows := mock.Rows()
+		if len(rows) != 1000 {
+			t.Fatalf("failed, expected 1000 rows to be inserted, received %d", len(rows))
+		}
+		assertSequence(t, rows, 0)
+	})
+}
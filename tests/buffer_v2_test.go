@@ -0,0 +1,301 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxfile"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxredis"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxstream"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+var errBufferUnavailable = errors.New("buffer is unavailable")
+
+type bufferV2FailMock struct{}
+
+func (b *bufferV2FailMock) Write(_ context.Context, _ cx.Vector) error {
+	return errBufferUnavailable
+}
+
+func (b *bufferV2FailMock) Drain(_ context.Context) ([]cx.Vector, error) {
+	return nil, nil
+}
+
+func (b *bufferV2FailMock) Len() int {
+	return 0
+}
+
+func (b *bufferV2FailMock) Close() error {
+	return nil
+}
+
+type bufferAckMock struct {
+	cx.Buffer
+	acked int
+}
+
+// Read removes rows at once, the adapter does not flush engines with acknowledgements
+func (b *bufferAckMock) Read() []cx.Vector {
+	rows := b.Buffer.Read()
+	b.Buffer.Flush()
+	return rows
+}
+
+func (b *bufferAckMock) Ack(_ *cx.Batch, _ error) {
+	b.acked++
+}
+
+// bufferLenMock counts requests of the length of the engine
+type bufferLenMock struct {
+	cx.Buffer
+	lens int32
+}
+
+func (b *bufferLenMock) Len() int {
+	atomic.AddInt32(&b.lens, 1)
+	return b.Buffer.Len()
+}
+
+// nolint:funlen,gocognit // it's not important here
+func TestBufferV2(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id", "uuid", "insert_ts"})
+
+	t.Run("it should adapt buffers of the first version", func(t *testing.T) {
+		engine := &bufferAckMock{Buffer: cxsyncmem.NewBuffer(10)}
+		buf := cx.AdaptBuffer(engine)
+		for i := 0; i < 3; i++ {
+			if err := buf.Write(ctx, cx.Vector{i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if buf.Len() != 3 {
+			t.Fatalf("failed, expected three rows, received %d", buf.Len())
+		}
+		rows, err := buf.Drain(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 3 || buf.Len() != 0 {
+			t.Fatalf("failed, expected to drain three rows, received %d, left %d", len(rows), buf.Len())
+		}
+		ack, ok := buf.(cx.Acknowledger)
+		if !ok {
+			t.Fatal("failed, expected adapter to keep Acknowledger")
+		}
+		ack.Ack(cx.NewBatch(rows), nil)
+		if engine.acked != 1 {
+			t.Fatalf("failed, expected ack to be passed to the engine, received %d", engine.acked)
+		}
+		if err = buf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for name, constructor := range map[string]func(context.Context, string) (cx.BufferV2, error){
+		"simple": func(ctx context.Context, bucket string) (cx.BufferV2, error) {
+			return cxredis.NewBufferV2(ctx, useMiniredis(t), bucket, 10, cxredis.WithMicroBatch(2))
+		},
+		"safe": func(ctx context.Context, bucket string) (cx.BufferV2, error) {
+			return cxredis.NewSafeBufferV2(ctx, useMiniredis(t), bucket, 10, cxredis.WithMicroBatch(2))
+		},
+	} {
+		constructor := constructor
+		t.Run("it should drain "+name+" redis buffer", func(t *testing.T) {
+			buf, err := constructor(ctx, "bucket")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 15; i++ {
+				if err = buf.Write(ctx, cx.Vector{i, "1"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if buf.Len() != 15 {
+				t.Fatalf("failed, expected 15 rows, received %d", buf.Len())
+			}
+			first, err := buf.Drain(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := buf.Drain(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(first) != 10 || len(second) != 5 || buf.Len() != 0 {
+				t.Fatalf("failed, expected to drain 10 and 5 rows, received %d and %d", len(first), len(second))
+			}
+			if second[4][0] != 14 {
+				t.Fatalf("failed, expected last row, received %v", second[4])
+			}
+			canceled, cancelWrite := context.WithCancel(ctx)
+			cancelWrite()
+			if err = buf.Write(canceled, cx.Vector{1, "1"}); err != nil {
+				t.Fatalf("failed, expected row to be kept in micro-batch, received %v", err)
+			}
+			if err = buf.Write(canceled, cx.Vector{2, "2"}); !errors.Is(err, context.Canceled) {
+				t.Fatalf("failed, expected write error, received %v", err)
+			}
+			if err = buf.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	t.Run("it should send buffer errors to the errors channel", func(t *testing.T) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplMock{},
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10),
+				clickhousebuffer.WithBatchSize(1),
+			),
+		)
+		defer client.Close()
+		writeAPI := client.WriterV2(ctx, tableView, &bufferV2FailMock{})
+		errorsCh := writeAPI.Errors()
+		writeAPI.WriteRow(RowMock{
+			id: 1, uuid: "1", insertTS: time.Now(),
+		})
+		select {
+		case err := <-errorsCh:
+			if !errors.Is(err, errBufferUnavailable) {
+				t.Fatalf("failed, expected buffer error, received %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("failed, expected to receive buffer error")
+		}
+	})
+
+	t.Run("it should write rows through redis buffer of the second version", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10),
+				clickhousebuffer.WithBatchSize(5),
+			),
+		)
+		buf, err := cxredis.NewSafeBufferV2(ctx, useMiniredis(t), "bucket", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.WriterV2(ctx, cx.NewView("test_db.test_table", []string{"id", "uuid"}), buf)
+		for i := 0; i < 12; i++ {
+			writeAPI.WriteVector(cx.Vector{i, "1"})
+		}
+		client.Close()
+		if rows := mock.Rows(); len(rows) != 12 {
+			t.Fatalf("failed, expected 12 rows to be inserted, received %d", len(rows))
+		}
+	})
+
+	t.Run("it should not request the length of the engine for every row", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10000),
+				clickhousebuffer.WithBatchSize(10),
+			),
+		)
+		engine := &bufferLenMock{Buffer: cxsyncmem.NewBuffer(10)}
+		writeAPI := client.Writer(ctx, tableView, engine)
+		for i := 0; i < 100; i++ {
+			writeAPI.WriteVector(cx.Vector{i, "1", time.Now()})
+		}
+		client.Close()
+		if rows := mock.Rows(); len(rows) != 100 {
+			t.Fatalf("failed, expected 100 rows to be inserted, received %d", len(rows))
+		}
+		if lens := atomic.LoadInt32(&engine.lens); lens > 5 {
+			t.Fatalf("failed, expected length of the engine to be requested on close only, received %d requests", lens)
+		}
+	})
+	for name, constructor := range map[string]func(string) (cx.BufferV2, error){
+		"file": func(dir string) (cx.BufferV2, error) {
+			return cxfile.NewBufferV2(dir, 5)
+		},
+		"tiered": func(dir string) (cx.BufferV2, error) {
+			return cxfile.NewTieredBufferV2(dir, 5, cxfile.WithMemoryRows(3))
+		},
+	} {
+		constructor := constructor
+		t.Run("it should write rows through "+name+" buffer of the second version", func(t *testing.T) {
+			mock := &ClickhouseImplRecordMock{}
+			client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+				clickhousebuffer.NewOptions(
+					clickhousebuffer.WithFlushInterval(10),
+					clickhousebuffer.WithBatchSize(5),
+				),
+			)
+			dir := t.TempDir()
+			buf, err := constructor(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeAPI := client.WriterV2(ctx, cx.NewView("test_db.test_table", []string{"id", "uuid"}), buf)
+			for i := 0; i < 12; i++ {
+				writeAPI.WriteVector(cx.Vector{i, "1"})
+			}
+			client.Close()
+			if rows := mock.Rows(); len(rows) != 12 {
+				t.Fatalf("failed, expected 12 rows to be inserted, received %d", len(rows))
+			}
+			if err = buf.Close(); err != nil {
+				t.Fatal(err)
+			}
+			restored, err := constructor(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored.Len() != 0 {
+				t.Fatalf("failed, inserted rows were expected to be removed, received %d", restored.Len())
+			}
+			if err = restored.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// the tiered buffer keeps rows written after Close in memory
+			if name == "file" {
+				if err = restored.Write(ctx, cx.Vector{1, "1"}); !errors.Is(err, os.ErrClosed) {
+					t.Fatalf("failed, expected write error of the closed buffer, received %v", err)
+				}
+			}
+		})
+	}
+
+	t.Run("it should write rows through stream buffer of the second version", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10),
+				clickhousebuffer.WithBatchSize(5),
+			),
+		)
+		rdb := useMiniredis(t)
+		buf, err := cxstream.NewBufferV2(ctx, rdb, "events", "writers", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.WriterV2(ctx, cx.NewView("test_db.test_table", []string{"id", "uuid"}), buf)
+		for i := 0; i < 12; i++ {
+			writeAPI.WriteVector(cx.Vector{i, "1"})
+		}
+		client.Close()
+		if rows := mock.Rows(); len(rows) != 12 {
+			t.Fatalf("failed, expected 12 rows to be inserted, received %d", len(rows))
+		}
+		if size := rdb.XLen(ctx, testStreamKey).Val(); size != 0 {
+			t.Fatalf("failed, expected all entries to be acknowledged and removed, left %d", size)
+		}
+		canceled, cancelWrite := context.WithCancel(ctx)
+		cancelWrite()
+		if err = buf.Write(canceled, cx.Vector{1, "1"}); !errors.Is(err, context.Canceled) {
+			t.Fatalf("failed, expected write error, received %v", err)
+		}
+	})
+}
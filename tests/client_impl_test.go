@@ -29,6 +29,12 @@ var (
 		Message:    "UNKNOWN_TABLE",
 		StackTrace: "UNKNOWN_TABLE == UNKNOWN_TABLE",
 	}
+	errClickhouseColumnsException = &clickhouse.Exception{
+		Code:       20,
+		Name:       "NUMBER_OF_COLUMNS_DOESNT_MATCH",
+		Message:    "NUMBER_OF_COLUMNS_DOESNT_MATCH",
+		StackTrace: "NUMBER_OF_COLUMNS_DOESNT_MATCH == NUMBER_OF_COLUMNS_DOESNT_MATCH",
+	}
 )
 
 type ClickhouseImplMock struct{}
@@ -92,6 +98,51 @@ func (cr *ClickhouseImplRetryMock) Conn() driver.Conn {
 	return nil
 }
 
+// ClickhouseImplPoisonMock rejects batches containing the poison row with an error that cannot be retried,
+// rows of other batches are stored
+type ClickhouseImplPoisonMock struct {
+	ClickhouseImplRecordMock
+	poison  interface{}
+	inserts int32
+}
+
+func (cp *ClickhouseImplPoisonMock) Insert(ctx context.Context, view cx.View, rows []cx.Vector) (uint64, error) {
+	atomic.AddInt32(&cp.inserts, 1)
+	for _, row := range rows {
+		if row[0] == cp.poison {
+			return 0, errClickhouseColumnsException
+		}
+	}
+	return cp.ClickhouseImplRecordMock.Insert(ctx, view, rows)
+}
+
+// ClickhouseImplRecordMock stores inserted rows
+type ClickhouseImplRecordMock struct {
+	mu   sync.Mutex
+	rows []cx.Vector
+}
+
+func (cr *ClickhouseImplRecordMock) Insert(_ context.Context, _ cx.View, rows []cx.Vector) (uint64, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.rows = append(cr.rows, rows...)
+	return uint64(len(rows)), nil
+}
+
+func (cr *ClickhouseImplRecordMock) Close() error {
+	return nil
+}
+
+func (cr *ClickhouseImplRecordMock) Conn() driver.Conn {
+	return nil
+}
+
+func (cr *ClickhouseImplRecordMock) Rows() []cx.Vector {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return append([]cx.Vector{}, cr.rows...)
+}
+
 type RowMock struct {
 	id       int
 	uuid     string
@@ -0,0 +1,247 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+	"github.com/zikwall/clickhouse-buffer/v4/src/retry"
+)
+
+// ClickhouseImplCloseMock records closing of the connection
+type ClickhouseImplCloseMock struct {
+	ClickhouseImplRecordMock
+	closed int32
+}
+
+func (cc *ClickhouseImplCloseMock) Close() error {
+	atomic.StoreInt32(&cc.closed, 1)
+	return nil
+}
+
+// ClickhouseImplHangCloseMock waits for the context of insert and records closing of the connection during insert
+type ClickhouseImplHangCloseMock struct {
+	ClickhouseImplHangMock
+	active             int32
+	closedDuringInsert int32
+	closed             int32
+}
+
+func (ch *ClickhouseImplHangCloseMock) Insert(ctx context.Context, view cx.View, rows []cx.Vector) (uint64, error) {
+	atomic.AddInt32(&ch.active, 1)
+	defer atomic.AddInt32(&ch.active, -1)
+	return ch.ClickhouseImplHangMock.Insert(ctx, view, rows)
+}
+
+func (ch *ClickhouseImplHangCloseMock) Close() error {
+	if atomic.LoadInt32(&ch.active) > 0 {
+		atomic.StoreInt32(&ch.closedDuringInsert, 1)
+	}
+	atomic.StoreInt32(&ch.closed, 1)
+	return nil
+}
+
+// queueEngineMock is the persistent queue engine of the retry worker
+type queueEngineMock struct {
+	retries chan *retry.Packet
+}
+
+func (q *queueEngineMock) Queue(packet *retry.Packet) {
+	q.retries <- packet
+}
+
+func (q *queueEngineMock) Retries() <-chan *retry.Packet {
+	return q.retries
+}
+
+// nolint:funlen,gocognit // it's not important here
+func TestClientShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dimensions := cx.NewView("test_db.dimensions", []string{"id"})
+	events := cx.NewView("test_db.events", []string{"id"})
+
+	useOptions := func(opts ...clickhousebuffer.Option) *clickhousebuffer.Options {
+		return clickhousebuffer.NewOptions(append([]clickhousebuffer.Option{
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(100),
+		}, opts...)...)
+	}
+
+	t.Run("it should deliver pending rows of all writers and close the connection", func(t *testing.T) {
+		mock := &ClickhouseImplCloseMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, useOptions(clickhousebuffer.WithCloseClickhouse(true)))
+		dimensionsAPI := client.Writer(ctx, dimensions, cxsyncmem.NewBuffer(100))
+		eventsAPI := client.Writer(ctx, events, cxsyncmem.NewBuffer(100))
+		for i := 0; i < 5; i++ {
+			dimensionsAPI.WriteVector(cx.Vector{i})
+			eventsAPI.WriteVector(cx.Vector{i})
+		}
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Second)
+		defer cancelDeadline()
+		if err := client.Shutdown(deadline); err != nil {
+			t.Fatalf("failed, expected all rows to be delivered, received %v", err)
+		}
+		if rows := mock.Rows(); len(rows) != 10 {
+			t.Fatalf("failed, expected rows of both writers, received %d", len(rows))
+		}
+		if atomic.LoadInt32(&mock.closed) != 1 {
+			t.Fatal("failed, expected connection to be closed")
+		}
+		if err := eventsAPI.WriteVectorContext(ctx, cx.Vector{1}); !errors.Is(err, clickhousebuffer.ErrWriterClosed) {
+			t.Fatalf("failed, expected writer to be closed, received %v", err)
+		}
+	})
+
+	t.Run("it should report rows not delivered by the deadline", func(t *testing.T) {
+		writerCtx, cancelWriter := context.WithCancel(ctx)
+		// releases inserts left after the deadline
+		defer cancelWriter()
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplHangMock{}, useOptions())
+		eventsAPI := client.Writer(writerCtx, events, cxsyncmem.NewBuffer(100))
+		for i := 0; i < 3; i++ {
+			eventsAPI.WriteVector(cx.Vector{i})
+		}
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Millisecond*50)
+		defer cancelDeadline()
+		err := client.Shutdown(deadline)
+		var shutdownErr *clickhousebuffer.ShutdownError
+		if !errors.As(err, &shutdownErr) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("failed, expected shutdown error by the deadline, received %v", err)
+		}
+		if shutdownErr.Undelivered[events.Name] != 3 || shutdownErr.Total() != 3 {
+			t.Fatalf("failed, expected 3 undelivered rows, received %v", shutdownErr.Undelivered)
+		}
+	})
+
+	t.Run("it should report rows of failed inserts", func(t *testing.T) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMockFailed{}, useOptions())
+		eventsAPI := client.Writer(ctx, events, cxsyncmem.NewBuffer(100))
+		// writers without undelivered rows are not listed
+		client.Writer(ctx, dimensions, cxsyncmem.NewBuffer(100))
+		eventsAPI.WriteVector(cx.Vector{1})
+		eventsAPI.WriteVector(cx.Vector{2})
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Second)
+		defer cancelDeadline()
+		err := client.Shutdown(deadline)
+		var shutdownErr *clickhousebuffer.ShutdownError
+		if !errors.As(err, &shutdownErr) || shutdownErr.Err != nil {
+			t.Fatalf("failed, expected shutdown error without cause, received %v", err)
+		}
+		if len(shutdownErr.Undelivered) != 1 || shutdownErr.Undelivered[events.Name] != 2 {
+			t.Fatalf("failed, expected 2 undelivered rows of events, received %v", shutdownErr.Undelivered)
+		}
+	})
+
+	t.Run("it should drain the retry queue", func(t *testing.T) {
+		mock := &ClickhouseImplRetryMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, useOptions(clickhousebuffer.WithRetry(true)))
+		if err := client.WriterBlocking(events).WriteRow(ctx, RowMock{id: 1}); err == nil {
+			t.Fatal("failed, expected error of the first insert")
+		}
+		go func() {
+			simulateWait(time.Millisecond * 50)
+			atomic.StoreInt32(&mock.hasErr, 1)
+		}()
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Second*5)
+		defer cancelDeadline()
+		if err := client.Shutdown(deadline); err != nil {
+			t.Fatalf("failed, expected retry queue to be drained, received %v", err)
+		}
+		if successfully, _, progress := client.RetryClient().Metrics(); successfully != 1 || progress != 0 {
+			t.Fatalf("failed, expected packet to be retried, received %d successful and %d queued", successfully, progress)
+		}
+		batch := cx.NewBatch([]cx.Vector{{2}})
+		client.RetryClient().Retry(retry.NewPacket(events, batch))
+		var result error
+		batch.OnDone(func(err error) {
+			result = err
+		})
+		if !errors.Is(result, retry.ErrRetryStopped) {
+			t.Fatalf("failed, expected packet to be rejected after shutdown, received %v", result)
+		}
+	})
+
+	t.Run("it should complete packets left in the retry queue by the deadline", func(t *testing.T) {
+		clientCtx, cancelClient := context.WithCancel(ctx)
+		defer cancelClient()
+		client := clickhousebuffer.NewClientWithOptions(clientCtx, &ClickhouseImplHangMock{}, useOptions(clickhousebuffer.WithRetry(true)))
+		// the first packet blocks the worker, the second one stays in the queue
+		client.RetryClient().Retry(retry.NewPacket(events, cx.NewBatch([]cx.Vector{{1}})))
+		simulateWait(time.Millisecond * 20)
+		batch := cx.NewBatch([]cx.Vector{{2}})
+		client.RetryClient().Retry(retry.NewPacket(events, batch))
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Millisecond*50)
+		defer cancelDeadline()
+		if err := client.Shutdown(deadline); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("failed, expected shutdown error by the deadline, received %v", err)
+		}
+		// releases the packet handled by the worker
+		cancelClient()
+		result := make(chan error, 1)
+		batch.OnDone(func(err error) {
+			result <- err
+		})
+		select {
+		case err := <-result:
+			if !errors.Is(err, retry.ErrRetryStopped) {
+				t.Fatalf("failed, expected packet to be rejected, received %v", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("failed, expected packet left in the queue to be completed")
+		}
+	})
+
+	t.Run("it should not wait for the retry worker that has already stopped", func(t *testing.T) {
+		clientCtx, cancelClient := context.WithCancel(ctx)
+		client := clickhousebuffer.NewClientWithOptions(clientCtx, &ClickhouseImplHangMock{}, useOptions(clickhousebuffer.WithRetry(true)))
+		client.RetryClient().Retry(retry.NewPacket(events, cx.NewBatch([]cx.Vector{{1}})))
+		simulateWait(time.Millisecond * 20)
+		batch := cx.NewBatch([]cx.Vector{{2}})
+		client.RetryClient().Retry(retry.NewPacket(events, batch))
+		// the worker stops together with the context of the client
+		cancelClient()
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Second*5)
+		defer cancelDeadline()
+		start := time.Now()
+		if err := client.Shutdown(deadline); err != nil {
+			t.Fatalf("failed, expected nothing to be undelivered, received %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second*2 {
+			t.Fatalf("failed, expected shutdown to return once the worker has stopped, took %v", elapsed)
+		}
+		var result error
+		batch.OnDone(func(err error) {
+			result = err
+		})
+		if !errors.Is(result, retry.ErrRetryStopped) {
+			t.Fatalf("failed, expected packet to be rejected, received %v", result)
+		}
+	})
+	t.Run("it should keep packets in the queue engine and close the connection after the retry", func(t *testing.T) {
+		mock := &ClickhouseImplHangCloseMock{}
+		engine := &queueEngineMock{retries: make(chan *retry.Packet, 10)}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, useOptions(
+			clickhousebuffer.WithRetry(true), clickhousebuffer.WithRetryQueueEngine(engine), clickhousebuffer.WithCloseClickhouse(true),
+		))
+		for i := 0; i < 5; i++ {
+			client.RetryClient().Retry(retry.NewPacket(events, cx.NewBatch([]cx.Vector{{i}})))
+		}
+		simulateWait(time.Millisecond * 20)
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Millisecond*50)
+		defer cancelDeadline()
+		if err := client.Shutdown(deadline); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("failed, expected shutdown error by the deadline, received %v", err)
+		}
+		if atomic.LoadInt32(&mock.closed) != 1 || atomic.LoadInt32(&mock.closedDuringInsert) != 0 {
+			t.Fatal("failed, expected connection to be closed after the retry was interrupted")
+		}
+		if left := len(engine.retries); left != 5 {
+			t.Fatalf("failed, expected all packets to be kept in the queue engine, received %d", left)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/zikwall/clickhouse-buffer/v4/example/pkg/tables"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// nolint:funlen // it's not important here
+func TestRowBinaryCodec(t *testing.T) {
+	t.Run("it should round-trip every column of advanced table", func(t *testing.T) {
+		codec, err := cx.NewRowBinaryCodec(cx.NewTypedView(
+			tables.AdvancedTableName(), tables.AdvancedTableColumns(), tables.AdvancedTableTypes(),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		tuple := func(tm time.Time) []interface{} {
+			return []interface{}{"String Value", uint8(5), []string{"val1", "val2", "val3"}, []interface{}{tm, uint32(5)}}
+		}
+		row := (&tables.AdvancedTable{
+			Col1:  uint8(42),
+			Col2:  "ClickHouse",
+			Col3:  "Inc",
+			Col4:  uuid.New(),
+			Col6:  []string{"Q", "W", "E", "R", "T", "Y"},
+			Col7:  tuple(now),
+			Col8:  now,
+			Col9:  "hello",
+			Col10: now,
+			Col11: int8(1),
+			Col12: now,
+			Col13: [][]interface{}{tuple(now), tuple(now)},
+		}).Row()
+		encoded, err := codec.Encode(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := cx.VectorDecoded(encoded).DecodeWith(codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// values are stored with the precision of the column type
+		seconds := time.Unix(now.Unix(), 0)
+		year, month, day := now.Date()
+		expected := cx.Vector{
+			row[0], row[1], row[2], row[3], row[4],
+			tuple(seconds),
+			seconds,
+			row[7],
+			now.Truncate(time.Millisecond),
+			true,
+			time.Date(year, month, day, 0, 0, 0, 0, time.UTC),
+			[][]interface{}{tuple(seconds), tuple(seconds)},
+		}
+		for i := range expected {
+			if !reflect.DeepEqual(stripMonotonic(expected[i]), stripMonotonic(decoded[i])) {
+				t.Fatalf("failed, column %s: expected %#v, received %#v", tables.AdvancedTableColumns()[i], expected[i], decoded[i])
+			}
+		}
+		cx.RegisterType(uuid.UUID{})
+		gob, err := row.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(encoded) >= len(gob) {
+			t.Fatalf("failed, expected rowbinary (%d bytes) to be more compact than gob (%d bytes)", len(encoded), len(gob))
+		}
+	})
+
+	t.Run("it should round-trip nullable, map and other types", func(t *testing.T) {
+		codec, err := cx.NewRowBinaryCodec(cx.NewTypedView("test_db.test_table",
+			[]string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"},
+			[]string{
+				"Int16", "Int64", "UInt64", "Float32", "Float64",
+				"Nullable(String)", "Array(Nullable(Int32))",
+				"Map(String, UInt64)", "LowCardinality(String)",
+				"DateTime64(6, 'Europe/Moscow')", "Tuple(name String, level Enum16('low' = -1000, 'high' = 1000))",
+			},
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, five := "value", int32(5)
+		tm := time.Date(2022, 5, 12, 10, 30, 15, 123456000, time.UTC)
+		row := cx.Vector{
+			int16(-300), int64(-1) << 40, uint64(1) << 63, float32(1.5), 2.25,
+			&value, []*int32{&five, nil},
+			map[string]uint64{"a": 1, "b": 2}, "low cardinality",
+			tm, []interface{}{"name", "high"},
+		}
+		encoded, err := codec.Encode(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := cx.VectorDecoded(encoded).DecodeWith(codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(row[:9], decoded[:9]) {
+			t.Fatalf("failed, expected %#v, received %#v", row[:9], decoded[:9])
+		}
+		if decodedTime := decoded[9].(time.Time); !decodedTime.Equal(tm) || decodedTime.Location().String() != "Europe/Moscow" {
+			t.Fatalf("failed, expected %s in time zone of the column, received %s", tm, decodedTime)
+		}
+		if !reflect.DeepEqual(row[10], decoded[10]) {
+			t.Fatalf("failed, expected %#v, received %#v", row[10], decoded[10])
+		}
+
+		encoded, err = codec.Encode(cx.Vector{
+			int16(0), int64(0), uint64(0), float32(0), 0.0, nil, []*int32{}, map[string]uint64{}, "", tm, []interface{}{"", "low"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded, err = cx.VectorDecoded(encoded).DecodeWith(codec); err != nil {
+			t.Fatal(err)
+		}
+		if p, ok := decoded[5].(*string); !ok || p != nil {
+			t.Fatalf("failed, expected NULL to be decoded as nil *string, received %#v", decoded[5])
+		}
+	})
+
+	t.Run("it should reject values that do not match column types", func(t *testing.T) {
+		codec, err := cx.NewRowBinaryCodec(cx.NewTypedView("test_db.test_table",
+			[]string{"a", "b", "c"}, []string{"UInt8", "FixedString(2)", "Enum8('a' = 1)"},
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range []cx.Vector{
+			{256, "ab", "a"},
+			{-1, "ab", "a"},
+			{1, "abc", "a"},
+			{1, "ab", "b"},
+			{1, "ab"},
+			{nil, "ab", "a"},
+			{"1", "ab", "a"},
+		} {
+			if _, err = codec.Encode(row); err == nil {
+				t.Fatalf("failed, expected error on %v", row)
+			}
+		}
+		if _, err = cx.NewRowBinaryCodec(cx.NewView("test_db.test_table", []string{"a"})); err == nil {
+			t.Fatal("failed, expected error on view without types")
+		}
+		if _, err = cx.NewRowBinaryCodec(cx.NewTypedView("test_db.test_table", []string{"a"}, []string{"Decimal(9, 2)"})); err == nil {
+			t.Fatal("failed, expected error on unsupported type")
+		}
+	})
+}
+
+// stripMonotonic removes monotonic clock reading and location of times, so that they can be compared with reflect.DeepEqual
+func stripMonotonic(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC().Round(0)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i := range v {
+			values[i] = stripMonotonic(v[i])
+		}
+		return values
+	case [][]interface{}:
+		values := make([]interface{}, len(v))
+		for i := range v {
+			values[i] = stripMonotonic(v[i])
+		}
+		return values
+	}
+	return value
+}
@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxredis"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+type Level uint8
+
+// nolint:funlen // it's not important here
+func TestCodec(t *testing.T) {
+	cx.RegisterType(uuid.UUID{})
+	cx.RegisterType(Level(0))
+	cx.RegisterType(map[string]uint64{})
+
+	now := time.Date(2022, 5, 12, 10, 30, 15, 123456789, time.UTC)
+	id := uuid.New()
+	row := cx.Vector{
+		1, int8(-2), int16(3), int32(-4), int64(5),
+		uint(6), uint8(7), uint16(8), uint32(9), uint64(10),
+		float32(1.5), 2.25, true, "string", nil, []byte("bytes"),
+		now, id, Level(3),
+		[]string{"a", "b"}, []int32{1, 2}, [][]interface{}{{"x", int64(1)}, {"y", nil}},
+		map[string]string{"k": "v"}, map[string]uint64{"n": 1},
+		[]interface{}{"nested", []interface{}{uint16(1), now}},
+	}
+
+	for _, name := range []string{"gob", "binary", "json"} {
+		codec, ok := cx.CodecByName(name)
+		if !ok {
+			t.Fatalf("failed, codec %s is not registered", name)
+		}
+		if byID, _ := cx.CodecByID(codec.ID()); byID == nil || byID.Name() != name {
+			t.Fatalf("failed, codec %s is not registered by identifier", name)
+		}
+		t.Run("it should round-trip values with "+name+" codec", func(t *testing.T) {
+			encoded, err := codec.Encode(row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := cx.VectorDecoded(encoded).DecodeWith(codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(decoded) != len(row) {
+				t.Fatalf("failed, expected %d columns, received %d", len(row), len(decoded))
+			}
+			for i := range row {
+				// gob does not distinguish between nil and empty values
+				if name == "gob" && row[i] == nil {
+					continue
+				}
+				if !reflect.DeepEqual(row[i], decoded[i]) {
+					t.Fatalf("failed, column %d: expected %#v, received %#v", i, row[i], decoded[i])
+				}
+			}
+		})
+	}
+
+	t.Run("it should reject unregistered types", func(t *testing.T) {
+		type unknown struct{ v int }
+		for _, codec := range []cx.Codec{cx.NewBinaryCodec(), cx.NewJSONCodec()} {
+			if _, err := codec.Encode(cx.Vector{unknown{v: 1}}); err == nil {
+				t.Fatalf("failed, expected %s codec to reject unregistered type", codec.Name())
+			}
+		}
+	})
+
+	t.Run("it should write rows through redis with custom codec", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		rdb := useMiniredis(t)
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplMock{},
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(20),
+				clickhousebuffer.WithBatchSize(2),
+			),
+		)
+		defer client.Close()
+		buf, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", client.Options().BatchSize(),
+			cxredis.WithCodec(cx.NewBinaryCodec()),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(cx.Vector{1, id, now})
+		raw := rdb.LRange(ctx, "ch_buffer:bucket", 0, -1).Val()
+		if len(raw) != 1 {
+			t.Fatalf("failed, expected one stored row, received %d", len(raw))
+		}
+		if raw[0][2] != cx.BinaryCodecID {
+			t.Fatalf("failed, expected identifier of binary codec in the envelope, received %d", raw[0][2])
+		}
+		decoded, err := cx.VectorDecoded(raw[0]).DecodeWith(cx.NewEnvelopeCodec(cx.NewBinaryCodec(), cx.View{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded[1] != id || !decoded[2].(time.Time).Equal(now) {
+			t.Fatalf("failed, expected row to be stored in binary format, received %v", decoded)
+		}
+		if rows := buf.Read(); len(rows) != 1 || rows[0][1] != id {
+			t.Fatalf("failed, expected to read the row back, received %v", rows)
+		}
+	})
+}
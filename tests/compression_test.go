@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxredis"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+func wideRow(i int) cx.Vector {
+	return cx.Vector{
+		i,
+		fmt.Sprintf("https://example.com/articles/%d?utm_source=newsletter&utm_medium=email", i),
+		strings.Repeat("Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) ", 3),
+		"ru-RU,ru;q=0.9,en-US;q=0.8,en;q=0.7",
+	}
+}
+
+// nolint:funlen // it's not important here
+func TestCompression(t *testing.T) {
+	view := cx.NewView("test_db.test_table", []string{"id", "url", "user_agent", "language"})
+
+	for _, compression := range []cx.Compression{cx.CompressionLZ4, cx.CompressionZSTD} {
+		compression := compression
+		t.Run("it should compress rows with "+compression.String(), func(t *testing.T) {
+			plain, err := cx.NewEnvelopeCodec(cx.NewGobCodec(), view).Encode(wideRow(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			codec := cx.NewEnvelopeCodec(cx.NewGobCodec(), view, cx.WithCompression(compression))
+			compressed, err := codec.Encode(wideRow(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compressed) >= len(plain) {
+				t.Fatalf("failed, expected compressed row (%d bytes) to be smaller than plain (%d bytes)", len(compressed), len(plain))
+			}
+			v, err := codec.Decode(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v, wideRow(1)) {
+				t.Fatalf("failed, expected %v, received %v", wideRow(1), v)
+			}
+			// the decoder does not need to know the compression
+			if v, err = cx.NewEnvelopeCodec(cx.NewGobCodec(), view).Decode(compressed); err != nil || v[0] != 1 {
+				t.Fatalf("failed, expected to decode without compression option, received %v: %v", v, err)
+			}
+		})
+	}
+
+	t.Run("it should store incompressible rows as is", func(t *testing.T) {
+		codec := cx.NewEnvelopeCodec(cx.NewBinaryCodec(), cx.View{}, cx.WithCompression(cx.CompressionZSTD))
+		encoded, err := codec.Encode(cx.Vector{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flags := encoded[3]; flags != byte(cx.CompressionNone) {
+			t.Fatalf("failed, expected row to be stored without compression, received flags %d", flags)
+		}
+		if v, decodeErr := codec.Decode(encoded); decodeErr != nil || v[0] != 1 {
+			t.Fatalf("failed, expected to decode row, received %v: %v", v, decodeErr)
+		}
+	})
+
+	t.Run("it should decode envelopes of the first version", func(t *testing.T) {
+		payload, err := cx.NewBinaryCodec().Encode(cx.Vector{1, "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprint := make([]byte, 4)
+		binary.BigEndian.PutUint32(fingerprint, cx.NewView("test_db.test_table", []string{"id", "uuid"}).Fingerprint())
+		v1 := append(append([]byte{0xCB, 1, cx.BinaryCodecID}, fingerprint...), payload...)
+		v, err := cx.NewEnvelopeCodec(cx.NewGobCodec(), cx.NewView("test_db.test_table", []string{"id", "uuid"})).Decode(v1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v[0] != 1 || v[1] != "1" {
+			t.Fatalf("failed, expected to decode row, received %v", v)
+		}
+	})
+
+	t.Run("it should store rows in compressed micro-batches", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		rdb := useMiniredis(t)
+		buf, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 100,
+			cxredis.WithView(view), cxredis.WithCompression(cx.CompressionZSTD), cxredis.WithMicroBatch(10),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 25; i++ {
+			buf.Write(wideRow(i))
+		}
+		if size := rdb.LLen(ctx, "ch_buffer:bucket").Val(); size != 2 {
+			t.Fatalf("failed, expected two complete blocks, received %d", size)
+		}
+		if buf.Len() != 25 {
+			t.Fatalf("failed, expected length of 25 rows, received %d", buf.Len())
+		}
+		var blocks int
+		for _, value := range rdb.LRange(ctx, "ch_buffer:bucket", 0, -1).Val() {
+			blocks += len(value)
+		}
+		single, _ := cx.NewEnvelopeCodec(cx.NewGobCodec(), view, cx.WithCompression(cx.CompressionZSTD)).Encode(wideRow(0))
+		if blocks >= 20*len(single) {
+			t.Fatalf("failed, expected blocks (%d bytes) to be smaller than rows compressed one by one (%d bytes)", blocks, 20*len(single))
+		}
+		// the buffer without micro-batches reads blocks as well
+		reader, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 100, cxredis.WithView(view), cxredis.WithConsumer("reader"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows := reader.Read(); len(rows) != 20 || !reflect.DeepEqual(rows[19], wideRow(19)) {
+			t.Fatalf("failed, expected to read two blocks, received %d rows", len(rows))
+		}
+		reader.Flush()
+		rows := buf.Read()
+		if len(rows) != 5 || !reflect.DeepEqual(rows[0], wideRow(20)) {
+			t.Fatalf("failed, expected incomplete block to be stored on read, received %d rows", len(rows))
+		}
+		buf.Flush()
+		if buf.Len() != 0 {
+			t.Fatalf("failed, expected empty buffer, received %d", buf.Len())
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxredis"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// nolint:funlen // it's not important here
+func TestEncryption(t *testing.T) {
+	view := cx.NewView("test_db.test_table", []string{"id", "user_id"})
+	first, second := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+
+	t.Run("it should encrypt rows with the current key", func(t *testing.T) {
+		keys, err := cx.NewKeyRing("k1", first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec := cx.NewEnvelopeCodec(cx.NewGobCodec(), view, cx.WithEncryption(keys))
+		encoded, err := codec.Encode(cx.Vector{1, "user-secret-identifier"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(encoded, []byte("user-secret-identifier")) {
+			t.Fatal("failed, expected row to be encrypted")
+		}
+		if encoded[1] != cx.EnvelopeVersion || !bytes.Contains(encoded, []byte("k1")) {
+			t.Fatalf("failed, expected encrypted envelope with key id, received %v", encoded[:12])
+		}
+		v, err := codec.Decode(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v[1] != "user-secret-identifier" {
+			t.Fatalf("failed, expected to decrypt row, received %v", v)
+		}
+		if _, err = cx.NewEnvelopeCodec(cx.NewGobCodec(), view).Decode(encoded); !errors.Is(err, cx.ErrEncrypted) {
+			t.Fatalf("failed, expected error without key provider, received %v", err)
+		}
+	})
+
+	t.Run("it should decrypt rows encrypted with previous keys after rotation", func(t *testing.T) {
+		keys, err := cx.NewKeyRing("k1", first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec := cx.NewEnvelopeCodec(cx.NewGobCodec(), view, cx.WithEncryption(keys))
+		old, err := codec.Encode(cx.Vector{1, "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = keys.Rotate("k2", second); err != nil {
+			t.Fatal(err)
+		}
+		current, err := codec.Encode(cx.Vector{2, "2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(current, []byte("k2")) {
+			t.Fatal("failed, expected new rows to be encrypted with the new key")
+		}
+		for _, encoded := range [][]byte{old, current} {
+			if _, err = codec.Decode(encoded); err != nil {
+				t.Fatal(err)
+			}
+		}
+		keys.Remove("k1")
+		if _, err = codec.Decode(old); !errors.Is(err, cx.ErrUnknownKey) {
+			t.Fatalf("failed, expected unknown key error, received %v", err)
+		}
+	})
+
+	t.Run("it should reject tampered rows", func(t *testing.T) {
+		keys, err := cx.NewKeyRing("k1", first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codec := cx.NewEnvelopeCodec(cx.NewGobCodec(), cx.View{}, cx.WithEncryption(keys))
+		encoded, err := codec.Encode(cx.Vector{1, "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range []int{2, 5, len(encoded) - 1} {
+			tampered := append([]byte{}, encoded...)
+			tampered[i] ^= 0xFF
+			if _, err = codec.Decode(tampered); err == nil {
+				t.Fatalf("failed, expected error on tampered byte %d", i)
+			}
+		}
+		if _, err = cx.NewKeyRing("k1", []byte("short")); err == nil {
+			t.Fatal("failed, expected error on invalid key size")
+		}
+	})
+
+	t.Run("it should store encrypted and compressed rows in redis", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		rdb := useMiniredis(t)
+		keys, err := cx.NewKeyRing("k1", first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 10,
+			cxredis.WithView(view), cxredis.WithCompression(cx.CompressionZSTD), cxredis.WithEncryption(keys),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identifier := strings.Repeat("user-secret-identifier", 10)
+		buf.Write(cx.Vector{1, identifier})
+		for _, value := range rdb.LRange(ctx, "ch_buffer:bucket", 0, -1).Val() {
+			if strings.Contains(value, "user-secret-identifier") {
+				t.Fatal("failed, expected row to be stored encrypted")
+			}
+		}
+		rows := buf.Read()
+		if len(rows) != 1 || rows[0][1] != identifier {
+			t.Fatalf("failed, expected to read decrypted row, received %v", rows)
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxredis"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// nolint:funlen // it's not important here
+func TestEnvelope(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	previous := cx.NewView("test_db.test_table", []string{"id", "uuid"})
+	current := cx.NewView("test_db.test_table", []string{"uuid", "id", "insert_ts"})
+
+	t.Run("it should read rows written without envelope", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		legacy, err := cx.Vector{1, "1"}.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdb.RPush(ctx, "ch_buffer:bucket", []byte(legacy))
+		buf, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 10, cxredis.WithView(previous))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(cx.Vector{2, "2"})
+		rows := buf.Read()
+		if len(rows) != 2 || rows[0][1] != "1" || rows[1][1] != "2" {
+			t.Fatalf("failed, expected to read legacy and enveloped rows, received %v", rows)
+		}
+	})
+
+	t.Run("it should reject rows written for another view", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		old, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 10, cxredis.WithView(previous), cxredis.WithConsumer("pod-0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old.Write(cx.Vector{1, "1"})
+		updated, err := cxredis.NewSafeBuffer(ctx, rdb, "bucket", 10, cxredis.WithView(current), cxredis.WithConsumer("pod-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated.Write(cx.Vector{"2", 2, "now"})
+		rows := updated.Read()
+		if len(rows) != 1 || rows[0][0] != "2" {
+			t.Fatalf("failed, expected to read only rows of current view, received %v", rows)
+		}
+		rejected := rdb.LRange(ctx, cxredis.RejectedKey("bucket"), 0, -1).Val()
+		if len(rejected) != 1 {
+			t.Fatalf("failed, expected one row in dead-letter list, received %d", len(rejected))
+		}
+		if v, decodeErr := cx.VectorDecoded(rejected[0]).DecodeWith(cx.NewEnvelopeCodec(cx.NewGobCodec(), previous)); decodeErr != nil || v[0] != 1 {
+			t.Fatalf("failed, expected rejected row to be stored as is, received %v: %v", v, decodeErr)
+		}
+	})
+
+	t.Run("it should migrate rows written for previous view", func(t *testing.T) {
+		rdb := useMiniredis(t)
+		typedPrevious := cx.NewTypedView(previous.Name, previous.Columns, []string{"Int64", "String"})
+		codec, err := cx.NewRowBinaryCodec(typedPrevious)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old, err := cxredis.NewBuffer(ctx, rdb, "bucket", 10, cxredis.WithView(typedPrevious), cxredis.WithCodec(codec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		old.Write(cx.Vector{int64(1), "1"})
+		updated, err := cxredis.NewBuffer(ctx, rdb, "bucket", 10, cxredis.WithCodec(
+			cx.NewEnvelopeCodec(cx.NewGobCodec(), current, cx.WithMigration(typedPrevious, func(v cx.Vector) (cx.Vector, error) {
+				return cx.Vector{v[1], v[0], "unknown"}, nil
+			})),
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+		updated.Write(cx.Vector{"2", int64(2), "now"})
+		rows := updated.Read()
+		if len(rows) != 2 || rows[0][0] != "1" || rows[0][1] != int64(1) || rows[0][2] != "unknown" || rows[1][0] != "2" {
+			t.Fatalf("failed, expected migrated and current rows, received %v", rows)
+		}
+	})
+
+	t.Run("it should decode rows of other registered codecs", func(t *testing.T) {
+		encoded, err := cx.NewEnvelopeCodec(cx.NewJSONCodec(), previous).Encode(cx.Vector{1, "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := cx.VectorDecoded(encoded).DecodeWith(cx.NewEnvelopeCodec(cx.NewGobCodec(), previous))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v[0] != 1 || v[1] != "1" {
+			t.Fatalf("failed, expected row encoded with json, received %v", v)
+		}
+	})
+
+	t.Run("it should decode many rows encoded with row binary by other instances", func(t *testing.T) {
+		typedPrevious := cx.NewTypedView(previous.Name, previous.Columns, []string{"Int64", "String"})
+		rowBinary, err := cx.NewRowBinaryCodec(typedPrevious)
+		if err != nil {
+			t.Fatal(err)
+		}
+		foreign := cx.NewEnvelopeCodec(rowBinary, typedPrevious)
+		own := cx.NewEnvelopeCodec(cx.NewGobCodec(), typedPrevious)
+		for i := int64(0); i < 3; i++ {
+			encoded, encodeErr := foreign.Encode(cx.Vector{i, "row"})
+			if encodeErr != nil {
+				t.Fatal(encodeErr)
+			}
+			v, decodeErr := cx.VectorDecoded(encoded).DecodeWith(own)
+			if decodeErr != nil {
+				t.Fatal(decodeErr)
+			}
+			if v[0] != i || v[1] != "row" {
+				t.Fatalf("failed, expected row encoded with row binary, received %v", v)
+			}
+		}
+	})
+
+	t.Run("it should reject unknown versions and codecs", func(t *testing.T) {
+		codec := cx.NewEnvelopeCodec(cx.NewGobCodec(), previous)
+		encoded, err := codec.Encode(cx.Vector{1, "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		newer := append([]byte{}, encoded...)
+		newer[1] = cx.EnvelopeVersion + 1
+		if _, err = codec.Decode(newer); !errors.Is(err, cx.ErrUnsupportedEnvelope) {
+			t.Fatalf("failed, expected unsupported envelope error, received %v", err)
+		}
+		unknown := append([]byte{}, encoded...)
+		unknown[2] = 200
+		if _, err = codec.Decode(unknown); !errors.Is(err, cx.ErrUnknownCodec) {
+			t.Fatalf("failed, expected unknown codec error, received %v", err)
+		}
+		if _, err = cx.NewEnvelopeCodec(cx.NewGobCodec(), current).Decode(encoded); !errors.Is(err, cx.ErrSchemaMismatch) {
+			t.Fatalf("failed, expected schema mismatch error, received %v", err)
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+	"github.com/zikwall/clickhouse-buffer/v4/src/metrics"
+	"github.com/zikwall/clickhouse-buffer/v4/src/retry"
+)
+
+// nolint:funlen,gocognit // it's not important here
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id"})
+	view := metrics.Label{Name: metrics.LabelView, Value: tableView.Name}
+
+	t.Run("it should write metrics in the Prometheus text format", func(t *testing.T) {
+		registry := metrics.NewRegistry(1, 0.1)
+		quoted := metrics.Label{Name: metrics.LabelView, Value: `db."t"`}
+		registry.Add(metrics.RowsReceived, 2, quoted)
+		registry.Set(metrics.RetryQueueDepth, 3)
+		for _, value := range []float64{0.25, 0.5, 4} {
+			registry.Observe(metrics.InsertDuration, value, quoted)
+		}
+		recorder := httptest.NewRecorder()
+		registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		expected := strings.Join([]string{
+			"# HELP clickhouse_buffer_insert_duration_seconds Duration of inserts and retry cycles in seconds.",
+			"# TYPE clickhouse_buffer_insert_duration_seconds histogram",
+			`clickhouse_buffer_insert_duration_seconds_bucket{view="db.\"t\"",le="0.1"} 0`,
+			`clickhouse_buffer_insert_duration_seconds_bucket{view="db.\"t\"",le="1"} 2`,
+			`clickhouse_buffer_insert_duration_seconds_bucket{view="db.\"t\"",le="+Inf"} 3`,
+			`clickhouse_buffer_insert_duration_seconds_sum{view="db.\"t\""} 4.75`,
+			`clickhouse_buffer_insert_duration_seconds_count{view="db.\"t\""} 3`,
+			"# HELP clickhouse_buffer_retry_queue_depth Packets waiting in the retry queue.",
+			"# TYPE clickhouse_buffer_retry_queue_depth gauge",
+			"clickhouse_buffer_retry_queue_depth 3",
+			"# HELP clickhouse_buffer_rows_received_total Rows written to the buffer of the writer.",
+			"# TYPE clickhouse_buffer_rows_received_total counter",
+			`clickhouse_buffer_rows_received_total{view="db.\"t\""} 2`,
+		}, "\n") + "\n"
+		if body := recorder.Body.String(); body != expected {
+			t.Fatalf("failed, unexpected exposition:\n%s", body)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+			t.Fatalf("failed, unexpected content type %s", contentType)
+		}
+	})
+
+	t.Run("it should collect metrics of the writer", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplRecordMock{}, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(100),
+			clickhousebuffer.WithMetrics(registry),
+		))
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(100))
+		for i := 0; i < 3; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+		if err := writeAPI.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		received, flushed := registry.Value(metrics.RowsReceived, view), registry.Value(metrics.RowsFlushed, view)
+		if received != 3 || flushed != 3 {
+			t.Fatalf("failed, expected 3 received and flushed rows, received %v and %v", received, flushed)
+		}
+		batches, length := registry.Value(metrics.Batches, view), registry.Value(metrics.BufferLength, view)
+		if batches != 1 || length != 0 {
+			t.Fatalf("failed, expected one batch and empty buffer, received %v and %v", batches, length)
+		}
+		recorder := httptest.NewRecorder()
+		registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		count := `clickhouse_buffer_insert_duration_seconds_count{view="test_db.test_table"} 1`
+		if body := recorder.Body.String(); !strings.Contains(body, count) {
+			t.Fatalf("failed, expected duration of the insert, received:\n%s", body)
+		}
+	})
+
+	t.Run("it should count the length of the buffer without asking the engine", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplRecordMock{}, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(100),
+			clickhousebuffer.WithMetrics(registry),
+		))
+		defer client.Close()
+		engine := &bufferLenMock{Buffer: cxsyncmem.NewBuffer(100)}
+		writeAPI := client.Writer(ctx, tableView, engine)
+		for i := 0; i < 3; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+		simulateWait(time.Millisecond * 50)
+		if length := registry.Value(metrics.BufferLength, view); length != 3 {
+			t.Fatalf("failed, expected three rows in the buffer, received %v", length)
+		}
+		if lens := atomic.LoadInt32(&engine.lens); lens != 0 {
+			t.Fatalf("failed, expected length of the engine not to be requested, received %d requests", lens)
+		}
+	})
+
+	t.Run("it should drop samples of the metric used as another type", func(t *testing.T) {
+		var logs strings.Builder
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+		registry := metrics.NewRegistry()
+		registry.Add(metrics.Drops, 1)
+		registry.Set(metrics.Drops, 5)
+		registry.Set(metrics.Drops, 6)
+		registry.Observe(metrics.Drops, 0.1)
+		var body strings.Builder
+		if err := registry.WritePrometheus(&body); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(body.String(), metrics.Drops+" 1\n") || strings.Contains(body.String(), "_bucket") {
+			t.Fatalf("failed, expected the counter to be kept, received:\n%s", body.String())
+		}
+		if conflicts := strings.Count(logs.String(), "samples of"); conflicts != 2 {
+			t.Fatalf("failed, expected every conflict to be logged once, received:\n%s", logs.String())
+		}
+	})
+
+	t.Run("it should collect metrics of errors, retries and drops", func(t *testing.T) {
+		registry := metrics.NewRegistry()
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMock{}, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(1),
+			clickhousebuffer.WithRetry(true), clickhousebuffer.WithMetrics(registry),
+		))
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		var lost *retry.LostError
+		if err := waitAck(t, writeAPI.WriteVectorAck(ctx, cx.Vector{1})); !errors.As(err, &lost) {
+			t.Fatalf("failed, expected packet to be lost, received %v", err)
+		}
+		if failures := registry.Value(metrics.Errors, view, metrics.Label{Name: metrics.LabelCode, Value: "1002"}); failures != 1 {
+			t.Fatalf("failed, expected one error with code 1002, received %v", failures)
+		}
+		if retries, drops := registry.Value(metrics.Retries, view), registry.Value(metrics.Drops, view); retries < 2 || drops != 1 {
+			t.Fatalf("failed, expected retries and one dropped row, received %v and %v", retries, drops)
+		}
+		if depth := registry.Value(metrics.RetryQueueDepth); depth != 0 {
+			t.Fatalf("failed, expected empty retry queue, received %v", depth)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxfile"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+func waitAck(t *testing.T, ack *clickhousebuffer.Ack) error {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err := ack.Wait(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("failed, expected acknowledgement to be resolved")
+	}
+	return err
+}
+
+// nolint:funlen,gocognit // it's not important here
+func TestWriterAck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id"})
+
+	t.Run("it should resolve acknowledgement once the batch is inserted", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(4)),
+		)
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(4))
+		writeAPI.WriteVector(cx.Vector{1})
+		first := writeAPI.WriteVectorAck(ctx, cx.Vector{2})
+		simulateWait(time.Millisecond * 20)
+		select {
+		case <-first.Done():
+			t.Fatal("failed, expected acknowledgement not to be resolved before the batch is flushed")
+		default:
+		}
+		writeAPI.WriteVector(cx.Vector{3})
+		second := writeAPI.WriteRowAck(ctx, RowMock{id: 4})
+		for _, ack := range []*clickhousebuffer.Ack{first, second} {
+			if err := waitAck(t, ack); err != nil {
+				t.Fatalf("failed, expected row to be acknowledged, received %v", err)
+			}
+		}
+		if rows := mock.Rows(); len(rows) != 4 {
+			t.Fatalf("failed, expected buffered and acknowledged rows in one batch, received %v", rows)
+		}
+	})
+
+	t.Run("it should resolve acknowledgement with error that cannot be retried", func(t *testing.T) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMockFailed{},
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10),
+				clickhousebuffer.WithBatchSize(1),
+				clickhousebuffer.WithRetry(true),
+			),
+		)
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		if err := waitAck(t, writeAPI.WriteVectorAck(ctx, cx.Vector{1})); !errors.Is(err, errClickhouseUnknownTableException) {
+			t.Fatalf("failed, expected insert error, received %v", err)
+		}
+	})
+
+	t.Run("it should resolve acknowledgement with the final error after retries", func(t *testing.T) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMock{},
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10),
+				clickhousebuffer.WithBatchSize(1),
+				clickhousebuffer.WithRetry(true),
+			),
+		)
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		if err := waitAck(t, writeAPI.WriteVectorAck(ctx, cx.Vector{1})); !errors.Is(err, errClickhouseUnknownException) {
+			t.Fatalf("failed, expected insert error, received %v", err)
+		}
+		if _, failed, _ := client.RetryClient().Metrics(); failed != 1 {
+			t.Fatalf("failed, expected packet to be lost after retries, received %d", failed)
+		}
+	})
+
+	t.Run("it should resolve acknowledgement once the batch is retried successfully", func(t *testing.T) {
+		mock := &ClickhouseImplRetryMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10),
+				clickhousebuffer.WithBatchSize(1),
+				clickhousebuffer.WithRetry(true),
+			),
+		)
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		ack := writeAPI.WriteVectorAck(ctx, cx.Vector{1})
+		simulateWait(time.Millisecond * 50)
+		if ack.Err() != nil {
+			t.Fatalf("failed, expected acknowledgement to wait for retries, received %v", ack.Err())
+		}
+		atomic.StoreInt32(&mock.hasErr, 1)
+		if err := waitAck(t, ack); err != nil {
+			t.Fatalf("failed, expected row to be acknowledged after retry, received %v", err)
+		}
+	})
+
+	t.Run("it should resolve acknowledgement of rows rejected by writer", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(10)),
+		)
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(10))
+		pending := writeAPI.WriteVectorAck(ctx, cx.Vector{1})
+		writeAPI.Close()
+		if err := waitAck(t, pending); err != nil || len(mock.Rows()) != 1 {
+			t.Fatalf("failed, expected pending row to be inserted on close, received %v", err)
+		}
+		if err := waitAck(t, writeAPI.WriteVectorAck(ctx, cx.Vector{2})); !errors.Is(err, clickhousebuffer.ErrWriterClosed) {
+			t.Fatalf("failed, expected writer closed error, received %v", err)
+		}
+		client.Close()
+
+		stalled, client, writeAPI, _ := useStalledWriter(t, ctx,
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureDropOldest),
+		)
+		evicted := writeAPI.WriteVectorAck(ctx, cx.Vector{4})
+		writeAPI.WriteVector(cx.Vector{5})
+		writeAPI.WriteVector(cx.Vector{6})
+		if err := waitAck(t, evicted); !errors.Is(err, clickhousebuffer.ErrRowEvicted) {
+			t.Fatalf("failed, expected evicted row error, received %v", err)
+		}
+		close(stalled.release)
+		client.Close()
+	})
+	t.Run("it should limit rows waiting for acknowledgement while spilling engine keeps rows", func(t *testing.T) {
+		mock := &ClickhouseImplBlockMock{release: make(chan struct{})}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000),
+			clickhousebuffer.WithBatchSize(2),
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureDropNewest),
+		))
+		buf, err := cxfile.NewTieredBuffer(t.TempDir(), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAPI := client.Writer(ctx, tableView, buf)
+		// the first batch is being inserted, the next one waits for the pipeline, the last row exceeds the limit
+		acks := make([]*clickhousebuffer.Ack, 0, 5)
+		for i := 0; i < 5; i++ {
+			acks = append(acks, writeAPI.WriteVectorAck(ctx, cx.Vector{i}))
+			simulateWait(time.Millisecond * 10)
+		}
+		if err = waitAck(t, acks[4]); !errors.Is(err, clickhousebuffer.ErrQueueFull) {
+			t.Fatalf("failed, expected queue full error, received %v", err)
+		}
+		if dropped := writeAPI.Dropped(); dropped != 1 {
+			t.Fatalf("failed, expected one dropped row, received %d", dropped)
+		}
+		close(mock.release)
+		client.Close()
+		for _, ack := range acks[:4] {
+			if err = waitAck(t, ack); err != nil {
+				t.Fatalf("failed, expected row to be acknowledged, received %v", err)
+			}
+		}
+		if rows := mock.Rows(); len(rows) != 4 {
+			t.Fatalf("failed, expected four rows to be inserted, received %v", rows)
+		}
+	})
+}
@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+var errClickhouseMemoryLimitException = &clickhouse.Exception{
+	Code:       241,
+	Name:       "MEMORY_LIMIT_EXCEEDED",
+	Message:    "MEMORY_LIMIT_EXCEEDED",
+	StackTrace: "MEMORY_LIMIT_EXCEEDED == MEMORY_LIMIT_EXCEEDED",
+}
+
+type ClickhouseImplOverloadMock struct{}
+
+func (co *ClickhouseImplOverloadMock) Insert(_ context.Context, _ cx.View, _ []cx.Vector) (uint64, error) {
+	return 0, errClickhouseMemoryLimitException
+}
+
+func (co *ClickhouseImplOverloadMock) Close() error {
+	return nil
+}
+
+func (co *ClickhouseImplOverloadMock) Conn() driver.Conn {
+	return nil
+}
+
+// nolint:funlen // it's not important here
+func TestWriterAdaptiveBatching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id"})
+
+	useWriter := func(ch cx.Clickhouse, opts ...clickhousebuffer.Option) (clickhousebuffer.Client, clickhousebuffer.Writer) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, ch, clickhousebuffer.NewOptions(append([]clickhousebuffer.Option{
+			clickhousebuffer.WithAdaptiveBatchSize(10, 40),
+			clickhousebuffer.WithAdaptiveFlushInterval(100, 400),
+		}, opts...)...))
+		return client, client.Writer(ctx, tableView, cxsyncmem.NewBuffer(10))
+	}
+
+	writeRows := func(writeAPI clickhousebuffer.Writer, count int) {
+		for i := 0; i < count; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+	}
+
+	t.Run("it should keep effective values within bounds", func(t *testing.T) {
+		client, writeAPI := useWriter(&ClickhouseImplMock{},
+			clickhousebuffer.WithBatchSize(5), clickhousebuffer.WithFlushInterval(10000),
+		)
+		defer client.Close()
+		if writeAPI.BatchSize() != 10 || writeAPI.FlushInterval() != 400 {
+			t.Fatalf("failed, expected values to be clamped, received %d and %d", writeAPI.BatchSize(), writeAPI.FlushInterval())
+		}
+		static := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplMock{}, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithBatchSize(5), clickhousebuffer.WithFlushInterval(10000),
+		))
+		defer static.Close()
+		staticAPI := static.Writer(ctx, tableView, cxsyncmem.NewBuffer(5))
+		if staticAPI.BatchSize() != 5 || staticAPI.FlushInterval() != 10000 {
+			t.Fatalf("failed, expected values of options, received %d and %d", staticAPI.BatchSize(), staticAPI.FlushInterval())
+		}
+	})
+
+	t.Run("it should disable adaptive batching with invalid bounds", func(t *testing.T) {
+		for _, opts := range [][]clickhousebuffer.Option{
+			{clickhousebuffer.WithAdaptiveBatchSize(40, 10)},
+			{clickhousebuffer.WithAdaptiveBatchSize(0, 40)},
+			{clickhousebuffer.WithAdaptiveFlushInterval(400, 100)},
+			{clickhousebuffer.WithAdaptiveFlushInterval(0, 400)},
+		} {
+			logger := &loggerMock{}
+			client, writeAPI := useWriter(&ClickhouseImplMock{}, append(opts,
+				clickhousebuffer.WithBatchSize(5), clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithLogger(logger),
+			)...)
+			if writeAPI.BatchSize() != 5 || writeAPI.FlushInterval() != 10000 {
+				t.Fatalf("failed, expected values of options, received %d and %d", writeAPI.BatchSize(), writeAPI.FlushInterval())
+			}
+			if logger.Len() != 1 || !strings.Contains(logger.messages[0], clickhousebuffer.ErrInvalidAdaptiveBounds.Error()) {
+				t.Fatalf("failed, expected invalid bounds to be logged, received %v", logger.messages)
+			}
+			client.Close()
+		}
+	})
+
+	t.Run("it should grow batches while inserts are fast", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client, writeAPI := useWriter(mock, clickhousebuffer.WithBatchSize(10), clickhousebuffer.WithFlushInterval(100))
+		writeRows(writeAPI, 100)
+		client.Close()
+		if size := writeAPI.BatchSize(); size <= 10 || size > 40 {
+			t.Fatalf("failed, expected batch size to grow within bounds, received %d", size)
+		}
+		if interval := writeAPI.FlushInterval(); interval <= 100 || interval > 400 {
+			t.Fatalf("failed, expected flush interval to grow within bounds, received %d", interval)
+		}
+		if rows := mock.Rows(); len(rows) != 100 {
+			t.Fatalf("failed, expected all rows to be inserted, received %d", len(rows))
+		}
+	})
+
+	t.Run("it should shrink batches while inserts are slow", func(t *testing.T) {
+		mock := &ClickhouseImplSlowMock{delay: func(_ cx.Vector) time.Duration {
+			return time.Millisecond * 20
+		}}
+		client, writeAPI := useWriter(mock,
+			clickhousebuffer.WithBatchSize(40),
+			clickhousebuffer.WithFlushInterval(400),
+			clickhousebuffer.WithTargetLatency(time.Millisecond*5),
+		)
+		writeRows(writeAPI, 100)
+		client.Close()
+		if size := writeAPI.BatchSize(); size >= 40 || size < 10 {
+			t.Fatalf("failed, expected batch size to shrink within bounds, received %d", size)
+		}
+		if interval := writeAPI.FlushInterval(); interval >= 400 {
+			t.Fatalf("failed, expected flush interval to shrink, received %d", interval)
+		}
+	})
+
+	t.Run("it should shrink batches to minimum on overload errors", func(t *testing.T) {
+		client, writeAPI := useWriter(&ClickhouseImplOverloadMock{},
+			clickhousebuffer.WithBatchSize(40), clickhousebuffer.WithFlushInterval(400),
+		)
+		writeRows(writeAPI, 100)
+		client.Close()
+		if writeAPI.BatchSize() != 10 || writeAPI.FlushInterval() != 100 {
+			t.Fatalf("failed, expected minimal values, received %d and %d", writeAPI.BatchSize(), writeAPI.FlushInterval())
+		}
+	})
+
+	t.Run("it should detect overload errors", func(t *testing.T) {
+		for err, expected := range map[error]bool{
+			errClickhouseMemoryLimitException:                           true,
+			fmt.Errorf("insert: %w", errClickhouseMemoryLimitException): true,
+			context.DeadlineExceeded:                                    true,
+			errClickhouseUnknownTableException:                          false,
+			errClickhouseUnknownException:                               false,
+		} {
+			if cx.IsOverload(err) != expected {
+				t.Fatalf("failed, expected overload to be %v for %v", expected, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,209 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+type droppedRows struct {
+	mu      sync.Mutex
+	rows    []cx.Vector
+	reasons []error
+}
+
+func (d *droppedRows) add(row cx.Vector, reason error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rows = append(d.rows, row)
+	d.reasons = append(d.reasons, reason)
+}
+
+func (d *droppedRows) get() ([]cx.Vector, []error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]cx.Vector{}, d.rows...), append([]error{}, d.reasons...)
+}
+
+// useStalledWriter returns the writer, whose Clickhouse is stalled and whose intake queue of two rows is full
+func useStalledWriter(
+	t *testing.T, ctx context.Context, opts ...clickhousebuffer.Option,
+) (*ClickhouseImplBlockMock, clickhousebuffer.Client, clickhousebuffer.Writer, *droppedRows) {
+	t.Helper()
+	mock := &ClickhouseImplBlockMock{release: make(chan struct{})}
+	dropped := &droppedRows{}
+	client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(append([]clickhousebuffer.Option{
+		clickhousebuffer.WithFlushInterval(10000),
+		clickhousebuffer.WithBatchSize(1),
+		clickhousebuffer.WithQueueSize(2),
+		clickhousebuffer.WithDropCallback(dropped.add),
+	}, opts...)...))
+	writeAPI := client.Writer(ctx, cx.NewView("test_db.test_table", []string{"id"}), cxsyncmem.NewBuffer(1))
+	// the first row is being inserted, the second one is being flushed
+	writeAPI.WriteVector(cx.Vector{0})
+	simulateWait(time.Millisecond * 20)
+	writeAPI.WriteVector(cx.Vector{1})
+	simulateWait(time.Millisecond * 20)
+	writeAPI.WriteVector(cx.Vector{2})
+	writeAPI.WriteVector(cx.Vector{3})
+	return mock, client, writeAPI, dropped
+}
+
+func insertedIDs(mock *ClickhouseImplBlockMock) []interface{} {
+	rows := mock.Rows()
+	ids := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row[0])
+	}
+	return ids
+}
+
+// nolint:funlen,gocognit // it's not important here
+func TestWriterBackpressure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("it should block producers by default", func(t *testing.T) {
+		mock, client, writeAPI, _ := useStalledWriter(t, ctx)
+		written := make(chan struct{})
+		go func() {
+			writeAPI.WriteVector(cx.Vector{4})
+			close(written)
+		}()
+		select {
+		case <-written:
+			t.Fatal("failed, expected producer to be blocked")
+		case <-time.After(time.Millisecond * 50):
+		}
+		close(mock.release)
+		<-written
+		client.Close()
+		if ids := insertedIDs(mock); len(ids) != 5 || writeAPI.Dropped() != 0 {
+			t.Fatalf("failed, expected all rows to be inserted, received %v", ids)
+		}
+	})
+
+	t.Run("it should drop rows after block timeout", func(t *testing.T) {
+		mock, client, writeAPI, dropped := useStalledWriter(t, ctx,
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureBlockTimeout),
+			clickhousebuffer.WithBlockTimeout(time.Millisecond*20),
+		)
+		start := time.Now()
+		writeAPI.WriteVector(cx.Vector{4})
+		if elapsed := time.Since(start); elapsed < time.Millisecond*20 {
+			t.Fatalf("failed, expected producer to wait for timeout, waited %s", elapsed)
+		}
+		rows, reasons := dropped.get()
+		if writeAPI.Dropped() != 1 || len(rows) != 1 || rows[0][0] != 4 || !errors.Is(reasons[0], clickhousebuffer.ErrQueueFull) {
+			t.Fatalf("failed, expected the row to be dropped, received %v: %v", rows, reasons)
+		}
+		close(mock.release)
+		client.Close()
+		if ids := insertedIDs(mock); len(ids) != 4 {
+			t.Fatalf("failed, expected four rows to be inserted, received %v", ids)
+		}
+	})
+
+	t.Run("it should drop newest rows", func(t *testing.T) {
+		mock, client, writeAPI, dropped := useStalledWriter(t, ctx,
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureDropNewest),
+		)
+		writeAPI.WriteVector(cx.Vector{4})
+		writeAPI.WriteVector(cx.Vector{5})
+		rows, reasons := dropped.get()
+		if writeAPI.Dropped() != 2 || len(rows) != 2 || rows[0][0] != 4 || rows[1][0] != 5 {
+			t.Fatalf("failed, expected newest rows to be dropped, received %v", rows)
+		}
+		if !errors.Is(reasons[0], clickhousebuffer.ErrQueueFull) {
+			t.Fatalf("failed, expected queue full reason, received %v", reasons[0])
+		}
+		close(mock.release)
+		client.Close()
+		if ids := insertedIDs(mock); len(ids) != 4 || ids[3] != 3 {
+			t.Fatalf("failed, expected first four rows to be inserted, received %v", ids)
+		}
+	})
+
+	t.Run("it should drop oldest rows", func(t *testing.T) {
+		mock, client, writeAPI, dropped := useStalledWriter(t, ctx,
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureDropOldest),
+		)
+		writeAPI.WriteVector(cx.Vector{4})
+		writeAPI.WriteVector(cx.Vector{5})
+		rows, reasons := dropped.get()
+		if writeAPI.Dropped() != 2 || len(rows) != 2 || rows[0][0] != 2 || rows[1][0] != 3 {
+			t.Fatalf("failed, expected oldest queued rows to be dropped, received %v", rows)
+		}
+		if !errors.Is(reasons[0], clickhousebuffer.ErrRowEvicted) {
+			t.Fatalf("failed, expected evicted reason, received %v", reasons[0])
+		}
+		close(mock.release)
+		client.Close()
+		if ids := insertedIDs(mock); len(ids) != 4 || ids[2] != 4 || ids[3] != 5 {
+			t.Fatalf("failed, expected newest rows to be inserted, received %v", ids)
+		}
+	})
+
+	t.Run("it should not spin while concurrent writers drop oldest rows", func(t *testing.T) {
+		mock, client, writeAPI, dropped := useStalledWriter(t, ctx,
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureDropOldest),
+		)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					writeAPI.WriteVector(cx.Vector{j})
+				}
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second * 5):
+			t.Fatal("failed, expected concurrent writers not to wait")
+		}
+		_, reasons := dropped.get()
+		for _, reason := range reasons {
+			if !errors.Is(reason, clickhousebuffer.ErrRowEvicted) && !errors.Is(reason, clickhousebuffer.ErrQueueFull) {
+				t.Fatalf("failed, expected evicted or queue full reason, received %v", reason)
+			}
+		}
+		close(mock.release)
+		client.Close()
+		if total := uint64(len(insertedIDs(mock))) + writeAPI.Dropped(); total != 804 {
+			t.Fatalf("failed, expected every row to be inserted or dropped, received %d", total)
+		}
+	})
+
+	t.Run("it should reject rows with error", func(t *testing.T) {
+		mock, client, writeAPI, dropped := useStalledWriter(t, ctx,
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureError),
+		)
+		start := time.Now()
+		writeAPI.WriteVector(cx.Vector{4})
+		if elapsed := time.Since(start); elapsed > time.Millisecond*10 {
+			t.Fatalf("failed, expected producer not to wait, waited %s", elapsed)
+		}
+		rows, reasons := dropped.get()
+		if writeAPI.Dropped() != 1 || len(rows) != 1 || !errors.Is(reasons[0], clickhousebuffer.ErrQueueFull) {
+			t.Fatalf("failed, expected the row to be rejected, received %v: %v", rows, reasons)
+		}
+		close(mock.release)
+		client.Close()
+		if ids := insertedIDs(mock); len(ids) != 4 {
+			t.Fatalf("failed, expected four rows to be inserted, received %v", ids)
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// ClickhouseImplBatchesMock stores the number of rows of every insert
+type ClickhouseImplBatchesMock struct {
+	mu      sync.Mutex
+	batches []int
+}
+
+func (cb *ClickhouseImplBatchesMock) Insert(_ context.Context, _ cx.View, rows []cx.Vector) (uint64, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.batches = append(cb.batches, len(rows))
+	return uint64(len(rows)), nil
+}
+
+func (cb *ClickhouseImplBatchesMock) Close() error {
+	return nil
+}
+
+func (cb *ClickhouseImplBatchesMock) Conn() driver.Conn {
+	return nil
+}
+
+func (cb *ClickhouseImplBatchesMock) Batches() []int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return append([]int{}, cb.batches...)
+}
+
+// nolint:funlen // it's not important here
+func TestWriterMaxBatchBytes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id", "payload"})
+	wide := func(i int) cx.Vector {
+		return cx.Vector{i, strings.Repeat("x", 1024)}
+	}
+	size := uint(cx.EncodedSize(wide(0)))
+
+	useWriter := func(batchSize, maxBytes uint) (*ClickhouseImplBatchesMock, clickhousebuffer.Client, clickhousebuffer.Writer) {
+		mock := &ClickhouseImplBatchesMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000),
+			clickhousebuffer.WithBatchSize(batchSize),
+			clickhousebuffer.WithMaxBatchBytes(maxBytes),
+		))
+		return mock, client, client.Writer(ctx, tableView, cxsyncmem.NewBuffer(batchSize))
+	}
+
+	t.Run("it should flush rows before the limit of bytes is exceeded", func(t *testing.T) {
+		mock, client, writeAPI := useWriter(1000, size*3+size/2)
+		for i := 0; i < 10; i++ {
+			writeAPI.WriteVector(wide(i))
+		}
+		client.Close()
+		if batches := mock.Batches(); !reflect.DeepEqual(batches, []int{3, 3, 3, 1}) {
+			t.Fatalf("failed, expected batches within the limit of bytes, received %v", batches)
+		}
+	})
+
+	t.Run("it should flush rows when the batch size is hit first", func(t *testing.T) {
+		mock, client, writeAPI := useWriter(2, size*100)
+		for i := 0; i < 5; i++ {
+			writeAPI.WriteVector(wide(i))
+		}
+		client.Close()
+		if batches := mock.Batches(); !reflect.DeepEqual(batches, []int{2, 2, 1}) {
+			t.Fatalf("failed, expected batches of two rows, received %v", batches)
+		}
+	})
+
+	t.Run("it should send the row exceeding the limit alone", func(t *testing.T) {
+		mock, client, writeAPI := useWriter(1000, size/2)
+		writeAPI.WriteVector(cx.Vector{0, "small"})
+		writeAPI.WriteVector(wide(1))
+		writeAPI.WriteVector(wide(2))
+		client.Close()
+		if batches := mock.Batches(); !reflect.DeepEqual(batches, []int{1, 1, 1}) {
+			t.Fatalf("failed, expected every row in its own batch, received %v", batches)
+		}
+	})
+
+	t.Run("it should estimate the size of the row in the RowBinary format", func(t *testing.T) {
+		view := cx.NewTypedView("test_db.test_table",
+			[]string{"id", "payload", "tags", "score", "flag"},
+			[]string{"Int64", "String", "Array(String)", "Nullable(Float64)", "UInt8"},
+		)
+		codec, err := cx.NewRowBinaryCodec(view)
+		if err != nil {
+			t.Fatal(err)
+		}
+		score := 0.5
+		for _, row := range []cx.Vector{
+			{int64(1), strings.Repeat("x", 1024), []string{"a", "bc"}, &score, uint8(1)},
+			{int64(2), "", []string{}, nil, uint8(0)},
+		} {
+			encoded, err := codec.Encode(row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := cx.EncodedSize(row); size != len(encoded) {
+				t.Fatalf("failed, expected size %d of the encoded row, received %d", len(encoded), size)
+			}
+		}
+	})
+}
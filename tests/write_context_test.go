@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// nolint:funlen,gocognit // it's not important here
+func TestWriterContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id", "uuid", "insert_ts"})
+
+	t.Run("it should return error on writes after close", func(t *testing.T) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplMock{},
+			clickhousebuffer.NewOptions(clickhousebuffer.WithFlushInterval(10), clickhousebuffer.WithBatchSize(5)),
+		)
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(5))
+		if err := writeAPI.WriteRowContext(ctx, RowMock{id: 1, uuid: "1", insertTS: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		writeAPI.Close()
+		writeAPI.Close()
+		if err := writeAPI.WriteRowContext(ctx, RowMock{id: 2, uuid: "2", insertTS: time.Now()}); !errors.Is(err, clickhousebuffer.ErrWriterClosed) {
+			t.Fatalf("failed, expected writer closed error, received %v", err)
+		}
+		if err := writeAPI.WriteVectorContext(ctx, cx.Vector{3, "3", time.Now()}); !errors.Is(err, clickhousebuffer.ErrWriterClosed) {
+			t.Fatalf("failed, expected writer closed error, received %v", err)
+		}
+		// writes without error result do not panic and do not block
+		writeAPI.WriteRow(RowMock{id: 4, uuid: "4", insertTS: time.Now()})
+		writeAPI.TryWriteRow(RowMock{id: 5, uuid: "5", insertTS: time.Now()})
+		writeAPI.WriteVector(cx.Vector{6, "6", time.Now()})
+		writeAPI.TryWriteVector(cx.Vector{7, "7", time.Now()})
+	})
+
+	t.Run("it should honour deadline and cancellation of the caller", func(t *testing.T) {
+		mock, client, writeAPI, _ := useStalledWriter(t, ctx)
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Millisecond*20)
+		defer cancelDeadline()
+		if err := writeAPI.WriteVectorContext(deadline, cx.Vector{4}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("failed, expected deadline exceeded error, received %v", err)
+		}
+		canceled, cancelWrite := context.WithCancel(ctx)
+		cancelWrite()
+		if err := writeAPI.WriteVectorContext(canceled, cx.Vector{5}); !errors.Is(err, context.Canceled) {
+			t.Fatalf("failed, expected canceled error, received %v", err)
+		}
+		close(mock.release)
+		client.Close()
+		if ids := insertedIDs(mock); len(ids) != 4 || writeAPI.Dropped() != 0 {
+			t.Fatalf("failed, expected rows of canceled writes not to be inserted, received %v", ids)
+		}
+	})
+
+	t.Run("it should return error of backpressure policy", func(t *testing.T) {
+		mock, client, writeAPI, _ := useStalledWriter(t, ctx,
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureError),
+		)
+		if err := writeAPI.WriteVectorContext(ctx, cx.Vector{4}); !errors.Is(err, clickhousebuffer.ErrQueueFull) {
+			t.Fatalf("failed, expected queue full error, received %v", err)
+		}
+		close(mock.release)
+		client.Close()
+
+		mock, client, writeAPI, _ = useStalledWriter(t, ctx,
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureDropNewest),
+		)
+		if err := writeAPI.WriteVectorContext(ctx, cx.Vector{4}); err != nil {
+			t.Fatalf("failed, expected dropped row not to be an error, received %v", err)
+		}
+		if writeAPI.Dropped() != 1 {
+			t.Fatalf("failed, expected one dropped row, received %d", writeAPI.Dropped())
+		}
+		close(mock.release)
+		client.Close()
+	})
+
+	t.Run("it should insert every accepted row when closed concurrently", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock,
+			clickhousebuffer.NewOptions(
+				clickhousebuffer.WithFlushInterval(10),
+				clickhousebuffer.WithBatchSize(10),
+				clickhousebuffer.WithQueueSize(100),
+			),
+		)
+		writeAPI := client.Writer(ctx, cx.NewView("test_db.test_table", []string{"id"}), cxsyncmem.NewBuffer(10))
+		var accepted int64
+		var wg sync.WaitGroup
+		for p := 0; p < 8; p++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					err := writeAPI.WriteVectorContext(ctx, cx.Vector{1})
+					if errors.Is(err, clickhousebuffer.ErrWriterClosed) {
+						return
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					atomic.AddInt64(&accepted, 1)
+				}
+			}()
+		}
+		simulateWait(time.Millisecond * 50)
+		client.Close()
+		wg.Wait()
+		if inserted := len(mock.Rows()); int64(inserted) != atomic.LoadInt64(&accepted) {
+			t.Fatalf("failed, expected %d accepted rows to be inserted, received %d", accepted, inserted)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+	"github.com/zikwall/clickhouse-buffer/v4/src/retry"
+)
+
+// nolint:funlen,gocognit // it's not important here
+func TestWriteError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id"})
+
+	useOptions := func(opts ...clickhousebuffer.Option) *clickhousebuffer.Options {
+		return clickhousebuffer.NewOptions(append([]clickhousebuffer.Option{
+			clickhousebuffer.WithFlushInterval(10), clickhousebuffer.WithBatchSize(1),
+		}, opts...)...)
+	}
+
+	t.Run("it should send structured error of the failed insert", func(t *testing.T) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMockFailed{}, useOptions())
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		errorsCh := writeAPI.Errors()
+		writeAPI.WriteVector(cx.Vector{1})
+		var err error
+		select {
+		case err = <-errorsCh:
+		case <-time.After(time.Second):
+			t.Fatal("failed, expected error of the insert")
+		}
+		var writeErr *clickhousebuffer.WriteError
+		if !errors.As(err, &writeErr) || !errors.Is(err, errClickhouseUnknownTableException) {
+			t.Fatalf("failed, expected write error, received %v", err)
+		}
+		if writeErr.View.Name != tableView.Name || len(writeErr.Batch.Rows()) != 1 ||
+			writeErr.Attempt != 1 || writeErr.Code != 60 || writeErr.Retried {
+			t.Fatalf("failed, unexpected write error %+v", writeErr)
+		}
+	})
+
+	t.Run("it should report the retried batch and its final failure", func(t *testing.T) {
+		var mu sync.Mutex
+		var received []*clickhousebuffer.WriteError
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMock{}, useOptions(
+			clickhousebuffer.WithRetry(true),
+			clickhousebuffer.WithErrorCallback(func(err error) {
+				var writeErr *clickhousebuffer.WriteError
+				if errors.As(err, &writeErr) {
+					mu.Lock()
+					received = append(received, writeErr)
+					mu.Unlock()
+				}
+			}),
+		))
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		var lost *retry.LostError
+		if err := waitAck(t, writeAPI.WriteVectorAck(ctx, cx.Vector{1})); !errors.As(err, &lost) {
+			t.Fatalf("failed, expected packet to be lost, received %v", err)
+		}
+		// the final failure is reported after acknowledgements are resolved
+		simulateWait(time.Millisecond * 50)
+		mu.Lock()
+		defer mu.Unlock()
+		if len(received) != 2 {
+			t.Fatalf("failed, expected two errors, received %d", len(received))
+		}
+		if first := received[0]; !first.Retried || first.Attempt != 1 || first.Code != 1002 {
+			t.Fatalf("failed, expected retry to be scheduled, received %+v", first)
+		}
+		if final := received[1]; final.Retried || final.Attempt != lost.Attempts || final.Attempt < 2 {
+			t.Fatalf("failed, expected final failure after retries, received %+v", final)
+		}
+	})
+
+	t.Run("it should not stall inserts with a slow reader of buffered errors", func(t *testing.T) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMockFailed{}, useOptions(
+			clickhousebuffer.WithErrorBuffer(1),
+		))
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		errorsCh := writeAPI.Errors()
+		for i := 0; i < 5; i++ {
+			if err := waitAck(t, writeAPI.WriteVectorAck(ctx, cx.Vector{i})); err == nil {
+				t.Fatal("failed, expected insert to fail")
+			}
+		}
+		if len(errorsCh) != 1 {
+			t.Fatalf("failed, expected one buffered error, received %d", len(errorsCh))
+		}
+	})
+
+	t.Run("it should return structured error of the blocking write", func(t *testing.T) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMockFailed{}, useOptions())
+		defer client.Close()
+		err := client.WriterBlocking(tableView).WriteRow(ctx, RowMock{id: 1})
+		var writeErr *clickhousebuffer.WriteError
+		if !errors.As(err, &writeErr) || writeErr.Code != 60 {
+			t.Fatalf("failed, expected write error, received %v", err)
+		}
+	})
+}
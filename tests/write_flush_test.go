@@ -0,0 +1,146 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// clientWrapperMock is a custom Client that writes batches without completing them
+type clientWrapperMock struct {
+	clickhousebuffer.Client
+	rows int32
+}
+
+func (c *clientWrapperMock) WriteBatch(_ context.Context, _ cx.View, batch *cx.Batch) error {
+	atomic.AddInt32(&c.rows, int32(len(batch.Rows())))
+	return nil
+}
+
+// nolint:funlen,gocognit // it's not important here
+func TestWriterFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id"})
+
+	useClient := func(ch cx.Clickhouse, opts ...clickhousebuffer.Option) clickhousebuffer.Client {
+		return clickhousebuffer.NewClientWithOptions(ctx, ch, clickhousebuffer.NewOptions(append([]clickhousebuffer.Option{
+			clickhousebuffer.WithFlushInterval(10000),
+			clickhousebuffer.WithBatchSize(100),
+		}, opts...)...))
+	}
+
+	t.Run("it should insert pending rows and wait for the result", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := useClient(mock)
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(100))
+		for i := 0; i < 5; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+		writeAPI.WriteVectorAck(ctx, cx.Vector{5})
+		if err := writeAPI.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if rows := mock.Rows(); len(rows) != 6 {
+			t.Fatalf("failed, expected all rows to be inserted, received %v", rows)
+		}
+		// nothing to flush
+		if err := writeAPI.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("it should return error of insert", func(t *testing.T) {
+		client := useClient(&ClickhouseImplErrMockFailed{})
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(100))
+		writeAPI.WriteVector(cx.Vector{1})
+		if err := writeAPI.Flush(ctx); !errors.Is(err, errClickhouseUnknownTableException) {
+			t.Fatalf("failed, expected insert error, received %v", err)
+		}
+	})
+
+	t.Run("it should wait for retries", func(t *testing.T) {
+		mock := &ClickhouseImplRetryMock{}
+		client := useClient(mock, clickhousebuffer.WithRetry(true))
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(100))
+		writeAPI.WriteVector(cx.Vector{1})
+		go func() {
+			simulateWait(time.Millisecond * 50)
+			atomic.StoreInt32(&mock.hasErr, 1)
+		}()
+		if err := writeAPI.Flush(ctx); err != nil {
+			t.Fatalf("failed, expected rows to be inserted after retry, received %v", err)
+		}
+		if successfully, _, _ := client.RetryClient().Metrics(); successfully != 1 {
+			t.Fatalf("failed, expected successful retry, received %d", successfully)
+		}
+	})
+
+	t.Run("it should wait for batches being inserted", func(t *testing.T) {
+		mock := &ClickhouseImplBlockMock{release: make(chan struct{})}
+		client := useClient(mock, clickhousebuffer.WithBatchSize(1))
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		writeAPI.WriteVector(cx.Vector{0})
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Millisecond*50)
+		defer cancelDeadline()
+		if err := writeAPI.Flush(deadline); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("failed, expected deadline exceeded error, received %v", err)
+		}
+		close(mock.release)
+		if err := writeAPI.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if ids := insertedIDs(mock); len(ids) != 1 {
+			t.Fatalf("failed, expected row to be inserted, received %v", ids)
+		}
+	})
+
+	t.Run("it should flush all writers of client", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := useClient(mock)
+		first := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(100))
+		second := client.Writer(ctx, cx.NewView("test_db.test_table_second", []string{"id"}), cxsyncmem.NewBuffer(100))
+		first.WriteVector(cx.Vector{1})
+		second.WriteVector(cx.Vector{2})
+		if err := client.FlushAll(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if rows := mock.Rows(); len(rows) != 2 {
+			t.Fatalf("failed, expected rows of both writers to be inserted, received %v", rows)
+		}
+		client.Close()
+		if err := first.Flush(ctx); !errors.Is(err, clickhousebuffer.ErrWriterClosed) {
+			t.Fatalf("failed, expected writer closed error, received %v", err)
+		}
+		if err := client.FlushAll(ctx); err != nil {
+			t.Fatalf("failed, expected no writers to flush, received %v", err)
+		}
+	})
+
+	t.Run("it should complete batches written by custom clients", func(t *testing.T) {
+		client := useClient(&ClickhouseImplMock{})
+		defer client.Close()
+		wrapper := &clientWrapperMock{Client: client}
+		writeAPI := clickhousebuffer.NewWriter(ctx, wrapper, tableView, cxsyncmem.NewBuffer(100))
+		defer writeAPI.Close()
+		ack := writeAPI.WriteVectorAck(ctx, cx.Vector{1})
+		flushCtx, cancelFlush := context.WithTimeout(ctx, time.Second)
+		defer cancelFlush()
+		if err := writeAPI.Flush(flushCtx); err != nil {
+			t.Fatalf("failed, expected flush to complete, received %v", err)
+		}
+		if err := waitAck(t, ack); err != nil || atomic.LoadInt32(&wrapper.rows) != 1 {
+			t.Fatalf("failed, expected row to be acknowledged, received %v", err)
+		}
+	})
+}
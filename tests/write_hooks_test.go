@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+	"github.com/zikwall/clickhouse-buffer/v4/src/retry"
+)
+
+// hooksRecorder stores events of hooks by their names
+type hooksRecorder struct {
+	mu     sync.Mutex
+	events map[string][]clickhousebuffer.HookEvent
+}
+
+func (h *hooksRecorder) add(name string, event clickhousebuffer.HookEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.events == nil {
+		h.events = map[string][]clickhousebuffer.HookEvent{}
+	}
+	h.events[name] = append(h.events[name], event)
+}
+
+func (h *hooksRecorder) get(name string) []clickhousebuffer.HookEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]clickhousebuffer.HookEvent{}, h.events[name]...)
+}
+
+func (h *hooksRecorder) OnFlush(event clickhousebuffer.HookEvent) {
+	h.add("flush", event)
+}
+
+func (h *hooksRecorder) OnInsertSuccess(event clickhousebuffer.HookEvent) {
+	h.add("success", event)
+}
+
+func (h *hooksRecorder) OnInsertError(event clickhousebuffer.HookEvent) {
+	h.add("error", event)
+}
+
+func (h *hooksRecorder) OnRetry(event clickhousebuffer.HookEvent) {
+	h.add("retry", event)
+}
+
+func (h *hooksRecorder) OnDrop(event clickhousebuffer.HookEvent) {
+	h.add("drop", event)
+}
+
+// nolint:funlen,gocognit // it's not important here
+func TestWriterHooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id"})
+
+	useOptions := func(opts ...clickhousebuffer.Option) *clickhousebuffer.Options {
+		return clickhousebuffer.NewOptions(append([]clickhousebuffer.Option{
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(2),
+		}, opts...)...)
+	}
+
+	t.Run("it should call hooks of flush and successful insert", func(t *testing.T) {
+		hooks := &hooksRecorder{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplRecordMock{}, useOptions())
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(2), clickhousebuffer.WithHooks(hooks))
+		writeAPI.WriteVector(cx.Vector{1})
+		writeAPI.WriteVector(cx.Vector{2})
+		if err := writeAPI.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		flushes, successes := hooks.get("flush"), hooks.get("success")
+		if len(flushes) != 1 || flushes[0].View != tableView.Name || flushes[0].Rows != 2 || flushes[0].Bytes == 0 {
+			t.Fatalf("failed, expected flush of two rows, received %+v", flushes)
+		}
+		if len(successes) != 1 || successes[0].Rows != 2 || successes[0].Bytes != flushes[0].Bytes || successes[0].Err != nil {
+			t.Fatalf("failed, expected successful insert of two rows, received %+v", successes)
+		}
+	})
+
+	t.Run("it should call hooks of failed insert, retries and lost packet", func(t *testing.T) {
+		hooks := &hooksRecorder{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMock{}, useOptions(clickhousebuffer.WithRetry(true)))
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1),
+			clickhousebuffer.WithHooks(hooks), clickhousebuffer.WithBatchSize(1),
+		)
+		var lost *retry.LostError
+		if err := waitAck(t, writeAPI.WriteVectorAck(ctx, cx.Vector{1})); !errors.As(err, &lost) {
+			t.Fatalf("failed, expected packet to be lost, received %v", err)
+		}
+		var writeErr *clickhousebuffer.WriteError
+		if failures := hooks.get("error"); len(failures) != 1 || !errors.As(failures[0].Err, &writeErr) || !writeErr.Retried {
+			t.Fatalf("failed, expected failed insert scheduled for retry, received %+v", failures)
+		}
+		if retries := hooks.get("retry"); len(retries) == 0 || retries[0].Latency == 0 || retries[0].Rows != 1 {
+			t.Fatalf("failed, expected packet to be queued for the next retry cycle, received %+v", retries)
+		}
+		if drops := hooks.get("drop"); len(drops) != 1 || !errors.As(drops[0].Err, &lost) || len(hooks.get("success")) != 0 {
+			t.Fatalf("failed, expected packet to be dropped, received %+v", drops)
+		}
+	})
+
+	t.Run("it should call hook of successful retry", func(t *testing.T) {
+		hooks := &hooksRecorder{}
+		mock := &ClickhouseImplRetryMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, useOptions(clickhousebuffer.WithRetry(true)))
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1),
+			clickhousebuffer.WithHooks(hooks), clickhousebuffer.WithBatchSize(1),
+		)
+		ack := writeAPI.WriteVectorAck(ctx, cx.Vector{1})
+		simulateWait(time.Millisecond * 50)
+		atomic.StoreInt32(&mock.hasErr, 1)
+		if err := waitAck(t, ack); err != nil {
+			t.Fatalf("failed, expected row to be inserted after retry, received %v", err)
+		}
+		if successes := hooks.get("success"); len(successes) != 1 || successes[0].Latency == 0 || len(hooks.get("error")) != 1 {
+			t.Fatalf("failed, expected retry to succeed, received %+v", successes)
+		}
+	})
+
+	t.Run("it should call hook of rows dropped by backpressure", func(t *testing.T) {
+		hooks := &hooksRecorder{}
+		mock, client, writeAPI, _ := useStalledWriter(t, ctx,
+			clickhousebuffer.WithBackpressure(clickhousebuffer.BackpressureDropNewest),
+			clickhousebuffer.WithHooks(hooks),
+		)
+		writeAPI.WriteVector(cx.Vector{4})
+		if drops := hooks.get("drop"); len(drops) != 1 || drops[0].Rows != 1 || !errors.Is(drops[0].Err, clickhousebuffer.ErrQueueFull) {
+			t.Fatalf("failed, expected row to be dropped, received %+v", drops)
+		}
+		close(mock.release)
+		client.Close()
+		// rows left on close may be inserted together
+		inserted := 0
+		for _, event := range hooks.get("success") {
+			inserted += event.Rows
+		}
+		if inserted != 4 {
+			t.Fatalf("failed, expected four rows to be inserted, received %d", inserted)
+		}
+	})
+
+	t.Run("it should call hooks of the client for blocking writes", func(t *testing.T) {
+		hooks := &hooksRecorder{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplErrMockFailed{}, useOptions(clickhousebuffer.WithHooks(hooks)))
+		defer client.Close()
+		if err := client.WriterBlocking(tableView).WriteRow(ctx, RowMock{id: 1}); err == nil {
+			t.Fatal("failed, expected insert to fail")
+		}
+		if failures := hooks.get("error"); len(failures) != 1 || !errors.Is(failures[0].Err, errClickhouseUnknownTableException) {
+			t.Fatalf("failed, expected failed insert, received %+v", failures)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// ClickhouseImplHangMock waits for the context of insert
+type ClickhouseImplHangMock struct{}
+
+func (ch *ClickhouseImplHangMock) Insert(ctx context.Context, _ cx.View, _ []cx.Vector) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (ch *ClickhouseImplHangMock) Close() error {
+	return nil
+}
+
+func (ch *ClickhouseImplHangMock) Conn() driver.Conn {
+	return nil
+}
+
+// nolint:funlen // it's not important here
+func TestWriterOverrides(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dimensions := cx.NewView("test_db.dimensions", []string{"id"})
+	events := cx.NewView("test_db.events", []string{"id"})
+
+	t.Run("it should override batch size and flush interval of client", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(100),
+		))
+		defer client.Close()
+		dimensionsAPI := client.Writer(ctx, dimensions, cxsyncmem.NewBuffer(2),
+			clickhousebuffer.WithBatchSize(2), clickhousebuffer.WithFlushInterval(20),
+		)
+		eventsAPI := client.Writer(ctx, events, cxsyncmem.NewBuffer(100))
+		dimensionsAPI.WriteVector(cx.Vector{1})
+		eventsAPI.WriteVector(cx.Vector{2})
+		simulateWait(time.Millisecond * 100)
+		if rows := mock.Rows(); len(rows) != 1 || rows[0][0] != 1 {
+			t.Fatalf("failed, expected only rows of the writer with short flush interval, received %v", rows)
+		}
+		if dimensionsAPI.BatchSize() != 2 || eventsAPI.BatchSize() != 100 || client.Options().BatchSize() != 100 {
+			t.Fatalf("failed, expected writer options not to change options of client")
+		}
+		// the existing writer is returned as is
+		if again := client.Writer(ctx, dimensions, cxsyncmem.NewBuffer(5), clickhousebuffer.WithBatchSize(5)); again.BatchSize() != 2 {
+			t.Fatalf("failed, expected options of the existing writer, received %d", again.BatchSize())
+		}
+	})
+
+	t.Run("it should enable retries for a single writer", func(t *testing.T) {
+		mock := &ClickhouseImplRetryMock{}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10), clickhousebuffer.WithBatchSize(1),
+		))
+		defer client.Close()
+		if client.RetryClient() != nil {
+			t.Fatal("failed, expected no retry client while retries are disabled")
+		}
+		eventsAPI := client.Writer(ctx, events, cxsyncmem.NewBuffer(1), clickhousebuffer.WithRetry(true))
+		dimensionsAPI := client.Writer(ctx, dimensions, cxsyncmem.NewBuffer(1))
+		if err := waitAck(t, dimensionsAPI.WriteVectorAck(ctx, cx.Vector{1})); !errors.Is(err, errClickhouseUnknownException) {
+			t.Fatalf("failed, expected error without retries, received %v", err)
+		}
+		retried := eventsAPI.WriteVectorAck(ctx, cx.Vector{2})
+		simulateWait(time.Millisecond * 50)
+		atomic.StoreInt32(&mock.hasErr, 1)
+		if err := waitAck(t, retried); err != nil {
+			t.Fatalf("failed, expected row to be inserted after retry, received %v", err)
+		}
+		if successfully, _, _ := client.RetryClient().Metrics(); successfully != 1 {
+			t.Fatalf("failed, expected successful retry, received %d", successfully)
+		}
+	})
+
+	t.Run("it should interrupt inserts by timeout of writer", func(t *testing.T) {
+		client := clickhousebuffer.NewClientWithOptions(ctx, &ClickhouseImplHangMock{}, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(100),
+		))
+		defer client.Close()
+		writeAPI := client.Writer(ctx, events, cxsyncmem.NewBuffer(100),
+			clickhousebuffer.WithInsertTimeout(time.Millisecond*20),
+		)
+		writeAPI.WriteVector(cx.Vector{1})
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Second)
+		defer cancelDeadline()
+		if err := writeAPI.Flush(deadline); !errors.Is(err, context.DeadlineExceeded) || deadline.Err() != nil {
+			t.Fatalf("failed, expected insert to time out, received %v", err)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// ClickhouseImplSlowMock stores inserted rows and the maximum number of concurrent inserts,
+// the duration of insert is returned by delay for the first row of the batch
+type ClickhouseImplSlowMock struct {
+	ClickhouseImplRecordMock
+	delay      func(row cx.Vector) time.Duration
+	concurrent int32
+	highest    int32
+}
+
+func (cs *ClickhouseImplSlowMock) Insert(ctx context.Context, view cx.View, rows []cx.Vector) (uint64, error) {
+	current := atomic.AddInt32(&cs.concurrent, 1)
+	defer atomic.AddInt32(&cs.concurrent, -1)
+	for {
+		highest := atomic.LoadInt32(&cs.highest)
+		if current <= highest || atomic.CompareAndSwapInt32(&cs.highest, highest, current) {
+			break
+		}
+	}
+	simulateWait(cs.delay(rows[0]))
+	return cs.ClickhouseImplRecordMock.Insert(ctx, view, rows)
+}
+
+// ClickhouseImplFlakyMock fails the first inserts with an error that can be retried, then stores inserted rows
+type ClickhouseImplFlakyMock struct {
+	ClickhouseImplRecordMock
+	failures int32
+}
+
+func (cf *ClickhouseImplFlakyMock) Insert(ctx context.Context, view cx.View, rows []cx.Vector) (uint64, error) {
+	if atomic.AddInt32(&cf.failures, -1) >= 0 {
+		return 0, errClickhouseUnknownException
+	}
+	return cf.ClickhouseImplRecordMock.Insert(ctx, view, rows)
+}
+
+// bufferOrderMock records the first row of every acknowledged batch
+type bufferOrderMock struct {
+	cx.Buffer
+	mu    sync.Mutex
+	acked []interface{}
+}
+
+// Read removes rows at once, the adapter does not flush engines with acknowledgements
+func (b *bufferOrderMock) Read() []cx.Vector {
+	rows := b.Buffer.Read()
+	b.Buffer.Flush()
+	return rows
+}
+
+func (b *bufferOrderMock) Ack(batch *cx.Batch, _ error) {
+	b.mu.Lock()
+	b.acked = append(b.acked, batch.Rows()[0][0])
+	b.mu.Unlock()
+}
+
+// nolint:funlen,gocognit // it's not important here
+func TestWriterPipeline(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id"})
+	// earlier batches are inserted longer, so that concurrent inserts finish in reverse order
+	reverse := func(row cx.Vector) time.Duration {
+		return time.Duration(10-row[0].(int)) * time.Millisecond * 5
+	}
+
+	t.Run("it should insert batches concurrently", func(t *testing.T) {
+		mock := &ClickhouseImplSlowMock{delay: reverse}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000),
+			clickhousebuffer.WithBatchSize(1),
+			clickhousebuffer.WithInsertWorkers(4),
+			clickhousebuffer.WithPipelineDepth(4),
+		))
+		engine := &bufferOrderMock{Buffer: cxsyncmem.NewBuffer(1)}
+		writeAPI := client.Writer(ctx, tableView, engine)
+		for i := 0; i < 10; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+		client.Close()
+		if highest := atomic.LoadInt32(&mock.highest); highest < 2 || highest > 4 {
+			t.Fatalf("failed, expected from 2 to 4 concurrent inserts, received %d", highest)
+		}
+		if rows := mock.Rows(); len(rows) != 10 || reflect.DeepEqual(rows[0], cx.Vector{0}) {
+			t.Fatalf("failed, expected all rows to be inserted out of order, received %v", rows)
+		}
+		// engines with delivery guarantees are acknowledged in the order batches were read
+		if expected := []interface{}{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(engine.acked, expected) {
+			t.Fatalf("failed, expected acknowledgements in order %v, received %v", expected, engine.acked)
+		}
+	})
+
+	t.Run("it should insert batches strictly one after another in ordered mode", func(t *testing.T) {
+		mock := &ClickhouseImplSlowMock{delay: reverse}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000),
+			clickhousebuffer.WithBatchSize(1),
+			clickhousebuffer.WithInsertWorkers(4),
+			clickhousebuffer.WithPipelineDepth(4),
+			clickhousebuffer.WithOrderedInserts(true),
+		))
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		for i := 0; i < 5; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+		client.Close()
+		if highest := atomic.LoadInt32(&mock.highest); highest != 1 {
+			t.Fatalf("failed, expected sequential inserts, received %d concurrent", highest)
+		}
+		if rows := mock.Rows(); !reflect.DeepEqual(rows, []cx.Vector{{0}, {1}, {2}, {3}, {4}}) {
+			t.Fatalf("failed, expected rows in order, received %v", rows)
+		}
+	})
+
+	t.Run("it should not overtake retried batch in ordered mode", func(t *testing.T) {
+		mock := &ClickhouseImplFlakyMock{failures: 2}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000),
+			clickhousebuffer.WithBatchSize(1),
+			clickhousebuffer.WithRetry(true),
+			clickhousebuffer.WithOrderedInserts(true),
+		))
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		for i := 0; i < 4; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+		client.Close()
+		if rows := mock.Rows(); !reflect.DeepEqual(rows, []cx.Vector{{0}, {1}, {2}, {3}}) {
+			t.Fatalf("failed, expected retried batch to be inserted first, received %v", rows)
+		}
+	})
+
+	t.Run("it should keep accepting rows while inserts are in flight", func(t *testing.T) {
+		mock := &ClickhouseImplBlockMock{release: make(chan struct{})}
+		client := clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000),
+			clickhousebuffer.WithBatchSize(1),
+			clickhousebuffer.WithPipelineDepth(2),
+		))
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(1))
+		deadline, cancelDeadline := context.WithTimeout(ctx, time.Millisecond*200)
+		defer cancelDeadline()
+		// the first batch is being inserted, the next two are waiting in the pipeline, the last one waits for room in it
+		for i := 0; i < 4; i++ {
+			if err := writeAPI.WriteVectorContext(deadline, cx.Vector{i}); err != nil {
+				t.Fatalf("failed, expected row %d to be accepted, received %v", i, err)
+			}
+		}
+		close(mock.release)
+		client.Close()
+		if ids := insertedIDs(mock); !reflect.DeepEqual(ids, []interface{}{0, 1, 2, 3}) {
+			t.Fatalf("failed, expected batches of the pipeline to be inserted on close, received %v", ids)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	clickhousebuffer "github.com/zikwall/clickhouse-buffer/v4"
+	"github.com/zikwall/clickhouse-buffer/v4/src/buffer/cxsyncmem"
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// nolint:funlen,gocognit // it's not important here
+func TestWriterReconfigure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tableView := cx.NewView("test_db.test_table", []string{"id"})
+
+	useClient := func(mock cx.Clickhouse) clickhousebuffer.Client {
+		return clickhousebuffer.NewClientWithOptions(ctx, mock, clickhousebuffer.NewOptions(
+			clickhousebuffer.WithFlushInterval(10000), clickhousebuffer.WithBatchSize(100),
+		))
+	}
+
+	t.Run("it should reset ticker of live writer", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := useClient(mock)
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(100))
+		writeAPI.WriteVector(cx.Vector{1})
+		simulateWait(time.Millisecond * 20)
+		if err := client.Options().Reconfigure(clickhousebuffer.Batching{BatchSize: 100, FlushInterval: 20}); err != nil {
+			t.Fatal(err)
+		}
+		simulateWait(time.Millisecond * 100)
+		if rows := mock.Rows(); len(rows) != 1 {
+			t.Fatalf("failed, expected row to be flushed by new interval, received %v", rows)
+		}
+		if writeAPI.FlushInterval() != 20 || writeAPI.Options() != client.Options() {
+			t.Fatalf("failed, expected writer to share options of client, received %d", writeAPI.FlushInterval())
+		}
+	})
+
+	t.Run("it should flush rows hitting new batch size", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := useClient(mock)
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(100))
+		for i := 0; i < 5; i++ {
+			writeAPI.WriteVector(cx.Vector{i})
+		}
+		client.Options().SetBatchSize(5)
+		simulateWait(time.Millisecond * 50)
+		if rows := mock.Rows(); len(rows) != 5 {
+			t.Fatalf("failed, expected rows to be flushed by new batch size, received %v", rows)
+		}
+	})
+
+	t.Run("it should reject invalid parameters", func(t *testing.T) {
+		options := clickhousebuffer.NewOptions()
+		if err := options.Reconfigure(clickhousebuffer.Batching{BatchSize: 10}); !errors.Is(err, clickhousebuffer.ErrInvalidBatching) {
+			t.Fatalf("failed, expected invalid batching error, received %v", err)
+		}
+		if options.BatchSize() != 2000 || options.FlushInterval() != 2000 {
+			t.Fatalf("failed, expected options not to change, received %+v", options.Batching())
+		}
+	})
+
+	t.Run("it should apply parameters of subscription to writer with own options", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := useClient(mock)
+		defer client.Close()
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(100), clickhousebuffer.WithBatchSize(50))
+		updates := make(chan clickhousebuffer.Batching)
+		writeAPI.Options().Subscribe(ctx, updates)
+		updates <- clickhousebuffer.Batching{BatchSize: 0}
+		updates <- clickhousebuffer.Batching{BatchSize: 2, FlushInterval: 10000, MaxBatchBytes: 1 << 20}
+		close(updates)
+		simulateWait(time.Millisecond * 20)
+		writeAPI.WriteVector(cx.Vector{1})
+		writeAPI.WriteVector(cx.Vector{2})
+		simulateWait(time.Millisecond * 20)
+		if rows := mock.Rows(); len(rows) != 2 {
+			t.Fatalf("failed, expected rows to be flushed by subscribed batch size, received %v", rows)
+		}
+		if writeAPI.Options().MaxBatchBytes() != 1<<20 || client.Options().BatchSize() != 100 {
+			t.Fatalf("failed, expected only options of writer to change, received %+v", client.Options().Batching())
+		}
+	})
+
+	t.Run("it should reconfigure concurrently with writes", func(t *testing.T) {
+		mock := &ClickhouseImplRecordMock{}
+		client := useClient(mock)
+		writeAPI := client.Writer(ctx, tableView, cxsyncmem.NewBuffer(100))
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				writeAPI.WriteVector(cx.Vector{i})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := uint(1); i <= 100; i++ {
+				client.Options().SetBatchSize(i)
+				client.Options().SetFlushInterval(i)
+			}
+		}()
+		wg.Wait()
+		client.Close()
+		if rows := mock.Rows(); len(rows) != 1000 {
+			t.Fatalf("failed, expected all rows to be inserted, received %d", len(rows))
+		}
+	})
+}
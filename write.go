@@ -2,11 +2,13 @@ package clickhousebuffer
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+	"github.com/zikwall/clickhouse-buffer/v4/src/metrics"
 )
 
 // Writer is client interface with non-blocking methods for writing rows asynchronously in batches into an Clickhouse server.
@@ -15,52 +17,140 @@ import (
 type Writer interface {
 	// WriteRow writes asynchronously line protocol record into bucket.
 	WriteRow(vector cx.Vectorable)
-	// TryWriteRow same as WriteRow, but with Channel Closing Principle (Gracefully Close Channels)
+	// TryWriteRow same as WriteRow, both are safe to call after Close, the row is discarded then
 	TryWriteRow(vec cx.Vectorable)
 	// WriteVector writes asynchronously line protocol record into bucket.
 	WriteVector(vec cx.Vector)
 	// TryWriteVector same as WriteVector
 	TryWriteVector(vec cx.Vector)
+	// WriteRowContext same as WriteRow, but waiting for room in the queue is interrupted by the context.
+	// It returns ErrWriterClosed after Close, and the error of the backpressure policy if the row was rejected
+	WriteRowContext(ctx context.Context, vec cx.Vectorable) error
+	// WriteVectorContext same as WriteRowContext, but just uses inlined vector
+	WriteVectorContext(ctx context.Context, vec cx.Vector) error
+	// WriteRowAck same as WriteRowContext, but returns the acknowledgement resolved
+	// once the batch containing the row is written into Clickhouse, or given up after retries
+	WriteRowAck(ctx context.Context, vec cx.Vectorable) *Ack
+	// WriteVectorAck same as WriteRowAck, but just uses inlined vector
+	WriteVectorAck(ctx context.Context, vec cx.Vector) *Ack
 	// Errors returns a channel for reading errors which occurs during async writes.
 	Errors() <-chan error
-	// Close writer
+	// Dropped returns the number of rows dropped by the backpressure policy
+	Dropped() uint64
+	// Options returns options of the Writer, writers created without options share options of the client.
+	// Batching of live writers is changed with Options.Reconfigure
+	Options() *Options
+	// Flush sends rows written before the call to Clickhouse and waits for the result of their inserts
+	Flush(ctx context.Context) error
+	// BatchSize returns the effective batch size, it changes at runtime with adaptive batching
+	BatchSize() uint
+	// FlushInterval returns the effective flush interval in ms, it changes at runtime with adaptive batching
+	FlushInterval() uint
+	// Close writer, it is safe to call Close several times, rows written after Close are discarded
 	Close()
 }
 
+// ErrWriterClosed is returned on writes after the Writer is closed
+var ErrWriterClosed = errors.New("writer is closed")
+
 // writer structure implements the Writer interface,
 // encapsulates all the necessary methods within itself and manages its own personal data flows
 type writer struct {
 	context      context.Context
 	view         cx.View
 	client       Client
-	bufferEngine cx.Buffer
+	bufferEngine cx.BufferV2
 	writeOptions *Options
 	errCh        chan error
-	clickhouseCh chan *cx.Batch
-	bufferCh     chan cx.Vector
+	clickhouseCh chan flushed
+	bufferCh     chan queued
 	doneCh       chan struct{}
 	writeStop    chan struct{}
 	bufferStop   chan struct{}
+	flushCh      chan chan []*cx.Batch
 	mu           *sync.RWMutex
 	isOpenErr    int32
+	// engine spills rows outside of memory, see cx.Spiller
+	spills bool
+	// number of batches flushed, but not inserted yet
+	inflight int32
+	// forwards results of batches to the engine with delivery guarantees in the order they were read
+	acks *ackSequencer
+	// sequence number of the last batch read from the engine
+	sequence uint64
+	// adjusts the batch size and the flush interval, nil if adaptive batching is disabled
+	adaptive *adaptive
+	// batches waited for by Flush
+	outstanding outstanding
+	// rows dropped by the backpressure policy
+	dropped uint64
+	// rows waiting for acknowledgement, they are added to the next batch, up to the batch size of them
+	acked []queued
+	// number of rows in the buffer engine, it is counted by the buffer bridge and refreshed from the engine
+	// by the ticker and before draining all rows, so the engine is not asked for its length for every row
+	rows int
+	// estimated size of rows waiting to be flushed, it is tracked only if the limit of bytes is set
+	bytes int
+	// user hooks together with hooks of metrics, nil if neither is set
+	hooks Hooks
+	// labels of metrics of the Writer
+	labels []metrics.Label
+	// writes hold the read lock, so that no row gets into the queue after it is drained on Close
+	closeMu   sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+}
+
+// queued is the row of the intake queue, ack is set for rows written with WriteRowAck
+type queued struct {
+	row cx.Vector
+	ack *Ack
+}
+
+// flushed is the batch sent to Clickhouse, buffered is false if it has no rows read from the buffer engine
+type flushed struct {
+	batch    *cx.Batch
+	buffered bool
+	sequence uint64
+}
+
+// NewWriter returns new non-blocking write client for writing rows to Clickhouse table.
+// Options override the options of the client for this Writer
+func NewWriter(ctx context.Context, client Client, view cx.View, engine cx.Buffer, opts ...Option) Writer {
+	return newWriter(ctx, client, view, cx.AdaptBuffer(engine), isSpiller(engine), opts)
+}
+
+// NewWriterV2 same as NewWriter, but uses the buffer engine of the second version,
+// failures of the engine are sent to Writer.Errors(). The engine is closed together with the Writer
+func NewWriterV2(ctx context.Context, client Client, view cx.View, engine cx.BufferV2, opts ...Option) Writer {
+	return newWriter(ctx, client, view, engine, isSpiller(engine), opts)
 }
 
-// NewWriter returns new non-blocking write client for writing rows to Clickhouse table
-func NewWriter(ctx context.Context, client Client, view cx.View, engine cx.Buffer) Writer {
+func newWriter(ctx context.Context, client Client, view cx.View, engine cx.BufferV2, spills bool, opts []Option) *writer {
+	options := client.Options().override(opts)
 	w := &writer{
 		mu:           &sync.RWMutex{},
 		context:      ctx,
 		view:         view,
 		client:       client,
 		bufferEngine: engine,
-		writeOptions: client.Options(),
+		writeOptions: options,
 		// write buffers
-		clickhouseCh: make(chan *cx.Batch),
-		bufferCh:     make(chan cx.Vector),
+		clickhouseCh: make(chan flushed, options.pipelineDepth),
+		bufferCh:     make(chan queued, options.queueCapacity()),
 		// signals
-		doneCh:     make(chan struct{}),
-		bufferStop: make(chan struct{}),
-		writeStop:  make(chan struct{}),
+		doneCh:      make(chan struct{}),
+		bufferStop:  make(chan struct{}),
+		writeStop:   make(chan struct{}),
+		flushCh:     make(chan chan []*cx.Batch),
+		spills:      spills,
+		adaptive:    newAdaptive(options),
+		outstanding: outstanding{batches: map[*cx.Batch]struct{}{}},
+		hooks:       options.lifecycle(),
+		labels:      []metrics.Label{{Name: metrics.LabelView, Value: view.Name}},
+	}
+	if ack, ok := engine.(cx.Acknowledger); ok {
+		w.acks = newAckSequencer(ack)
 	}
 	go w.runBufferBridge()
 	go w.runClickhouseBridge()
@@ -70,59 +160,62 @@ func NewWriter(ctx context.Context, client Client, view cx.View, engine cx.Buffe
 // WriteRow writes asynchronously line protocol record into bucket.
 // WriteRow adds record into the buffer which is sent on the background when it reaches the batch size.
 func (w *writer) WriteRow(vec cx.Vectorable) {
-	// maybe use atomic for check is closed
-	// atomic.LoadInt32(&w.isClosed) == 1
-	w.bufferCh <- vec.Row()
+	_ = w.write(context.Background(), queued{row: vec.Row()})
 }
 
-// TryWriteRow same as WriteRow, but with Channel Closing Principle (Gracefully Close Channels)
+// TryWriteRow same as WriteRow, it is kept for compatibility, WriteRow is safe to call after Close as well
 func (w *writer) TryWriteRow(vec cx.Vectorable) {
-	// the try-receive operation is to try to exit the goroutine as early as
-	// possible.
-	select {
-	case <-w.bufferStop:
-		return
-	default:
-	}
-	// even if bufferStop is closed, the first branch in the second select may be
-	// still not selected for some loops if to send to bufferCh is also unblocked.
-	select {
-	case <-w.bufferStop:
-		return
-	case w.bufferCh <- vec.Row():
-	}
+	_ = w.write(context.Background(), queued{row: vec.Row()})
 }
 
 // WriteVector same as WriteRow, but just uses inlined vector.
 // WriteVector a faster option for writing to buffer than WriteRow, in addition, memory allocates less
 func (w *writer) WriteVector(vec cx.Vector) {
-	w.bufferCh <- vec
+	_ = w.write(context.Background(), queued{row: vec})
 }
 
 // TryWriteVector same as WriteVector
 func (w *writer) TryWriteVector(vec cx.Vector) {
-	select {
-	case <-w.bufferStop:
-		return
-	default:
+	_ = w.write(context.Background(), queued{row: vec})
+}
+
+// WriteRowContext same as WriteRow, but waiting for room in the queue is interrupted by the context
+func (w *writer) WriteRowContext(ctx context.Context, vec cx.Vectorable) error {
+	return w.write(ctx, queued{row: vec.Row()})
+}
+
+// WriteVectorContext same as WriteVector, but waiting for room in the queue is interrupted by the context
+func (w *writer) WriteVectorContext(ctx context.Context, vec cx.Vector) error {
+	return w.write(ctx, queued{row: vec})
+}
+
+func (w *writer) write(ctx context.Context, item queued) error {
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
 	}
-	select {
-	case <-w.bufferStop:
-		return
-	case w.bufferCh <- vec:
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	return w.enqueue(ctx, item)
 }
 
-// Errors returns a channel for reading errors which occurs during async writes.
+// Options returns options of the Writer
+func (w *writer) Options() *Options {
+	return w.writeOptions
+}
+
+// Errors returns a channel for reading errors which occurs during async writes, failed inserts are *WriteError.
 // Errors must be called before performing any writes for errors to be collected.
-// Errors chan is unbuffered and must be drained or the writer will block.
+// Errors chan is unbuffered and must be drained or the writer will block, unless WithErrorBuffer is set.
 func (w *writer) Errors() <-chan error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if w.errCh == nil {
+		w.errCh = make(chan error, w.writeOptions.errorBuffer)
 		// mark that have a channel reader with errors so that can write to same channel
 		atomic.StoreInt32(&w.isOpenErr, 1)
-		w.errCh = make(chan error)
 	}
 	return w.errCh
 }
@@ -132,8 +225,24 @@ func (w *writer) hasErrReader() bool {
 	return atomic.LoadInt32(&w.isOpenErr) > 0
 }
 
+// bufferError sends the failure of the buffer engine to the errors channel,
+// if nobody reads errors, it is logged, because rows are lost
+func (w *writer) bufferError(err error) {
+	if !w.reportError(err, false) {
+		w.writeOptions.logger.Logf("buffer %s: %v", w.view.Name, err)
+	}
+}
+
 // Close finishes outstanding write operations, stop background routines and closes all channels
 func (w *writer) Close() {
+	w.closeOnce.Do(w.close)
+}
+
+func (w *writer) close() {
+	// wait for writes in progress, later writes get ErrWriterClosed
+	w.closeMu.Lock()
+	w.closed = true
+	w.closeMu.Unlock()
 	if w.clickhouseCh != nil {
 		// stop and wait for write buffer
 		close(w.bufferStop)
@@ -147,18 +256,97 @@ func (w *writer) Close() {
 		// close(w.tickerStop)
 		// <-w.doneCh
 	}
+	if err := w.bufferEngine.Close(); err != nil {
+		w.writeOptions.logger.Logf("close buffer %s: %v", w.view.Name, err)
+	}
 	if w.writeOptions.isDebug {
 		w.writeOptions.logger.Logf("close writer %s", w.view.Name)
 	}
 }
 
+func isSpiller(engine interface{}) bool {
+	_, ok := engine.(cx.Spiller)
+	return ok
+}
+
 // flush generates a new message packet and sends it to the queue channel for subsequent recording to Clickhouse database
 func (w *writer) flush() {
 	if w.writeOptions.isDebug {
 		w.writeOptions.logger.Logf("flush buffer: %s", w.view.Name)
 	}
-	w.clickhouseCh <- cx.NewBatch(w.bufferEngine.Read())
-	w.bufferEngine.Flush()
+	// spilling engines keep rows while the pipeline is full, instead of blocking producers
+	if w.spills && int(atomic.LoadInt32(&w.inflight)) >= w.writeOptions.pipelineCapacity() {
+		return
+	}
+	w.drain()
+}
+
+// drain sends rows of the buffer to Clickhouse, returns nil if the buffer had nothing to send
+func (w *writer) drain() *cx.Batch {
+	// engines with delivery guarantees may have nothing to return,
+	// e.g. when the pending rows were claimed by another instance
+	rows, err := w.bufferEngine.Drain(w.context)
+	if err != nil {
+		w.bufferError(err)
+	}
+	// engines shared by several writers may return rows written by others
+	if w.rows -= len(rows); w.rows < 0 {
+		w.rows = 0
+	}
+	if len(rows) == 0 && len(w.acked) == 0 {
+		return nil
+	}
+	next := flushed{batch: w.batch(rows), buffered: len(rows) > 0}
+	w.untrack(next.batch.Rows())
+	if w.hooks != nil {
+		w.hooks.OnFlush(newHookEvent(w.hooks, w.view, next.batch.Rows(), 0, nil))
+	}
+	w.observeLength()
+	if next.buffered {
+		w.sequence++
+		next.sequence = w.sequence
+	}
+	// the engine is acknowledged with the final result of the batch, after retries,
+	// batches of acknowledged rows only were not read from the engine
+	if w.acks != nil && next.buffered {
+		next.batch.OnDone(func(err error) {
+			w.acks.done(next, err)
+		})
+	}
+	w.outstanding.add(next.batch)
+	atomic.AddInt32(&w.inflight, 1)
+	w.clickhouseCh <- next
+	return next.batch
+}
+
+// drainAll sends all rows of the buffer to Clickhouse, spilling engines return rows in parts
+func (w *writer) drainAll() []*cx.Batch {
+	w.refresh()
+	var batches []*cx.Batch
+	for w.pending() > 0 {
+		batch := w.drain()
+		if batch == nil {
+			break
+		}
+		batches = append(batches, batch)
+		if !w.spills {
+			break
+		}
+	}
+	return batches
+}
+
+// untrack subtracts the size of flushed rows, engines shared by several writers may return rows written by others
+func (w *writer) untrack(rows []cx.Vector) {
+	if w.bytes == 0 {
+		return
+	}
+	for _, row := range rows {
+		w.bytes -= w.estimate(row)
+	}
+	if w.bytes < 0 || w.pending() == 0 {
+		w.bytes = 0
+	}
 }
 
 // func (w *writer) runTicker() {
@@ -183,18 +371,13 @@ func (w *writer) flush() {
 
 // runBufferBridge writing to a temporary buffer to collect more data
 func (w *writer) runBufferBridge() {
-	ticker := time.NewTicker(time.Duration(w.writeOptions.FlushInterval()) * time.Millisecond)
+	interval := w.FlushInterval()
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	changed := w.writeOptions.watch()
 	defer func() {
 		ticker.Stop()
 		// flush last data
-		if w.bufferEngine.Len() > 0 {
-			w.flush()
-		}
-		w.mu.Lock()
-		// close buffer channel
-		close(w.bufferCh)
-		w.bufferCh = nil
-		w.mu.Unlock()
+		w.drainAll()
 		// send signal, buffer listener is done
 		w.doneCh <- struct{}{}
 		if w.writeOptions.isDebug {
@@ -206,18 +389,93 @@ func (w *writer) runBufferBridge() {
 	}
 	for {
 		select {
-		case vector := <-w.bufferCh:
-			w.bufferEngine.Write(vector)
-			if w.bufferEngine.Len() == int(w.writeOptions.BatchSize()) {
+		case item := <-w.bufferCh:
+			size := w.estimate(item.row)
+			// rows are flushed before the row that would exceed the limit of bytes
+			if w.bytes > 0 && w.bytes+size > int(w.writeOptions.MaxBatchBytes()) {
 				w.flush()
 			}
+			w.buffer(item, size)
+			if w.pending() >= int(w.BatchSize()) || w.bytesExceeded() {
+				w.flush()
+			}
+		case <-changed:
+			// batching is reconfigured, rows are flushed at once if they hit new limits
+			changed = w.writeOptions.watch()
+			if w.adaptive != nil {
+				w.adaptive.reset(w.writeOptions.Batching())
+			}
+			if w.pending() > 0 && (w.pending() >= int(w.BatchSize()) || w.bytesExceeded()) {
+				w.flush()
+			}
+		case reply := <-w.flushCh:
+			reply <- w.flushAll()
 		case <-w.bufferStop:
+			w.drainQueue()
 			return
 		case <-ticker.C:
-			if w.bufferEngine.Len() > 0 {
+			w.refresh()
+			if w.pending() > 0 {
 				w.flush()
 			}
 		}
+		// reconfiguration and adaptive batching change the flush interval
+		if current := w.FlushInterval(); current != interval && current > 0 {
+			interval = current
+			ticker.Reset(time.Duration(interval) * time.Millisecond)
+		}
+	}
+}
+
+// buffer writes the row of the intake queue to the buffer engine, or keeps it until the next batch if it waits for acknowledgement
+func (w *writer) buffer(item queued, size int) {
+	if item.ack != nil {
+		w.bufferAcked(item, size)
+		return
+	}
+	w.bytes += size
+	if err := w.bufferEngine.Write(w.context, item.row); err != nil {
+		w.outstanding.accept(-1)
+		w.bufferError(err)
+		return
+	}
+	w.rows++
+	w.observeBuffer()
+}
+
+// pending returns the number of rows waiting to be flushed
+func (w *writer) pending() int {
+	return w.rows + len(w.acked)
+}
+
+// refresh reads the length of the buffer engine, it may hold rows written by other writers or instances,
+// or rows left by the previous run
+func (w *writer) refresh() {
+	w.rows = w.bufferEngine.Len()
+	w.observeLength()
+}
+
+// estimate returns the estimated encoded size of the row, if the limit of bytes is set
+func (w *writer) estimate(row cx.Vector) int {
+	if w.writeOptions.MaxBatchBytes() == 0 {
+		return 0
+	}
+	return cx.EncodedSize(row)
+}
+
+func (w *writer) bytesExceeded() bool {
+	return w.writeOptions.MaxBatchBytes() > 0 && w.bytes >= int(w.writeOptions.MaxBatchBytes())
+}
+
+// drainQueue writes rows left in the intake queue to the buffer, so they are flushed on close
+func (w *writer) drainQueue() {
+	for {
+		select {
+		case item := <-w.bufferCh:
+			w.buffer(item, w.estimate(item.row))
+		default:
+			return
+		}
 	}
 }
 
@@ -243,15 +501,13 @@ func (w *writer) runClickhouseBridge() {
 			w.writeOptions.logger.Logf("stop clickhouse bridge: %s", w.view.Name)
 		}
 	}()
-	for {
-		select {
-		case batch := <-w.clickhouseCh:
-			err := w.client.WriteBatch(w.context, w.view, batch)
-			if err != nil && w.hasErrReader() {
-				w.errCh <- err
-			}
-		case <-w.writeStop:
-			return
-		}
+	wg := sync.WaitGroup{}
+	for i := 0; i < w.writeOptions.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.runInsertWorker()
+		}()
 	}
+	wg.Wait()
 }
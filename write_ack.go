@@ -0,0 +1,124 @@
+package clickhousebuffer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// Ack is the delivery acknowledgement of the row written with WriteRowAck.
+// It is resolved with nil once the batch containing the row is written into Clickhouse,
+// or with the final error when the batch is given up, including retries.
+// Rows rejected by the Writer resolve it immediately, e.g. with ErrWriterClosed or ErrQueueFull
+type Ack struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newAck() *Ack {
+	return &Ack{done: make(chan struct{})}
+}
+
+// Done returns a channel that is closed when the acknowledgement is resolved
+func (a *Ack) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err returns the result of delivery, it is nil until Done is closed
+func (a *Ack) Err() error {
+	select {
+	case <-a.done:
+		return a.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits for the result of delivery, or returns the error of the context
+func (a *Ack) Wait(ctx context.Context) error {
+	select {
+	case <-a.done:
+		return a.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *Ack) resolve(err error) {
+	a.once.Do(func() {
+		a.err = err
+		close(a.done)
+	})
+}
+
+// WriteRowAck same as WriteRowContext, but returns the acknowledgement of delivery.
+// Such rows bypass the buffer engine, they are kept in memory and added to the next batch,
+// so that the Writer knows the batch containing them. Persistent engines do not keep them over a crash,
+// so the producer should retry rows whose acknowledgement was not resolved.
+// Up to the batch size of them wait for the next batch, while spilling engines keep rows because the pipeline
+// is full, further rows wait for room in the pipeline or are dropped according to the backpressure policy
+func (w *writer) WriteRowAck(ctx context.Context, vec cx.Vectorable) *Ack {
+	return w.writeAck(ctx, vec.Row())
+}
+
+// WriteVectorAck same as WriteRowAck, but just uses inlined vector
+func (w *writer) WriteVectorAck(ctx context.Context, vec cx.Vector) *Ack {
+	return w.writeAck(ctx, vec)
+}
+
+func (w *writer) writeAck(ctx context.Context, vec cx.Vector) *Ack {
+	ack := newAck()
+	if err := w.write(ctx, queued{row: vec, ack: ack}); err != nil {
+		ack.resolve(err)
+	}
+	return ack
+}
+
+// bufferAcked keeps the row until the next batch, the number of kept rows is limited by the batch size
+func (w *writer) bufferAcked(item queued, size int) {
+	if len(w.acked) >= int(w.BatchSize()) {
+		switch w.writeOptions.backpressure {
+		case BackpressureDropNewest, BackpressureError:
+			_ = w.drop(item, ErrQueueFull)
+			return
+		case BackpressureDropOldest:
+			oldest := w.acked[0]
+			w.acked = w.acked[1:]
+			if w.bytes -= w.estimate(oldest.row); w.bytes < 0 {
+				w.bytes = 0
+			}
+			_ = w.drop(oldest, ErrRowEvicted)
+		case BackpressureBlock, BackpressureBlockTimeout:
+			// the rows are sent even if the pipeline is full, so the buffer bridge waits for room in it
+			w.drain()
+		}
+	}
+	w.bytes += size
+	w.acked = append(w.acked, item)
+	w.observeBuffer()
+}
+
+// batch creates the batch of rows read from the buffer engine and rows waiting for acknowledgement,
+// acknowledgements are resolved with the final result of the batch
+func (w *writer) batch(rows []cx.Vector) *cx.Batch {
+	if len(w.acked) == 0 {
+		return cx.NewBatch(rows)
+	}
+	// the capacity is limited, so that appending never writes into memory of the engine
+	rows = rows[:len(rows):len(rows)]
+	acks := make([]*Ack, 0, len(w.acked))
+	for _, item := range w.acked {
+		rows = append(rows, item.row)
+		acks = append(acks, item.ack)
+	}
+	w.acked = nil
+	batch := cx.NewBatch(rows)
+	batch.OnDone(func(err error) {
+		for _, ack := range acks {
+			ack.resolve(err)
+		}
+	})
+	return batch
+}
@@ -0,0 +1,167 @@
+package clickhousebuffer
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+const defaultTargetLatency = time.Second
+
+// ErrInvalidAdaptiveBounds is logged by NewOptions when adaptive batching is disabled because of invalid bounds
+var ErrInvalidAdaptiveBounds = errors.New("bounds of adaptive batching must be greater than zero, the minimum must not exceed the maximum")
+
+// validateAdaptive checks bounds of adaptive batching, bounds of the flush interval are optional
+func (o *Options) validateAdaptive() error {
+	if o.maxBatchSize == 0 && o.minBatchSize == 0 {
+		return nil
+	}
+	if o.minBatchSize == 0 || o.minBatchSize > o.maxBatchSize {
+		return ErrInvalidAdaptiveBounds
+	}
+	if o.maxFlushInterval == 0 && o.minFlushInterval == 0 {
+		return nil
+	}
+	if o.minFlushInterval == 0 || o.minFlushInterval > o.maxFlushInterval {
+		return ErrInvalidAdaptiveBounds
+	}
+	return nil
+}
+
+// checkAdaptive disables adaptive batching with invalid bounds, so that effective values never leave them
+func (o *Options) checkAdaptive() {
+	err := o.validateAdaptive()
+	if err == nil {
+		return
+	}
+	logger := o.logger
+	if logger == nil {
+		logger = cx.NewDefaultLogger()
+	}
+	logger.Logf("adaptive batching %d-%d rows, %d-%d ms is disabled: %v",
+		o.minBatchSize, o.maxBatchSize, o.minFlushInterval, o.maxFlushInterval, err,
+	)
+	o.minBatchSize, o.maxBatchSize, o.minFlushInterval, o.maxFlushInterval = 0, 0, 0, 0
+}
+
+// adaptive adjusts the effective batch size and flush interval of the Writer by the latency and errors of inserts.
+// Values grow by a quarter after fast inserts, shrink to three quarters after slow ones and to a half after overload errors
+type adaptive struct {
+	mu               sync.Mutex
+	batchSize        uint64
+	flushInterval    uint64
+	minBatchSize     uint
+	maxBatchSize     uint
+	minFlushInterval uint
+	maxFlushInterval uint
+	target           time.Duration
+}
+
+// newAdaptive returns the controller of adaptive batching, or nil if it is disabled
+func newAdaptive(o *Options) *adaptive {
+	if o.maxBatchSize == 0 {
+		return nil
+	}
+	a := &adaptive{
+		minBatchSize:     maxUint(o.minBatchSize, 1),
+		maxBatchSize:     o.maxBatchSize,
+		minFlushInterval: o.minFlushInterval,
+		maxFlushInterval: o.maxFlushInterval,
+		target:           o.targetLatency,
+	}
+	if a.target <= 0 {
+		a.target = defaultTargetLatency
+	}
+	a.reset(o.Batching())
+	return a
+}
+
+// reset starts adjusting from the parameters of batching, e.g. after Options.Reconfigure
+func (a *adaptive) reset(value Batching) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	atomic.StoreUint64(&a.batchSize, uint64(clamp(value.BatchSize, a.minBatchSize, a.maxBatchSize)))
+	interval := value.FlushInterval
+	if a.maxFlushInterval > 0 {
+		interval = clamp(interval, maxUint(a.minFlushInterval, 1), a.maxFlushInterval)
+	}
+	atomic.StoreUint64(&a.flushInterval, uint64(interval))
+}
+
+func (a *adaptive) BatchSize() uint {
+	return uint(atomic.LoadUint64(&a.batchSize))
+}
+
+func (a *adaptive) FlushInterval() uint {
+	return uint(atomic.LoadUint64(&a.flushInterval))
+}
+
+// observe adjusts values by the result of insert, errors not related to the load are ignored
+func (a *adaptive) observe(latency time.Duration, err error) {
+	switch {
+	case err != nil && cx.IsOverload(err):
+		a.scale(1, 2)
+	case err != nil:
+	case latency > a.target:
+		a.scale(3, 4)
+	case latency < a.target/2:
+		a.scale(5, 4)
+	}
+}
+
+// scale multiplies values by the fraction within the bounds
+func (a *adaptive) scale(numerator, denominator uint) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	atomic.StoreUint64(&a.batchSize, uint64(scaleWithin(a.BatchSize(), numerator, denominator, a.minBatchSize, a.maxBatchSize)))
+	if a.maxFlushInterval > 0 {
+		atomic.StoreUint64(&a.flushInterval, uint64(
+			scaleWithin(a.FlushInterval(), numerator, denominator, maxUint(a.minFlushInterval, 1), a.maxFlushInterval),
+		))
+	}
+}
+
+// scaleWithin changes the value by at least one, so that small values can grow
+func scaleWithin(value, numerator, denominator, lower, upper uint) uint {
+	scaled := value * numerator / denominator
+	if numerator > denominator && scaled == value {
+		scaled++
+	}
+	return clamp(scaled, lower, upper)
+}
+
+func clamp(value, lower, upper uint) uint {
+	if value < lower {
+		return lower
+	}
+	if value > upper {
+		return upper
+	}
+	return value
+}
+
+func maxUint(a, b uint) uint {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// BatchSize returns the effective batch size of the Writer, it changes at runtime with adaptive batching
+func (w *writer) BatchSize() uint {
+	if w.adaptive != nil {
+		return w.adaptive.BatchSize()
+	}
+	return w.writeOptions.BatchSize()
+}
+
+// FlushInterval returns the effective flush interval of the Writer in ms, it changes at runtime with adaptive batching
+func (w *writer) FlushInterval() uint {
+	if w.adaptive != nil {
+		return w.adaptive.FlushInterval()
+	}
+	return w.writeOptions.FlushInterval()
+}
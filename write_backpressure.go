@@ -0,0 +1,133 @@
+package clickhousebuffer
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// Backpressure determines what the Writer does with a row, when its intake queue is full
+type Backpressure int
+
+const (
+	// BackpressureBlock waits until there is room in the queue, default policy
+	BackpressureBlock Backpressure = iota
+	// BackpressureBlockTimeout waits for the timeout set by WithBlockTimeout, then drops the row
+	BackpressureBlockTimeout
+	// BackpressureDropNewest drops the written row
+	BackpressureDropNewest
+	// BackpressureDropOldest drops the oldest row of the queue to make room for the written one,
+	// the written row is dropped with ErrQueueFull if concurrent writers keep taking the room
+	BackpressureDropOldest
+	// BackpressureError rejects the written row with ErrQueueFull
+	BackpressureError
+)
+
+const (
+	defaultBlockTimeout = time.Second
+	// number of evictions of BackpressureDropOldest to make room for the row, before it is dropped itself
+	evictAttempts = 3
+)
+
+var (
+	// ErrQueueFull is reported for rows rejected because the intake queue of the Writer is full
+	ErrQueueFull = errors.New("writer queue is full")
+	// ErrRowEvicted is reported for rows removed from the queue to make room for newer ones
+	ErrRowEvicted = errors.New("row is evicted from writer queue")
+)
+
+// DropFunc is called for every row dropped by the backpressure policy with the reason
+type DropFunc func(row cx.Vector, reason error)
+
+// queueCapacity returns the capacity of the intake queue, policies other than blocking need a buffered queue,
+// so the batch size is used by default
+func (o *Options) queueCapacity() int {
+	if o.queueSize == 0 && o.backpressure != BackpressureBlock {
+		return int(o.BatchSize())
+	}
+	return int(o.queueSize)
+}
+
+// enqueue puts the row to the intake queue according to the backpressure policy.
+// Waiting for room in the queue is interrupted by the context, rows dropped by the policy
+// are reported to the caller only with BackpressureError and BackpressureBlockTimeout
+func (w *writer) enqueue(ctx context.Context, row queued) error {
+	// the row is counted before it is queued, so the buffer bridge never flushes rows that were not counted
+	w.outstanding.accept(1)
+	switch w.writeOptions.backpressure {
+	case BackpressureBlockTimeout:
+		timeout := w.writeOptions.blockTimeout
+		if timeout <= 0 {
+			timeout = defaultBlockTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case w.bufferCh <- row:
+		case <-ctx.Done():
+			w.outstanding.accept(-1)
+			return ctx.Err()
+		case <-timer.C:
+			return w.drop(row, ErrQueueFull)
+		}
+	case BackpressureDropNewest:
+		select {
+		case w.bufferCh <- row:
+		default:
+			_ = w.drop(row, ErrQueueFull)
+		}
+	case BackpressureError:
+		select {
+		case w.bufferCh <- row:
+		default:
+			return w.drop(row, ErrQueueFull)
+		}
+	case BackpressureDropOldest:
+		for attempt := 0; attempt < evictAttempts; attempt++ {
+			select {
+			case w.bufferCh <- row:
+				return nil
+			default:
+			}
+			select {
+			case oldest := <-w.bufferCh:
+				_ = w.drop(oldest, ErrRowEvicted)
+			default:
+			}
+		}
+		// concurrent writers take the room faster, the row is dropped as with BackpressureDropNewest
+		_ = w.drop(row, ErrQueueFull)
+	default:
+		select {
+		case w.bufferCh <- row:
+		case <-ctx.Done():
+			w.outstanding.accept(-1)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// drop counts the row and passes it to the drop callback, the acknowledgement of the row is resolved with the reason
+func (w *writer) drop(row queued, reason error) error {
+	w.outstanding.accept(-1)
+	atomic.AddUint64(&w.dropped, 1)
+	if w.writeOptions.onDrop != nil {
+		w.writeOptions.onDrop(row.row, reason)
+	}
+	if w.hooks != nil {
+		w.hooks.OnDrop(newHookEvent(w.hooks, w.view, []cx.Vector{row.row}, 0, reason))
+	}
+	if row.ack != nil {
+		row.ack.resolve(reason)
+	}
+	return reason
+}
+
+// Dropped returns the number of rows dropped by the backpressure policy
+func (w *writer) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
@@ -0,0 +1,95 @@
+package clickhousebuffer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+	"github.com/zikwall/clickhouse-buffer/v4/src/retry"
+)
+
+// WriteError describes the failed insert of the batch, it is returned by Client.WriteBatch and sent to Writer.Errors.
+// The underlying error is available with errors.Is and errors.As
+type WriteError struct {
+	View  cx.View
+	Batch *cx.Batch
+	// Attempt is the number of inserts of the batch made so far, one for the first insert
+	Attempt int
+	// Code of the Clickhouse exception, zero if the error is not an exception
+	Code int32
+	// Retried is true if the batch was scheduled for retry, its final failure is reported once more then,
+	// see WithErrorCallback and WithErrorBuffer
+	Retried bool
+	Err     error
+}
+
+func newWriteError(view cx.View, batch *cx.Batch, err error, retried bool) *WriteError {
+	attempt := 1
+	var lost *retry.LostError
+	if errors.As(err, &lost) {
+		attempt = lost.Attempts
+	}
+	return &WriteError{
+		View:    view,
+		Batch:   batch,
+		Attempt: attempt,
+		Code:    cx.ExceptionCode(err),
+		Retried: retried,
+		Err:     err,
+	}
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("write %d rows to %s, attempt %d: %v", len(e.Batch.Rows()), e.View.Name, e.Attempt, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorFunc receives errors of the Writer, it is called by insert workers and must not block
+type ErrorFunc func(err error)
+
+// reportError sends the error to the callback and to the errors channel, returns false if nobody receives errors.
+// If the channel is buffered and full, the error is logged instead, so that slow readers do not stall inserts.
+// Errors of the retry worker are not sent to the unbuffered channel, it would stall retries of all writers
+func (w *writer) reportError(err error, fromRetry bool) bool {
+	received := false
+	if w.writeOptions.onError != nil {
+		w.writeOptions.onError(err)
+		received = true
+	}
+	if !w.hasErrReader() {
+		return received
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	// the channel is closed with the Writer, final results of retries may come later
+	if w.errCh == nil || (fromRetry && w.writeOptions.errorBuffer == 0) {
+		return received
+	}
+	if w.writeOptions.errorBuffer == 0 {
+		w.errCh <- err
+		return true
+	}
+	select {
+	case w.errCh <- err:
+	default:
+		w.writeOptions.logger.Logf("errors of %s are not read: %v", w.view.Name, err)
+	}
+	return true
+}
+
+// insertError reports the failed insert, the final failure of the retried batch is reported when it is done,
+// to the callback and to the buffered errors channel
+func (w *writer) insertError(err error) {
+	w.reportError(err, false)
+	var writeErr *WriteError
+	if errors.As(err, &writeErr) && writeErr.Retried {
+		writeErr.Batch.OnDone(func(err error) {
+			if err != nil {
+				w.reportError(newWriteError(w.view, writeErr.Batch, err, false), true)
+			}
+		})
+	}
+}
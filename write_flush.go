@@ -0,0 +1,127 @@
+package clickhousebuffer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// Flush sends rows written before the call to Clickhouse and waits for the result of their inserts, including retries.
+// Batches flushed earlier and still being inserted are waited for as well.
+// It returns the first error of inserts, the error of the context, or ErrWriterClosed after Close
+func (w *writer) Flush(ctx context.Context) error {
+	reply := make(chan []*cx.Batch, 1)
+	if err := w.requestFlush(ctx, reply); err != nil {
+		return err
+	}
+	select {
+	case batches := <-reply:
+		return waitBatches(ctx, batches)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *writer) requestFlush(ctx context.Context, reply chan []*cx.Batch) error {
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	select {
+	case w.flushCh <- reply:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushAll sends all pending rows to Clickhouse, including rows of the intake queue,
+// and returns sent batches together with batches that were not inserted yet
+func (w *writer) flushAll() []*cx.Batch {
+	// sent batches may be done before they would be listed
+	batches := w.outstanding.list()
+	w.drainQueue()
+	return append(batches, w.drainAll()...)
+}
+
+// outstanding holds batches sent to Clickhouse until their final result
+type outstanding struct {
+	mu      sync.Mutex
+	batches map[*cx.Batch]struct{}
+	// number of rows of batches completed with an error
+	failed uint64
+	// number of rows written to the Writer and not sent to Clickhouse yet
+	unflushed int
+}
+
+// accept adds the number of rows written to the Writer, rows that were dropped are subtracted
+func (o *outstanding) accept(rows int) {
+	o.mu.Lock()
+	o.unflushed += rows
+	o.mu.Unlock()
+}
+
+// add tracks the batch sent to Clickhouse, its rows are not counted as unflushed anymore
+func (o *outstanding) add(batch *cx.Batch) {
+	o.mu.Lock()
+	o.batches[batch] = struct{}{}
+	o.unflushed -= len(batch.Rows())
+	o.mu.Unlock()
+	batch.OnDone(func(err error) {
+		o.mu.Lock()
+		if err != nil {
+			o.failed += uint64(len(batch.Rows()))
+		}
+		delete(o.batches, batch)
+		o.mu.Unlock()
+	})
+}
+
+// undelivered returns the number of rows of failed batches and of rows without the final result,
+// including rows that were not sent yet. Counts are taken together, so rows being flushed are counted once
+func (o *outstanding) undelivered() (failed, pending uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for batch := range o.batches {
+		pending += uint64(len(batch.Rows()))
+	}
+	// engines shared by several writers may return rows written by others
+	if o.unflushed > 0 {
+		pending += uint64(o.unflushed)
+	}
+	return o.failed, pending
+}
+
+func (o *outstanding) list() []*cx.Batch {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	batches := make([]*cx.Batch, 0, len(o.batches))
+	for batch := range o.batches {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// waitBatches waits for the final result of batches, returns the first error
+func waitBatches(ctx context.Context, batches []*cx.Batch) error {
+	results := make(chan error, len(batches))
+	for _, batch := range batches {
+		batch.OnDone(func(err error) {
+			results <- err
+		})
+	}
+	var first error
+	for range batches {
+		select {
+		case err := <-results:
+			if err != nil && first == nil {
+				first = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return first
+}
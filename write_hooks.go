@@ -0,0 +1,94 @@
+package clickhousebuffer
+
+import (
+	"time"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// Hooks are called at key points of the lifecycle of batches, they are called synchronously and must not block.
+// Embed NopHooks to implement only some of the methods
+type Hooks interface {
+	// OnFlush is called when the Writer sends the batch to insert
+	OnFlush(event HookEvent)
+	// OnInsertSuccess is called when the batch is inserted, by the Writer or by the retry worker
+	OnInsertSuccess(event HookEvent)
+	// OnInsertError is called when the insert of the Writer fails, Err is *WriteError
+	OnInsertError(event HookEvent)
+	// OnRetry is called when the retry worker queues the batch for the next retry cycle
+	OnRetry(event HookEvent)
+	// OnDrop is called when rows are given up: by the retry worker, or by the backpressure policy of the Writer
+	OnDrop(event HookEvent)
+}
+
+// HookEvent describes the batch passed to Hooks
+type HookEvent struct {
+	View string
+	Rows int
+	// estimated size of rows sent to Clickhouse in bytes, see cx.EncodedSize
+	Bytes int
+	// duration of the insert, or of the retry cycle, zero for flushes and drops of the backpressure policy
+	Latency time.Duration
+	Err     error
+}
+
+// NopHooks implements Hooks doing nothing
+type NopHooks struct{}
+
+func (NopHooks) OnFlush(HookEvent)         {}
+func (NopHooks) OnInsertSuccess(HookEvent) {}
+func (NopHooks) OnInsertError(HookEvent)   {}
+func (NopHooks) OnRetry(HookEvent)         {}
+func (NopHooks) OnDrop(HookEvent)          {}
+
+// newHookEvent describes the batch passed to the hooks, the size of rows is estimated only for hooks set by WithHooks,
+// metrics do not report it, while the estimation walks every value of every row
+func newHookEvent(hooks Hooks, view cx.View, rows []cx.Vector, latency time.Duration, err error) HookEvent {
+	event := HookEvent{View: view.Name, Rows: len(rows), Latency: latency, Err: err}
+	if _, ok := hooks.(metricsHooks); ok {
+		return event
+	}
+	for _, row := range rows {
+		event.Bytes += cx.EncodedSize(row)
+	}
+	return event
+}
+
+// retryObserver passes results of retry cycles to Hooks of the Writer of the view
+type retryObserver struct {
+	client *clientImpl
+}
+
+// hooks updates the depth of the retry queue and returns hooks of the view
+func (r retryObserver) hooks(view cx.View) Hooks {
+	options := r.client.optionsOf(view)
+	r.client.observeRetryQueue(options)
+	return options.lifecycle()
+}
+
+func (r retryObserver) OnSuccess(view cx.View, batch *cx.Batch, latency time.Duration) {
+	if hooks := r.hooks(view); hooks != nil {
+		hooks.OnInsertSuccess(newHookEvent(hooks, view, batch.Rows(), latency, nil))
+	}
+}
+
+func (r retryObserver) OnRequeue(view cx.View, batch *cx.Batch, latency time.Duration, err error) {
+	if hooks := r.hooks(view); hooks != nil {
+		hooks.OnRetry(newHookEvent(hooks, view, batch.Rows(), latency, err))
+	}
+}
+
+func (r retryObserver) OnLost(view cx.View, batch *cx.Batch, latency time.Duration, err error) {
+	if hooks := r.hooks(view); hooks != nil {
+		hooks.OnDrop(newHookEvent(hooks, view, batch.Rows(), latency, err))
+	}
+}
+
+// optionsOf returns options of the Writer of the view, or options of the client for blocking writes.
+// They are kept apart from writers, because Close holds the lock of writers while inserts may be retried
+func (c *clientImpl) optionsOf(view cx.View) *Options {
+	if options, ok := c.viewOptions.Load(view.Name); ok {
+		return options.(*Options)
+	}
+	return c.options
+}
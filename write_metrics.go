@@ -0,0 +1,127 @@
+package clickhousebuffer
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/metrics"
+)
+
+// metricsHooks passes events of batches to the metrics.Collector
+type metricsHooks struct {
+	collector metrics.Collector
+}
+
+func (m metricsHooks) OnFlush(event HookEvent) {
+	view := viewLabel(event)
+	m.collector.Add(metrics.RowsFlushed, float64(event.Rows), view)
+	m.collector.Add(metrics.Batches, 1, view)
+}
+
+func (m metricsHooks) OnInsertSuccess(event HookEvent) {
+	m.collector.Observe(metrics.InsertDuration, event.Latency.Seconds(), viewLabel(event))
+}
+
+func (m metricsHooks) OnInsertError(event HookEvent) {
+	view := viewLabel(event)
+	m.collector.Observe(metrics.InsertDuration, event.Latency.Seconds(), view)
+	var writeErr *WriteError
+	code := int32(0)
+	if errors.As(event.Err, &writeErr) {
+		code = writeErr.Code
+		if writeErr.Retried {
+			m.collector.Add(metrics.Retries, 1, view)
+		}
+	}
+	m.collector.Add(metrics.Errors, 1, view, metrics.Label{Name: metrics.LabelCode, Value: strconv.Itoa(int(code))})
+}
+
+func (m metricsHooks) OnRetry(event HookEvent) {
+	view := viewLabel(event)
+	m.collector.Observe(metrics.InsertDuration, event.Latency.Seconds(), view)
+	m.collector.Add(metrics.Retries, 1, view)
+}
+
+func (m metricsHooks) OnDrop(event HookEvent) {
+	view := viewLabel(event)
+	// drops of the backpressure policy have no insert
+	if event.Latency > 0 {
+		m.collector.Observe(metrics.InsertDuration, event.Latency.Seconds(), view)
+	}
+	m.collector.Add(metrics.Drops, float64(event.Rows), view)
+}
+
+func viewLabel(event HookEvent) metrics.Label {
+	return metrics.Label{Name: metrics.LabelView, Value: event.View}
+}
+
+// hooksList calls all hooks in turn
+type hooksList []Hooks
+
+func (l hooksList) OnFlush(event HookEvent) {
+	for _, hooks := range l {
+		hooks.OnFlush(event)
+	}
+}
+
+func (l hooksList) OnInsertSuccess(event HookEvent) {
+	for _, hooks := range l {
+		hooks.OnInsertSuccess(event)
+	}
+}
+
+func (l hooksList) OnInsertError(event HookEvent) {
+	for _, hooks := range l {
+		hooks.OnInsertError(event)
+	}
+}
+
+func (l hooksList) OnRetry(event HookEvent) {
+	for _, hooks := range l {
+		hooks.OnRetry(event)
+	}
+}
+
+func (l hooksList) OnDrop(event HookEvent) {
+	for _, hooks := range l {
+		hooks.OnDrop(event)
+	}
+}
+
+// lifecycle returns Hooks together with hooks of metrics, nil if neither is set
+func (o *Options) lifecycle() Hooks {
+	switch {
+	case o.metrics == nil:
+		return o.hooks
+	case o.hooks == nil:
+		return metricsHooks{collector: o.metrics}
+	}
+	return hooksList{o.hooks, metricsHooks{collector: o.metrics}}
+}
+
+// observeBuffer counts the row written to the buffer and updates the length of the buffer
+func (w *writer) observeBuffer() {
+	if m := w.writeOptions.metrics; m != nil {
+		m.Add(metrics.RowsReceived, 1, w.labels...)
+	}
+	w.observeLength()
+}
+
+// observeLength updates the length of the buffer counted by the Writer, the engine is not asked for it,
+// rows of other writers or instances sharing the engine are visible after the engine length is refreshed by the ticker
+func (w *writer) observeLength() {
+	if m := w.writeOptions.metrics; m != nil {
+		m.Set(metrics.BufferLength, float64(w.pending()), w.labels...)
+	}
+}
+
+// observeRetryQueue updates the depth of the retry queue
+func (c *clientImpl) observeRetryQueue(options *Options) {
+	if options.metrics == nil {
+		return
+	}
+	if r := c.RetryClient(); r != nil {
+		_, _, progress := r.Metrics()
+		options.metrics.Set(metrics.RetryQueueDepth, float64(progress))
+	}
+}
@@ -1,17 +1,17 @@
 package clickhousebuffer
 
 import (
+	"time"
+
 	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+	"github.com/zikwall/clickhouse-buffer/v4/src/metrics"
 	"github.com/zikwall/clickhouse-buffer/v4/src/retry"
 )
 
 // Options holds write configuration properties
 type Options struct {
-	// Maximum number of rows sent to server in single request. Default 5000
-	batchSize uint
-	// Interval, in ms, in which is buffer flushed if it has not been already written (by reaching batch size).
-	// Default 1000ms
-	flushInterval uint
+	// batch size, flush interval and limit of bytes, they can be changed on live writers, see Batching
+	batching *batching
 	// Debug mode
 	isDebug bool
 	// retry.Retry is enabled
@@ -20,42 +20,73 @@ type Options struct {
 	logger cx.Logger
 	// retry.Queueable with
 	queue retry.Queueable
+	// capacity of the intake queue of the Writer, default 0 (unbuffered)
+	queueSize uint
+	// what to do with a row when the intake queue is full, default BackpressureBlock
+	backpressure Backpressure
+	// how long BackpressureBlockTimeout waits for room in the queue
+	blockTimeout time.Duration
+	// called for rows dropped by the backpressure policy
+	onDrop DropFunc
+	// number of concurrent inserts of the Writer, default 1
+	insertWorkers uint
+	// number of batches waiting for a free insert worker, default 0
+	pipelineDepth uint
+	// batches are inserted strictly one after another
+	orderedInserts bool
+	// bounds of adaptive batching, it is disabled while the maximum is zero
+	minBatchSize     uint
+	maxBatchSize     uint
+	minFlushInterval uint
+	maxFlushInterval uint
+	// inserts faster than a half of it grow batches, slower ones shrink them
+	targetLatency time.Duration
+	// timeout of a single insert, default 0 (the timeout of the cx.Clickhouse implementation is used)
+	insertTimeout time.Duration
+	// Client.Shutdown closes the cx.Clickhouse connection
+	closeClickhouse bool
+	// capacity of the channel of Writer.Errors, default 0 (unbuffered, inserts wait for the reader)
+	errorBuffer uint
+	// receives errors of the Writer in addition to Writer.Errors
+	onError ErrorFunc
+	// called at key points of the lifecycle of batches
+	hooks Hooks
+	// receives metrics of writers and the retry worker
+	metrics metrics.Collector
 }
 
 // BatchSize returns size of batch
 func (o *Options) BatchSize() uint {
-	return o.batchSize
+	return o.Batching().BatchSize
 }
 
-// SetBatchSize sets number of rows sent in single request, it would be a good practice to remove this function,
-// but it is convenient for testing. DO NOT USE in parallel environments
+// SetBatchSize sets number of rows sent in single request, it is safe to call on live writers
 func (o *Options) SetBatchSize(batchSize uint) *Options {
-	o.batchSize = batchSize
+	o.updateBatching(func(b *Batching) {
+		b.BatchSize = batchSize
+	})
 	return o
 }
 
+// MaxBatchBytes returns the limit of estimated encoded size of batch in bytes, zero if it is not set
+func (o *Options) MaxBatchBytes() uint {
+	return o.Batching().MaxBatchBytes
+}
+
 // FlushInterval returns flush interval in ms
 func (o *Options) FlushInterval() uint {
-	return o.flushInterval
+	return o.Batching().FlushInterval
 }
 
-// SetFlushInterval sets flush interval in ms in which is buffer flushed if it has not been already written
-// it would be a good practice to remove this function,
-// but it is convenient for testing. DO NOT USE in parallel environments
+// SetFlushInterval sets flush interval in ms in which is buffer flushed if it has not been already written,
+// it is safe to call on live writers
 func (o *Options) SetFlushInterval(flushIntervalMs uint) *Options {
-	o.flushInterval = flushIntervalMs
+	o.updateBatching(func(b *Batching) {
+		b.FlushInterval = flushIntervalMs
+	})
 	return o
 }
 
-// for multithreading systems, you can implement something like this:
-//
-// func (o *Options) ConcurrentlySetFlushInterval(flushIntervalMs uint) *Options {
-//   o.mx.Lock()
-//	 o.flushInterval = flushIntervalMs
-//   o.mx.Unlock()
-//	 return o
-// }
-
 // SetDebugMode set debug mode, for logs and errors
 //
 // Deprecated: use WithDebugMode function with NewOptions
@@ -90,13 +121,24 @@ func (o *Options) SetQueueEngine(queue retry.Queueable) *Options {
 
 func WithBatchSize(size uint) Option {
 	return func(o *Options) {
-		o.batchSize = size
+		o.SetBatchSize(size)
+	}
+}
+
+// WithMaxBatchBytes sets the limit of estimated encoded size of batch in bytes, the Writer flushes rows when any limit is hit:
+// the batch size, the size in bytes or the flush interval. The size is estimated in the RowBinary format,
+// see cx.EncodedSize, so the limit should leave a margin below the limits of Clickhouse
+func WithMaxBatchBytes(size uint) Option {
+	return func(o *Options) {
+		o.updateBatching(func(b *Batching) {
+			b.MaxBatchBytes = size
+		})
 	}
 }
 
 func WithFlushInterval(interval uint) Option {
 	return func(o *Options) {
-		o.flushInterval = interval
+		o.SetFlushInterval(interval)
 	}
 }
 
@@ -124,17 +166,157 @@ func WithRetryQueueEngine(queue retry.Queueable) Option {
 	}
 }
 
+// WithQueueSize sets the capacity of the intake queue of the Writer, rows are queued while the buffer
+// is being flushed. Default 0, policies other than BackpressureBlock use the batch size by default
+func WithQueueSize(size uint) Option {
+	return func(o *Options) {
+		o.queueSize = size
+	}
+}
+
+// WithBackpressure sets what the Writer does with a row when the intake queue is full, default BackpressureBlock
+func WithBackpressure(policy Backpressure) Option {
+	return func(o *Options) {
+		o.backpressure = policy
+	}
+}
+
+// WithBlockTimeout sets how long BackpressureBlockTimeout waits for room in the queue, default 1s
+func WithBlockTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.blockTimeout = timeout
+	}
+}
+
+// WithDropCallback sets the function called for every row dropped by the backpressure policy
+func WithDropCallback(fn DropFunc) Option {
+	return func(o *Options) {
+		o.onDrop = fn
+	}
+}
+
+// WithInsertWorkers sets the number of concurrent inserts of every Writer, default 1.
+// Batches are inserted in any order then, use WithOrderedInserts if the order matters
+func WithInsertWorkers(workers uint) Option {
+	return func(o *Options) {
+		o.insertWorkers = workers
+	}
+}
+
+// WithPipelineDepth sets the number of batches waiting for a free insert worker, default 0.
+// The Writer keeps accepting and flushing rows while inserts are in flight, until the pipeline is full
+func WithPipelineDepth(depth uint) Option {
+	return func(o *Options) {
+		o.pipelineDepth = depth
+	}
+}
+
+// WithOrderedInserts makes batches to be inserted strictly one after another in the order they were flushed,
+// the number of insert workers is ignored then. A batch given to the retry queue holds the next batches
+// until it is written or given up, so the Writer stops inserting while Clickhouse is unavailable
+func WithOrderedInserts(ordered bool) Option {
+	return func(o *Options) {
+		o.orderedInserts = ordered
+	}
+}
+
+// WithAdaptiveBatchSize enables adaptive batching: the effective batch size of every Writer
+// is adjusted at runtime within the bounds, starting from the batch size set by WithBatchSize.
+// Fast inserts grow batches to reduce the number of parts, slow inserts and overload errors shrink them,
+// see Writer.BatchSize and cx.IsOverload. Bounds must be greater than zero, otherwise adaptive batching is disabled
+func WithAdaptiveBatchSize(minSize, maxSize uint) Option {
+	return func(o *Options) {
+		o.minBatchSize = minSize
+		o.maxBatchSize = maxSize
+	}
+}
+
+// WithAdaptiveFlushInterval sets the bounds of the flush interval in ms adjusted together with the batch size,
+// the flush interval stays as is without them. Invalid bounds disable adaptive batching, see ErrInvalidAdaptiveBounds
+func WithAdaptiveFlushInterval(minInterval, maxInterval uint) Option {
+	return func(o *Options) {
+		o.minFlushInterval = minInterval
+		o.maxFlushInterval = maxInterval
+	}
+}
+
+// WithTargetLatency sets the latency of inserts targeted by adaptive batching, default 1s
+func WithTargetLatency(latency time.Duration) Option {
+	return func(o *Options) {
+		o.targetLatency = latency
+	}
+}
+
+// WithInsertTimeout sets the timeout of a single insert of the Writer,
+// it is applied in addition to cx.RuntimeOptions of the Clickhouse connection
+func WithInsertTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.insertTimeout = timeout
+	}
+}
+
+// WithCloseClickhouse makes Client.Shutdown close the cx.Clickhouse connection after all rows are delivered
+func WithCloseClickhouse(enabled bool) Option {
+	return func(o *Options) {
+		o.closeClickhouse = enabled
+	}
+}
+
+// WithErrorBuffer makes the channel of Writer.Errors buffered, errors are logged instead of sent while it is full,
+// so that a slow reader does not stall inserts. Final failures of retried batches are sent only to the buffered channel
+func WithErrorBuffer(size uint) Option {
+	return func(o *Options) {
+		o.errorBuffer = size
+	}
+}
+
+// WithErrorCallback sets the function receiving errors of the Writer, it is called by insert workers and must not block
+func WithErrorCallback(fn ErrorFunc) Option {
+	return func(o *Options) {
+		o.onError = fn
+	}
+}
+
+// WithHooks sets Hooks called when batches are flushed, inserted, failed, retried or dropped
+func WithHooks(hooks Hooks) Option {
+	return func(o *Options) {
+		o.hooks = hooks
+	}
+}
+
+// WithMetrics sets the metrics.Collector receiving metrics of writers and the retry worker, e.g. metrics.Registry
+func WithMetrics(collector metrics.Collector) Option {
+	return func(o *Options) {
+		o.metrics = collector
+	}
+}
+
 type Option func(o *Options)
 
+// override returns a copy of options with changes, or the same options if there are no changes
+func (o *Options) override(options []Option) *Options {
+	if len(options) == 0 {
+		return o
+	}
+	copied := *o
+	// the Writer is reconfigured separately from the client then
+	copied.batching = newBatching(o.Batching())
+	for _, option := range options {
+		option(&copied)
+	}
+	copied.checkAdaptive()
+	return &copied
+}
+
 // NewOptions returns Options object with the ability to set your own parameters
 func NewOptions(options ...Option) *Options {
 	o := &Options{
-		batchSize:     2000,
-		flushInterval: 2000,
+		batching: newBatching(Batching{BatchSize: 2000, FlushInterval: 2000}),
 	}
 	for _, option := range options {
 		option(o)
 	}
+	o.checkAdaptive()
 	return o
 }
 
@@ -143,7 +325,6 @@ func NewOptions(options ...Option) *Options {
 // Deprecated: use NewOptions function with Option callbacks
 func DefaultOptions() *Options {
 	return &Options{
-		batchSize:     5000,
-		flushInterval: 1000,
+		batching: newBatching(Batching{BatchSize: 5000, FlushInterval: 1000}),
 	}
 }
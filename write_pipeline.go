@@ -0,0 +1,120 @@
+package clickhousebuffer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// workers returns the number of insert workers of the Writer
+func (o *Options) workers() int {
+	if o.orderedInserts || o.insertWorkers == 0 {
+		return 1
+	}
+	return int(o.insertWorkers)
+}
+
+// pipelineCapacity returns the number of batches that can be flushed before the Writer waits for inserts
+func (o *Options) pipelineCapacity() int {
+	return o.workers() + int(o.pipelineDepth)
+}
+
+// runInsertWorker writes batches of the pipeline to Clickhouse,
+// batches left in the pipeline are written before the worker stops
+func (w *writer) runInsertWorker() {
+	for {
+		select {
+		case next := <-w.clickhouseCh:
+			w.insert(next)
+		case <-w.writeStop:
+			for {
+				select {
+				case next := <-w.clickhouseCh:
+					w.insert(next)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *writer) insert(next flushed) {
+	start := time.Now()
+	err := w.writeBatch(next.batch)
+	latency := time.Since(start)
+	if w.writeOptions.orderedInserts {
+		// a batch given to the retry queue is completed later, the next batch must not overtake it
+		w.awaitDone(next.batch)
+	}
+	atomic.AddInt32(&w.inflight, -1)
+	if w.adaptive != nil {
+		w.adaptive.observe(latency, err)
+	}
+	if err != nil {
+		w.insertError(err)
+	}
+}
+
+// awaitDone waits for the final result of the batch, including retries, or for the context of the Writer
+func (w *writer) awaitDone(batch *cx.Batch) {
+	done := make(chan struct{})
+	batch.OnDone(func(error) {
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-w.context.Done():
+	}
+}
+
+// batchWriter is implemented by the client, so that batches are written with options of the Writer
+type batchWriter interface {
+	writeBatch(ctx context.Context, view cx.View, batch *cx.Batch, options *Options) error
+}
+
+func (w *writer) writeBatch(batch *cx.Batch) error {
+	if client, ok := w.client.(batchWriter); ok {
+		return client.writeBatch(w.context, w.view, batch, w.writeOptions)
+	}
+	// other clients do not complete batches, so Flush and acknowledgements would never resolve
+	err := w.client.WriteBatch(w.context, w.view, batch)
+	batch.Done(err)
+	return err
+}
+
+// ackSequencer forwards results of batches to the engine in the order the batches were read,
+// while insert workers may finish them in any order
+type ackSequencer struct {
+	engine cx.Acknowledger
+	mu     sync.Mutex
+	last   uint64
+	ready  map[uint64]ackResult
+}
+
+type ackResult struct {
+	batch *cx.Batch
+	err   error
+}
+
+func newAckSequencer(engine cx.Acknowledger) *ackSequencer {
+	return &ackSequencer{engine: engine, ready: map[uint64]ackResult{}}
+}
+
+func (a *ackSequencer) done(next flushed, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ready[next.sequence] = ackResult{batch: next.batch, err: err}
+	for {
+		result, ok := a.ready[a.last+1]
+		if !ok {
+			return
+		}
+		delete(a.ready, a.last+1)
+		a.last++
+		a.engine.Ack(result.batch, result.err)
+	}
+}
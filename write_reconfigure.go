@@ -0,0 +1,116 @@
+package clickhousebuffer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zikwall/clickhouse-buffer/v4/src/cx"
+)
+
+// ErrInvalidBatching is returned by Reconfigure on zero batch size or flush interval
+var ErrInvalidBatching = errors.New("batch size and flush interval must be greater than zero")
+
+// Batching holds parameters of batching, they can be changed on live writers with Options.Reconfigure
+type Batching struct {
+	// Maximum number of rows sent to server in single request
+	BatchSize uint
+	// Interval, in ms, in which is buffer flushed if it has not been already written
+	FlushInterval uint
+	// Maximum estimated size of rows sent to server in single request, in bytes, zero means no limit
+	MaxBatchBytes uint
+}
+
+// batching holds current parameters, writers are notified about changes by closing of the channel
+type batching struct {
+	value   atomic.Value
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+func newBatching(value Batching) *batching {
+	b := &batching{changed: make(chan struct{})}
+	b.value.Store(value)
+	return b
+}
+
+func (b *batching) load() Batching {
+	return b.value.Load().(Batching)
+}
+
+func (b *batching) update(fn func(value *Batching)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	value := b.load()
+	fn(&value)
+	b.value.Store(value)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *batching) watch() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.changed
+}
+
+// Batching returns current parameters of batching
+func (o *Options) Batching() Batching {
+	if o.batching == nil {
+		return Batching{}
+	}
+	return o.batching.load()
+}
+
+func (o *Options) updateBatching(fn func(value *Batching)) {
+	// options created without NewOptions
+	if o.batching == nil {
+		o.batching = newBatching(Batching{})
+	}
+	o.batching.update(fn)
+}
+
+// watch returns a channel closed on the next change of batching
+func (o *Options) watch() <-chan struct{} {
+	if o.batching == nil {
+		return nil
+	}
+	return o.batching.watch()
+}
+
+// Reconfigure changes all parameters of batching at once, live writers using the options apply them immediately.
+// Writers created without options share options of the client, see Writer.Options
+func (o *Options) Reconfigure(value Batching) error {
+	if value.BatchSize == 0 || value.FlushInterval == 0 {
+		return ErrInvalidBatching
+	}
+	o.updateBatching(func(b *Batching) {
+		*b = value
+	})
+	return nil
+}
+
+// Subscribe applies parameters of batching received from the channel, e.g. from a config system,
+// until the channel is closed or the context is done. Invalid parameters are logged and skipped
+func (o *Options) Subscribe(ctx context.Context, updates <-chan Batching) {
+	logger := o.logger
+	if logger == nil {
+		logger = cx.NewDefaultLogger()
+	}
+	go func() {
+		for {
+			select {
+			case value, ok := <-updates:
+				if !ok {
+					return
+				}
+				if err := o.Reconfigure(value); err != nil {
+					logger.Logf("reconfigure %+v: %v", value, err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
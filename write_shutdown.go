@@ -0,0 +1,56 @@
+package clickhousebuffer
+
+import (
+	"context"
+	"fmt"
+)
+
+// ShutdownError is returned by Client.Shutdown if some rows were not delivered to Clickhouse
+type ShutdownError struct {
+	// Undelivered holds the number of rows that were not delivered by name of the table
+	Undelivered map[string]int
+	// Err is the cause, e.g. the error of the context or of closing the connection
+	Err error
+}
+
+func (e *ShutdownError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("shutdown: %d rows were not delivered", e.Total())
+	}
+	return fmt.Sprintf("shutdown: %d rows were not delivered: %v", e.Total(), e.Err)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// Total returns the number of rows that were not delivered to all tables
+func (e *ShutdownError) Total() int {
+	total := 0
+	for _, rows := range e.Undelivered {
+		total += rows
+	}
+	return total
+}
+
+// shutdown closes the Writer and waits for the final result of its batches, including retries, within the deadline.
+// It returns the number of rows that failed or were not inserted by the deadline,
+// inserts still running at the deadline are counted as well, though they may reach Clickhouse later
+func (w *writer) shutdown(ctx context.Context) int {
+	// rows failed earlier were reported by Errors
+	before, _ := w.outstanding.undelivered()
+	closed := make(chan struct{})
+	go func() {
+		w.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+	}
+	// error of the batches is counted below
+	_ = waitBatches(ctx, w.outstanding.list())
+	// rows that have not been flushed by the deadline are counted as pending
+	failed, pending := w.outstanding.undelivered()
+	return int(failed - before + pending)
+}